@@ -0,0 +1,56 @@
+package check
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/linuxerwang/goplz/conf"
+	"github.com/linuxerwang/goplz/conflict"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/vfs"
+	cli "github.com/urfave/cli/v2"
+)
+
+// CheckCmd is for subcommand "check".
+var CheckCmd = &cli.Command{
+	Name:  "check",
+	Usage: "check the mapping of the workspace for conflicts, without mounting it",
+	Action: func(ctx *cli.Context) error {
+		scan.Init(ctx)
+		vfs.Init(ctx)
+
+		// The config is validated when it's loaded.
+		cfg := conf.Cfg()
+		mapper := mapping.New(cfg)
+		tree, err := vfs.NewCompact(".")
+		if err != nil {
+			return err
+		}
+		detector := conflict.New(tree, mapper, true)
+
+		progress := scan.NewProgress()
+		stop := scan.PrintProgress(os.Stdout, progress, time.Second)
+		scan.Walk(".", mapper, detector, progress, nil)
+		progress.Done()
+		stop()
+
+		r := detector.Report()
+		for _, c := range r.Conflicts {
+			level := "warning"
+			if c.Error {
+				level = "error"
+			}
+			fmt.Printf("%s (%s): %s\n", level, c.Policy, c)
+		}
+		if r.Dropped > 0 {
+			fmt.Printf("%d more conflicts not listed.\n", r.Dropped)
+		}
+		fmt.Printf("%d conflicts, %d errors.\n", len(r.Conflicts)+r.Dropped, r.Errors)
+		if r.Errors > 0 {
+			return fmt.Errorf("%d conflicts are errors", r.Errors)
+		}
+		return nil
+	},
+}
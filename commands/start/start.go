@@ -7,26 +7,30 @@ import (
 	"os"
 	osexec "os/exec"
 	"os/signal"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/linuxerwang/goplz/commands/version"
 	"github.com/linuxerwang/goplz/conf"
+	"github.com/linuxerwang/goplz/conflict"
 	"github.com/linuxerwang/goplz/exec"
 	"github.com/linuxerwang/goplz/gopathfs"
 	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/metrics"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/snapshot"
+	"github.com/linuxerwang/goplz/status"
+	"github.com/linuxerwang/goplz/trace"
 	"github.com/linuxerwang/goplz/vfs"
-	"github.com/rjeczalik/notify"
 	cli "github.com/urfave/cli/v2"
 )
 
 var (
-	verbose bool
+	verbose   bool
+	traceFile string
 )
 
 // StartCmd is for subcommand "start".
@@ -44,9 +48,19 @@ var StartCmd = &cli.Command{
 			Value: false,
 			Usage: "True means the current process has been detached from parent process. Do not set it manually, it's only used by goplz to detach itself.",
 		},
+		&cli.BoolFlag{
+			Name:  "fuse_debug",
+			Value: false,
+			Usage: "print the FUSE requests and responses, very verbose.",
+		},
+		&cli.StringFlag{
+			Name:  "trace",
+			Usage: "trace the file system operations and the workspace changes to `FILE` as JSON lines, to be replayed by goplz trace replay.",
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		verbose = ctx.Bool("verbose")
+		traceFile = ctx.String("trace")
 
 		fmt.Printf("Starting goplz ...\n")
 
@@ -87,17 +101,43 @@ var StartCmd = &cli.Command{
 		}
 
 		gopathfs.Init(ctx)
+		scan.Init(ctx)
 		vfs.Init(ctx)
 
+		status.Start(cfg.GoplzStatus, time.Second)
+		defer status.Stop()
+
+		if ttl := attrCacheTTL(cfg); ttl > 0 {
+			vfs.SetAttrCacheTTL(ttl)
+			status.Register("attr_cache", func() interface{} {
+				return vfs.AttrCacheStats()
+			})
+		}
+
 		mapper := mapping.New(cfg)
-		fs := createVirtualFS(cfg, mapper)
+		var dirs *scan.DirSet
+		if cfg.Settings.Snapshot {
+			if cfg.Settings.Lazy {
+				log.Println("Snapshot is not supported in lazy mode, ignored.")
+			} else {
+				dirs = &scan.DirSet{}
+			}
+		}
+		fs, lazy := createVirtualFS(cfg, mapper, dirs, !detach)
 
-		startGopathFS(cfg, detach, fs, mapper)
+		gpfs := startGopathFS(cfg, detach, fs, mapper, lazy, dirs)
 
+		if dirs != nil {
+			saveSnapshot(cfg, mapper, fs, dirs, gpfs.DroppedChanges())
+		}
 		return nil
 	},
 }
 
+func attrCacheTTL(cfg *conf.Config) time.Duration {
+	return time.Duration(cfg.Settings.AttrCacheTtlMs) * time.Millisecond
+}
+
 func startIDE(cfg *conf.Config) {
 	cmd := fmt.Sprintf("%s %s/src", cfg.Settings.IdeCmd, cfg.Settings.VirtualGoPath)
 	if err := exec.RunCommand(cmd); err != nil {
@@ -122,83 +162,129 @@ func detachProcess() (int, error) {
 	return pid, nil
 }
 
-func createVirtualFS(cfg *conf.Config, mapper mapping.SourceMapper) vfs.FileSystem {
-	fs, err := vfs.New(".")
+// createVirtualFS creates the virtual file system. In lazy mode, only the
+// actual directories whose rules can't be reversed are scanned upfront, and
+// the returned scan.Lazy populates the rest on first access. If dirs is not
+// nil, the snapshot saved at the last exit is restored if possible. The
+// conflicts between the mapped files are detected as they are tracked.
+func createVirtualFS(cfg *conf.Config, mapper mapping.SourceMapper, dirs *scan.DirSet, foreground bool) (vfs.FileSystem, *scan.Lazy) {
+	newFS := vfs.New
+	if cfg.Settings.CompactVfs {
+		newFS = vfs.NewCompact
+	}
+	tree, err := newFS(".")
 	if err != nil {
 		panic(err)
 	}
+	detector := conflict.New(tree, mapper, cfg.Settings.CheckCaseConflicts)
+	status.Register("conflicts", func() interface{} {
+		return detector.Report()
+	})
+	var fs vfs.FileSystem = detector
 
-	filepath.Walk(".", func(actual string, info os.FileInfo, err error) error {
-		virtual, readonly, st := mapper.Map(actual)
-		if st == mapping.Excluded {
-			return filepath.SkipDir
-		}
-		if virtual != "" {
-			fs.Track(virtual, actual, readonly)
-		}
-		return nil
+	progress := scan.NewProgress()
+	status.Register("scan", func() interface{} {
+		return progress.Report()
 	})
+	if foreground {
+		stop := scan.PrintProgress(os.Stdout, progress, time.Second)
+		defer stop()
+	}
+
+	var lazy *scan.Lazy
+	if cfg.Settings.Lazy {
+		lazy = scan.NewLazy(mapper, fs)
+		status.Register("lazy", func() interface{} {
+			return lazy.Report()
+		})
+		for _, dir := range mapper.EagerDirs() {
+			scan.Walk(dir, mapper, fs, progress, nil)
+		}
+	} else if dirs == nil || !restoreSnapshot(cfg, mapper, fs, dirs, progress) {
+		scan.Walk(".", mapper, fs, progress, dirs)
+	}
+	progress.Done()
 
 	if verbose {
 		log.Printf("File System:\n%s", fs)
 	}
-	return fs
+	return fs, lazy
 }
 
-func startGopathFS(cfg *conf.Config, detach bool, fs vfs.FileSystem, mapper mapping.SourceMapper) {
-	absWorkspace, err := filepath.Abs(cfg.Workspace)
+// restoreSnapshot restores the snapshot into fs, it returns false if there
+// is no usable snapshot.
+func restoreSnapshot(cfg *conf.Config, mapper mapping.SourceMapper, fs vfs.FileSystem, dirs *scan.DirSet, progress *scan.Progress) bool {
+	var report *snapshot.Report
+	defer func() {
+		status.Register("snapshot", func() interface{} {
+			return report
+		})
+	}()
+
+	s, err := snapshot.Load(cfg.GoplzSnapshot, version.Version, cfg.Hash())
 	if err != nil {
-		panic(err)
+		if !os.IsNotExist(err) {
+			log.Printf("Discard snapshot %s, %v.\n", cfg.GoplzSnapshot, err)
+			os.Remove(cfg.GoplzSnapshot)
+		}
+		report = &snapshot.Report{Error: err.Error()}
+		return false
 	}
+	report = s.Restore(mapper, fs, dirs, progress)
+	if verbose {
+		log.Printf("Restored snapshot %s, %d entries in %d directories, %d directories changed.\n",
+			cfg.GoplzSnapshot, report.Entries, report.Dirs, report.ChangedDirs)
+	}
+	return true
+}
 
-	// Create a FUSE virtual file system on cfg.Settings.VirtualGoPath.
-	var gpfs *pathfs.PathNodeFs
-	gpfs = pathfs.NewPathNodeFs(gopathfs.NewGoPathFs(cfg, fs, mapper, func(ei notify.EventInfo) {
-		actual, _ := filepath.Rel(absWorkspace, ei.Path())
-		if verbose {
-			log.Println("file changed:", actual, ei.Event(), ei.Sys())
-		}
+// saveSnapshot saves the snapshot of fs. The snapshot is removed instead if
+// some changes were dropped, the next start has to scan the workspace as fs
+// might be stale while the mtimes of the directories are current.
+func saveSnapshot(cfg *conf.Config, mapper mapping.SourceMapper, fs vfs.FileSystem, dirs *scan.DirSet, dropped int64) {
+	if dropped > 0 {
+		log.Printf("Not saving snapshot %s, %d changes were dropped.\n", cfg.GoplzSnapshot, dropped)
+		os.Remove(cfg.GoplzSnapshot)
+		return
+	}
+	if err := snapshot.Save(cfg.GoplzSnapshot, version.Version, cfg.Hash(), mapper, fs, dirs); err != nil {
+		log.Printf("Failed to save snapshot %s, %v.\n", cfg.GoplzSnapshot, err)
+	}
+}
 
-		virtual, readonly, st := mapper.Map(actual)
-		if st == mapping.Excluded || st == mapping.Unmatched {
-			log.Printf("file %s is excluded or unmatched\n", actual)
-			return
+func startGopathFS(cfg *conf.Config, detach bool, fs vfs.FileSystem, mapper mapping.SourceMapper, lazy *scan.Lazy, dirs *scan.DirSet) *gopathfs.GoPathFs {
+	// Create a FUSE virtual file system on cfg.Settings.VirtualGoPath.
+	gpfs := gopathfs.NewGoPathFs(cfg, fs, mapper, lazy)
+	gpfs.RecordDirs(dirs)
+	if traceFile != "" {
+		w, err := trace.Create(traceFile)
+		if err != nil {
+			fmt.Printf("Failed to create trace file %s, %v\n", traceFile, err)
+			os.Exit(2)
 		}
-
-		switch ei.Event() {
-		case notify.Create, notify.Rename:
-			fi, err := os.Stat(actual)
-			if err != nil {
-				log.Printf("Failed to stat actual file %s, %v\n", actual, err)
-				return
-			}
-			if fi.IsDir() {
-				filepath.Walk(actual, func(ac string, info os.FileInfo, err error) error {
-					vi, readonly, st := mapper.Map(ac)
-					if st == mapping.Excluded {
-						return filepath.SkipDir
-					}
-					if vi != "" {
-						fs.Track(vi, ac, readonly)
-					}
-					return nil
-				})
-			} else {
-				fs.Track(virtual, actual, readonly)
-			}
-		case notify.Remove:
-			fs.Untrack(virtual)
+		defer w.Close()
+		gpfs.SetTracer(w)
+	}
+	if addr := cfg.Settings.MetricsAddress; addr != "" {
+		srv, err := metrics.Serve(addr)
+		if err != nil {
+			fmt.Printf("Failed to serve metrics on %s, %v\n", addr, err)
+			os.Exit(2)
 		}
-		// TODO: is the line needed?
-		// gpfs.EntryNotify(filepath.Dir(virtual), filepath.Base(virtual))
-	}), nil)
+		defer srv.Close()
+		gpfs.EnableMetrics()
+		fmt.Printf("Serving metrics on %s.\n", addr)
+	}
 
 	fmt.Printf("Fuse mount %s\n", cfg.Settings.VirtualGoPath)
-	server, _, err := nodefs.MountRoot(cfg.Settings.VirtualGoPath, gpfs.Root(), nil)
+	server, err := gpfs.Mount(cfg.Settings.VirtualGoPath)
 	if err != nil {
 		fmt.Printf("Mount fail: %v\n", err)
 		os.Exit(2)
 	}
+	status.Register("fuse", func() interface{} {
+		return gpfs.Report()
+	})
 	fmt.Printf("Mounted Please source folder to %s. \nYou need to set %s as your GOPATH. \n\n Ctrl+C to exit.\n", cfg.Settings.VirtualGoPath, cfg.Settings.VirtualGoPath)
 
 	if detach {
@@ -216,16 +302,17 @@ func startGopathFS(cfg *conf.Config, detach bool, fs vfs.FileSystem, mapper mapp
 	// If a Go IDE is specified, start it with the proper GOPATH.
 	if cfg.Settings.IdeCmd != "" {
 		go func() {
-			server.WaitMount()
 			fmt.Println("\nStarting IDE ...")
 			startIDE(cfg)
 		}()
 	}
 
-	server.Serve()
+	server.Wait()
+	gpfs.Stop()
 
 	makeSureUnmount(cfg)
 	os.Remove(cfg.GoplzPid)
+	return gpfs
 }
 
 func setGracefullExit(cfg *conf.Config, server *fuse.Server) {
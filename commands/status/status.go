@@ -0,0 +1,42 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"syscall"
+
+	"github.com/linuxerwang/goplz/conf"
+	daemonstatus "github.com/linuxerwang/goplz/status"
+	cli "github.com/urfave/cli/v2"
+)
+
+// StatusCmd is for subcommand "status".
+var StatusCmd = &cli.Command{
+	Name:  "status",
+	Usage: "show the status of the running goplz",
+	Action: func(ctx *cli.Context) error {
+		cfg := conf.Cfg()
+		p := cfg.GetExistingProcess()
+		if p == nil || p.Signal(syscall.Signal(0)) != nil {
+			fmt.Println("No existing goplz process found for this workspace")
+			return nil
+		}
+
+		st, err := daemonstatus.Load(cfg.GoplzStatus)
+		if err != nil {
+			fmt.Printf("goplz process %d is running, but its status is not available, %v.\n", p.Pid, err)
+			return nil
+		}
+
+		fmt.Printf("goplz process %d is running, status updated at %s.\n", st.Pid, st.Updated.Format("15:04:05"))
+		for _, name := range st.SectionNames() {
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, st.Sections[name], "  ", "  "); err != nil {
+				return err
+			}
+			fmt.Printf("\n%s:\n  %s\n", name, buf.String())
+		}
+		return nil
+	},
+}
@@ -0,0 +1,137 @@
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/linuxerwang/goplz/conf"
+	"github.com/linuxerwang/goplz/conflict"
+	"github.com/linuxerwang/goplz/gopathfs"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	tracefile "github.com/linuxerwang/goplz/trace"
+	"github.com/linuxerwang/goplz/vfs"
+	cli "github.com/urfave/cli/v2"
+)
+
+// maxDiverged is the number of the diverging records listed.
+const maxDiverged = 100
+
+// TraceCmd is for subcommand "trace".
+var TraceCmd = &cli.Command{
+	Name:  "trace",
+	Usage: "work with the traces recorded by goplz start --trace",
+	Subcommands: []*cli.Command{
+		replayCmd,
+	},
+}
+
+var replayCmd = &cli.Command{
+	Name:      "replay",
+	Usage:     "replay the trace in a temporary workspace with the mapping of this workspace, and report where the results diverge",
+	ArgsUsage: "TRACE_FILE",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "keep",
+			Value: false,
+			Usage: "keep the temporary workspace.",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.Args().Len() != 1 {
+			return errors.New("expected one trace file")
+		}
+		fn, err := filepath.Abs(ctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		gopathfs.Init(ctx)
+		scan.Init(ctx)
+		vfs.Init(ctx)
+
+		// The trace is replayed with the config of the workspace, in an
+		// empty copy of it.
+		cfg := *conf.Cfg()
+		dir, err := ioutil.TempDir("", "goplz-replay-")
+		if err != nil {
+			return err
+		}
+		if ctx.Bool("keep") {
+			fmt.Printf("Replaying in %s.\n", dir)
+		} else {
+			defer os.RemoveAll(dir)
+		}
+		scratch, err := filepath.Rel(cfg.Workspace, cfg.GoplzScratch)
+		if err != nil {
+			return err
+		}
+		cfg.Workspace = dir
+		cfg.GoplzScratch = filepath.Join(dir, scratch)
+		// The actual paths are relative to the workspace.
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+
+		mapper := mapping.New(&cfg)
+		tree, err := vfs.New(".")
+		if err != nil {
+			return err
+		}
+		fs := conflict.New(tree, mapper, cfg.Settings.CheckCaseConflicts)
+		// Track the mapped roots as the initial scan does, the files are
+		// created as the trace is replayed.
+		scan.Walk(".", mapper, fs, nil, nil)
+		gpfs := gopathfs.NewGoPathFs(&cfg, fs, mapper, nil)
+
+		records, diverged := 0, 0
+		err = tracefile.Read(fn, func(line int, r *tracefile.Record) error {
+			records++
+			got := gpfs.Replay(r)
+			if got.Status == r.Status && got.Result == r.Result {
+				return nil
+			}
+			diverged++
+			if diverged <= maxDiverged {
+				fmt.Printf("line %d: %s, recorded %s, replayed %s\n", line, describe(r), outcome(r), outcome(got))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if diverged > maxDiverged {
+			fmt.Printf("%d more diverging records not listed.\n", diverged-maxDiverged)
+		}
+		fmt.Printf("%d records replayed, %d diverged.\n", records, diverged)
+		if diverged > 0 {
+			return fmt.Errorf("%d records diverged", diverged)
+		}
+		return nil
+	},
+}
+
+// describe returns the operation or change of the record.
+func describe(r *tracefile.Record) string {
+	switch {
+	case r.Op == "event":
+		return fmt.Sprintf("%s %s of actual file %s", r.Op, r.Event, r.Actual)
+	case r.NewVirtual != "":
+		return fmt.Sprintf("%s %s to %s", r.Op, r.Virtual, r.NewVirtual)
+	case r.Target != "":
+		return fmt.Sprintf("%s %s to %s", r.Op, r.Virtual, r.Target)
+	}
+	return fmt.Sprintf("%s %s", r.Op, r.Virtual)
+}
+
+// outcome returns the status of the operation, or how the virtual tree was
+// updated for the change.
+func outcome(r *tracefile.Record) string {
+	if r.Op == "event" {
+		return r.Result
+	}
+	return r.Status
+}
@@ -1,7 +1,10 @@
 package conf
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -16,9 +19,12 @@ import (
 )
 
 const (
-	goplzPidFile = ".goplzpid"
-	goplzRcFile  = ".goplzrc"
-	plzCfgFile   = ".plzconfig"
+	goplzPidFile      = ".goplzpid"
+	goplzRcFile       = ".goplzrc"
+	goplzScratchDir   = "plz-out/goplz/scratch"
+	goplzSnapshotFile = "plz-out/goplz/snapshot"
+	goplzStatusFile   = "plz-out/goplz/status"
+	plzCfgFile        = ".plzconfig"
 )
 
 type initializer func(cfg *Config)
@@ -55,10 +61,25 @@ type Config struct {
 
 	GoImportPath  string
 	Workspace     string
+	WorkspaceName string
 	GoplzConf     string
 	GoplzPid      string
+	// GoplzSnapshot is where the snapshot of the virtual tree is saved,
+	// it's in plz-out so that saving it isn't picked up by the mapping.
+	GoplzSnapshot string
+	// GoplzScratch is where the ephemeral files created through the mount
+	// are stored, it's in plz-out so that it's on the same file system as
+	// the workspace but ignored by the VCS.
+	GoplzScratch string
+	// GoplzStatus is where the running daemon saves its status, it's in
+	// plz-out so that the updates aren't picked up by the mapping.
+	GoplzStatus   string
 	PlzConf       string
 	VirtualSrcDir string
+
+	// PlzBlacklistDirs are the directories Please ignores, from the
+	// BlacklistDirs in the [parse] section of .plzconfig.
+	PlzBlacklistDirs []string
 }
 
 // GetExistingProcess returns the existing goplz process for the workspace.
@@ -89,6 +110,25 @@ func (cfg *Config) GetExistingProcess() *os.Process {
 	return p
 }
 
+// Hash returns a hash of the configuration affecting the virtual tree, i.e.
+// the mapping rules, the exclusions and the import path. The other settings
+// can be changed without invalidating the snapshot.
+func (cfg *Config) Hash() string {
+	tree := pb.Settings{
+		HonorPlzBlacklistDirs: cfg.Settings.HonorPlzBlacklistDirs,
+		SourceMapping:         cfg.Settings.SourceMapping,
+		Exclude:               cfg.Settings.Exclude,
+		ExcludeGlob:           cfg.Settings.ExcludeGlob,
+		IgnoreFile:            cfg.Settings.IgnoreFile,
+	}
+	h := sha256.New()
+	io.WriteString(h, proto.MarshalTextString(&tree))
+	for _, s := range append([]string{cfg.GoImportPath, cfg.Workspace}, cfg.PlzBlacklistDirs...) {
+		io.WriteString(h, "\x00"+s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // HasGoplzRc returns true if the .goplzrc file exists.
 func HasGoplzRc() bool {
 	if _, err := os.Stat(goplzRcFile); err != nil {
@@ -180,14 +220,21 @@ func Cfg() *Config {
 	}
 
 	cfg.Workspace = workspace
+	cfg.WorkspaceName = filepath.Base(workspace)
 	cfg.GoplzConf = filepath.Join(workspace, goplzRcFile)
 	cfg.GoplzPid = filepath.Join(workspace, goplzPidFile)
+	cfg.GoplzSnapshot = filepath.Join(workspace, goplzSnapshotFile)
+	cfg.GoplzScratch = filepath.Join(workspace, goplzScratchDir)
+	cfg.GoplzStatus = filepath.Join(workspace, goplzStatusFile)
 	cfg.PlzConf = filepath.Join(workspace, plzCfgFile)
 
 	plzCfg := struct {
 		Go struct {
 			ImportPath string
 		}
+		Parse struct {
+			BlacklistDirs []string
+		}
 	}{}
 	if err := gcfg.FatalOnly(gcfg.ReadFileInto(&plzCfg, plzCfgFile)); err != nil {
 		fmt.Printf("Failed to parse plz config file %s, %+v.\n", plzCfgFile, err)
@@ -200,9 +247,11 @@ func Cfg() *Config {
 		os.Exit(1)
 	}
 	fmt.Printf("Go Import Path: %s\n", cfg.GoImportPath)
+	cfg.PlzBlacklistDirs = plzCfg.Parse.BlacklistDirs
 
 	settings := &pb.Settings{}
 	parseCfg(goplzRcFile, settings)
+	applyDeprecated(settings)
 	if settings.VirtualGoPath == "REPLACE_ME" {
 		fmt.Printf("virtual_go_path was not set.")
 		os.Exit(1)
@@ -219,6 +268,25 @@ func Cfg() *Config {
 	return &cfg
 }
 
+// applyDeprecated applies the deprecated settings to the mount options
+// replacing them.
+func applyDeprecated(settings *pb.Settings) {
+	if !settings.DisablePassthrough && !settings.DefaultPermissions {
+		return
+	}
+	if settings.MountOptions == nil {
+		settings.MountOptions = &pb.MountOptions{}
+	}
+	if settings.DisablePassthrough {
+		log.Println("disable_passthrough is deprecated, use mount_options.disable_passthrough.")
+		settings.MountOptions.DisablePassthrough = true
+	}
+	if settings.DefaultPermissions {
+		log.Println("default_permissions is deprecated, use mount_options.default_permissions.")
+		settings.MountOptions.DefaultPermissions = true
+	}
+}
+
 func parseCfg(fn string, cfg proto.Message) {
 	b, err := ioutil.ReadFile(fn)
 	if err != nil {
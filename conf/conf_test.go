@@ -0,0 +1,77 @@
+package conf
+
+import (
+	"testing"
+
+	pb "github.com/linuxerwang/goplz/conf/proto"
+)
+
+func hashConfig() *Config {
+	return &Config{
+		GoImportPath: "example.com/ws",
+		Workspace:    "/ws",
+		Settings: &pb.Settings{
+			SourceMapping: []*pb.SourceMapping{{
+				FromActualDir: "plz-out/gen",
+				Filter:        []*pb.SourceFilter{{Match: `.*\.pb\.go$`, ToVirtualDir: "src"}},
+			}},
+			Exclude: []string{".git"},
+		},
+	}
+}
+
+func TestHashIgnoresUnrelatedSettings(t *testing.T) {
+	want := hashConfig().Hash()
+	for name, change := range map[string]func(s *pb.Settings){
+		"ide_cmd":           func(s *pb.Settings) { s.IdeCmd = "code" },
+		"lazy":              func(s *pb.Settings) { s.Lazy = true },
+		"attr_cache_ttl_ms": func(s *pb.Settings) { s.AttrCacheTtlMs = 1000 },
+		"metrics_address":   func(s *pb.Settings) { s.MetricsAddress = "localhost:6060" },
+		"mount_options":     func(s *pb.Settings) { s.MountOptions = &pb.MountOptions{AllowOther: true} },
+	} {
+		cfg := hashConfig()
+		change(cfg.Settings)
+		if got := cfg.Hash(); got != want {
+			t.Errorf("changing %s changed the hash", name)
+		}
+	}
+}
+
+func TestHashTreeSettings(t *testing.T) {
+	base := hashConfig().Hash()
+	for name, change := range map[string]func(cfg *Config){
+		"source_mapping":           func(cfg *Config) { cfg.Settings.SourceMapping[0].Filter[0].Prepend = "x" },
+		"exclude":                  func(cfg *Config) { cfg.Settings.Exclude = append(cfg.Settings.Exclude, "tmp") },
+		"exclude_glob":             func(cfg *Config) { cfg.Settings.ExcludeGlob = []string{"*.log"} },
+		"ignore_file":              func(cfg *Config) { cfg.Settings.IgnoreFile = []string{".gitignore"} },
+		"honor_plz_blacklist_dirs": func(cfg *Config) { cfg.Settings.HonorPlzBlacklistDirs = true },
+		"import path":              func(cfg *Config) { cfg.GoImportPath = "example.com/other" },
+		"blacklist dirs":           func(cfg *Config) { cfg.PlzBlacklistDirs = []string{"third_party"} },
+	} {
+		cfg := hashConfig()
+		change(cfg)
+		if cfg.Hash() == base {
+			t.Errorf("changing %s didn't change the hash", name)
+		}
+	}
+}
+
+func TestApplyDeprecated(t *testing.T) {
+	s := &pb.Settings{DisablePassthrough: true, DefaultPermissions: true}
+	applyDeprecated(s)
+	if mo := s.GetMountOptions(); !mo.GetDisablePassthrough() || !mo.GetDefaultPermissions() {
+		t.Errorf("mount_options %+v, want the deprecated settings applied", mo)
+	}
+
+	s = &pb.Settings{DisablePassthrough: true, MountOptions: &pb.MountOptions{ReadOnly: true}}
+	applyDeprecated(s)
+	if mo := s.GetMountOptions(); !mo.GetDisablePassthrough() || mo.GetDefaultPermissions() || !mo.GetReadOnly() {
+		t.Errorf("mount_options %+v, want disable_passthrough added to them", mo)
+	}
+
+	s = &pb.Settings{}
+	applyDeprecated(s)
+	if s.MountOptions != nil {
+		t.Errorf("mount_options %+v, want none", s.MountOptions)
+	}
+}
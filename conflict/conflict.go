@@ -0,0 +1,395 @@
+package conflict
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	pb "github.com/linuxerwang/goplz/conf/proto"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+const (
+	// maxConflicts bounds the conflicts kept for the report, a bad rule can
+	// conflict on every file it maps.
+	maxConflicts = 1000
+	// trackStripes is the number of the locks serializing the tracking of
+	// the virtual files, by the hash of their paths.
+	trackStripes = 256
+)
+
+var pathSeparator = string(os.PathSeparator)
+
+// Kind is the kind of a conflict.
+type Kind string
+
+const (
+	// Sources is several actual files mapped to the same virtual file.
+	Sources Kind = "sources"
+	// Case is virtual paths differing only by case, they collide on the
+	// case-insensitive file systems, e.g. on macOS.
+	Case Kind = "case"
+	// Type is a file mapped where a directory is needed, or the other way
+	// around.
+	Type Kind = "type"
+)
+
+// Conflict is a conflict between the mapped files.
+type Conflict struct {
+	Kind    Kind   `json:"kind"`
+	Virtual string `json:"virtual"`
+	// Other is the virtual path differing only by case from Virtual.
+	Other string `json:"other,omitempty"`
+	// Actual is the actual files involved, the shown one first.
+	Actual []string `json:"actual,omitempty"`
+	Policy string   `json:"policy"`
+	Error  bool     `json:"error"`
+}
+
+func (c *Conflict) String() string {
+	switch c.Kind {
+	case Case:
+		return fmt.Sprintf("virtual paths %s and %s differ only by case", c.Virtual, c.Other)
+	case Type:
+		return fmt.Sprintf("virtual path %s is mapped both as a file and a directory, from %s", c.Virtual, strings.Join(c.Actual, ", "))
+	}
+	return fmt.Sprintf("virtual file %s is mapped from %s, %s is shown", c.Virtual, strings.Join(c.Actual, ", "), c.Actual[0])
+}
+
+// Report is a point-in-time report of the conflicts.
+type Report struct {
+	Conflicts []*Conflict `json:"conflicts"`
+	Errors    int         `json:"errors"`
+	// Dropped is the number of the conflicts not listed, beyond the first
+	// maxConflicts. They're counted in Errors.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// Detector is a vfs.FileSystem detecting the conflicts when the files are
+// tracked, and resolving them according to the conflict policies of the
+// rules:
+//   - several actual files mapped to the same virtual file are all tracked
+//     with the PRIORITY policy, only the one ranking first otherwise. The
+//     actual directories mapped to the same virtual directory are merged;
+//   - a file isn't tracked where a directory is already tracked, and the
+//     other way around;
+//   - the virtual paths differing only by case are all tracked. They're
+//     only checked if checkCase is set, the upper case paths are indexed
+//     for it.
+type Detector struct {
+	vfs.FileSystem
+	mapper mapping.SourceMapper
+
+	// tracking serializes tracking the same virtual file, so that its
+	// conflicts are detected and resolved consistently. The files are
+	// tracked in parallel by the scan.
+	tracking [trackStripes]sync.Mutex
+	// mu guards the maps below, it's not held while calling into the tree
+	// or making syscalls.
+	mu sync.Mutex
+	// cases is the virtual paths having upper case letters by their lower
+	// case paths, nil if the case isn't checked.
+	cases     map[string]string
+	conflicts map[string]*Conflict
+	// dropped is the conflicts not kept beyond maxConflicts, so that
+	// they're counted and logged once, and kept once the resolved
+	// conflicts make room.
+	dropped map[string]*Conflict
+}
+
+// Make sure *Detector implements vfs.FileSystem.
+var _ = (vfs.FileSystem)((*Detector)(nil))
+
+// New creates and returns a new Detector tracking the files in fs. The
+// virtual paths differing only by case are detected if checkCase is true.
+func New(fs vfs.FileSystem, mapper mapping.SourceMapper, checkCase bool) *Detector {
+	d := Detector{
+		FileSystem: fs,
+		mapper:     mapper,
+		conflicts:  map[string]*Conflict{},
+		dropped:    map[string]*Conflict{},
+	}
+	if checkCase {
+		d.cases = map[string]string{}
+	}
+	return &d
+}
+
+func (d *Detector) Track(virtual, actual string, readonly bool) {
+	d.TrackSource(virtual, vfs.Source{Actual: actual, Readonly: readonly})
+}
+
+func (d *Detector) TrackSource(virtual string, src vfs.Source) {
+	mu := d.lock(virtual)
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, remPath := d.FileSystem.MatchPath(virtual)
+	if len(remPath) == 0 {
+		if e.Parent() == nil || src.Actual == "" {
+			return
+		}
+		track, conflicting := d.checkSources(virtual, e, src)
+		if track {
+			d.FileSystem.TrackSource(virtual, src)
+		}
+		if conflicting {
+			d.resolve(virtual, e)
+		}
+		return
+	}
+	if !d.checkParent(virtual, e, remPath, src) {
+		return
+	}
+	if d.cases != nil {
+		d.checkCase(virtual, remPath, src)
+	}
+	d.FileSystem.TrackSource(virtual, src)
+}
+
+// lock returns the lock serializing the tracking of the virtual file.
+func (d *Detector) lock(virtual string) *sync.Mutex {
+	// FNV-1a.
+	h := uint32(2166136261)
+	for i := 0; i < len(virtual); i++ {
+		h ^= uint32(virtual[i])
+		h *= 16777619
+	}
+	return &d.tracking[h%trackStripes]
+}
+
+// checkSources checks the actual file tracked at the existing virtual file.
+// It returns whether the file must be tracked, and whether the files tracked
+// at the virtual file conflict. The directories don't, their children are
+// merged.
+func (d *Detector) checkSources(virtual string, e vfs.Entry, src vfs.Source) (track, conflicting bool) {
+	sources := e.Sources()
+	for _, s := range sources {
+		if s.Actual == src.Actual {
+			// The file is tracked again, e.g. by the watcher.
+			return true, false
+		}
+	}
+	dir := src.Dir
+	if len(sources) == 0 {
+		// The intermediate directory is needed by the files in it.
+		if !dir {
+			d.report(&Conflict{Kind: Type, Virtual: virtual, Actual: []string{src.Actual}}, src)
+		}
+		return dir, false
+	}
+	if sources[0].Dir != dir {
+		d.report(&Conflict{Kind: Type, Virtual: virtual, Actual: []string{sources[0].Actual, src.Actual}}, append(sources, src)...)
+		return false, false
+	}
+	if dir {
+		return true, false
+	}
+	all := append(sources, src)
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].Priority != all[j].Priority {
+			return all[i].Priority < all[j].Priority
+		}
+		return all[i].Actual < all[j].Actual
+	})
+	actual := make([]string, len(all))
+	for i, s := range all {
+		actual[i] = s.Actual
+	}
+	d.report(&Conflict{Kind: Sources, Virtual: virtual, Actual: actual}, all...)
+	return true, true
+}
+
+// resolve keeps only the source ranking first of the virtual file, unless
+// the policy of its sources is PRIORITY.
+func (d *Detector) resolve(virtual string, e vfs.Entry) {
+	sources := e.Sources()
+	if d.policy(sources...) == pb.ConflictPolicy_PRIORITY {
+		return
+	}
+	for _, s := range sources[1:] {
+		d.FileSystem.UntrackSource(virtual, s.Actual)
+	}
+}
+
+// checkParent checks the deepest existing entry e of the new virtual file is
+// a directory, and returns false if the file must not be tracked.
+func (d *Detector) checkParent(virtual string, e vfs.Entry, remPath []string, src vfs.Source) bool {
+	sources := e.Sources()
+	if e.Parent() == nil || len(sources) == 0 || sources[0].Dir {
+		return true
+	}
+	dirs := strings.Split(virtual, pathSeparator)
+	parentVirtual := strings.Join(dirs[:len(dirs)-len(remPath)], pathSeparator)
+	actual := []string{sources[0].Actual}
+	if src.Actual != "" {
+		actual = append(actual, src.Actual)
+	}
+	d.report(&Conflict{Kind: Type, Virtual: parentVirtual, Actual: actual}, append(sources, src)...)
+	return false
+}
+
+// checkCase checks the new virtual paths don't differ only by case from the
+// existing ones.
+func (d *Detector) checkCase(virtual string, remPath []string, src vfs.Source) {
+	dirs := strings.Split(virtual, pathSeparator)
+	for i := len(dirs) - len(remPath); i < len(dirs); i++ {
+		path := strings.Join(dirs[:i+1], pathSeparator)
+		lower := strings.ToLower(path)
+		d.mu.Lock()
+		p, ok := d.cases[lower]
+		d.mu.Unlock()
+		other := ""
+		if ok && p != path && d.exists(p) {
+			other = p
+		} else if lower != path && d.exists(lower) {
+			other = lower
+		}
+		if lower != path && other == "" {
+			d.mu.Lock()
+			d.cases[lower] = path
+			d.mu.Unlock()
+		}
+		if other == "" {
+			continue
+		}
+		c := Conflict{Kind: Case, Virtual: path, Other: other}
+		sources := []vfs.Source{src}
+		if e, remPath := d.FileSystem.MatchPath(other); len(remPath) == 0 {
+			sources = append(sources, e.Sources()...)
+		}
+		for _, s := range sources {
+			if s.Actual != "" {
+				c.Actual = append(c.Actual, s.Actual)
+			}
+		}
+		d.report(&c, sources...)
+		// The paths in the new directory conflict too, once is enough.
+		return
+	}
+}
+
+// report records the conflict between the sources, and logs it the first
+// time. Beyond maxConflicts, only the key of a new conflict is kept.
+func (d *Detector) report(c *Conflict, sources ...vfs.Source) {
+	policy := d.policy(sources...)
+	c.Policy = policy.String()
+	c.Error = policy == pb.ConflictPolicy_ERROR
+
+	key := string(c.Kind) + ":" + c.Virtual
+	d.mu.Lock()
+	_, kept := d.conflicts[key]
+	_, dropped := d.dropped[key]
+	if kept || len(d.conflicts) < maxConflicts {
+		d.conflicts[key] = c
+		delete(d.dropped, key)
+	} else {
+		d.dropped[key] = c
+	}
+	d.mu.Unlock()
+
+	if !kept && !dropped {
+		log.Printf("Conflict (%s): %s.\n", c.Policy, c)
+	}
+}
+
+// policy returns the strictest conflict policy of the rules of the sources.
+func (d *Detector) policy(sources ...vfs.Source) pb.ConflictPolicy {
+	policy := pb.ConflictPolicy_PRIORITY
+	for _, s := range sources {
+		if s.Actual == "" {
+			continue
+		}
+		if p := d.mapper.ConflictPolicy(s.Priority); p > policy {
+			policy = p
+		}
+	}
+	return policy
+}
+
+func (d *Detector) exists(virtual string) bool {
+	_, remPath := d.FileSystem.MatchPath(virtual)
+	return len(remPath) == 0
+}
+
+// Report returns the current conflicts. The conflicts resolved since they
+// were detected, e.g. by removing a file, are left out, and forgotten.
+func (d *Detector) Report() *Report {
+	// The actual files are statted without holding the lock.
+	d.mu.Lock()
+	detected := make(map[string]*Conflict, len(d.conflicts)+len(d.dropped))
+	for key, c := range d.conflicts {
+		detected[key] = c
+	}
+	for key, c := range d.dropped {
+		detected[key] = c
+	}
+	d.mu.Unlock()
+	resolved := map[string]*Conflict{}
+	for key, c := range detected {
+		if !d.current(c) {
+			resolved[key] = c
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, c := range resolved {
+		// Unless it was detected again meanwhile.
+		if d.conflicts[key] == c {
+			delete(d.conflicts, key)
+		}
+		if d.dropped[key] == c {
+			delete(d.dropped, key)
+		}
+	}
+	for key, c := range d.dropped {
+		if len(d.conflicts) >= maxConflicts {
+			break
+		}
+		d.conflicts[key] = c
+		delete(d.dropped, key)
+	}
+
+	r := Report{Dropped: len(d.dropped)}
+	for _, c := range d.conflicts {
+		r.Conflicts = append(r.Conflicts, c)
+		if c.Error {
+			r.Errors++
+		}
+	}
+	for _, c := range d.dropped {
+		if c.Error {
+			r.Errors++
+		}
+	}
+	sort.Slice(r.Conflicts, func(i, j int) bool {
+		if r.Conflicts[i].Virtual != r.Conflicts[j].Virtual {
+			return r.Conflicts[i].Virtual < r.Conflicts[j].Virtual
+		}
+		return r.Conflicts[i].Kind < r.Conflicts[j].Kind
+	})
+	return &r
+}
+
+// current returns true if the conflict still exists.
+func (d *Detector) current(c *Conflict) bool {
+	if c.Kind == Case {
+		return d.exists(c.Virtual) && d.exists(c.Other)
+	}
+	existing := 0
+	for _, actual := range c.Actual {
+		if _, err := os.Lstat(actual); err == nil {
+			existing++
+		}
+	}
+	if c.Kind == Sources {
+		return existing > 1
+	}
+	return existing == len(c.Actual) && d.exists(c.Virtual)
+}
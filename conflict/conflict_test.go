@@ -0,0 +1,233 @@
+package conflict
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/linuxerwang/goplz/conf"
+	pb "github.com/linuxerwang/goplz/conf/proto"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+// detect scans a workspace where plz-out/gen is mapped over the workspace
+// with the policy, and returns the conflicts by kind and virtual path.
+func detect(t *testing.T, policy pb.ConflictPolicy, checkCase bool) (*Detector, map[string]*Conflict) {
+	ws := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, dir := range []string{"a/Foo", "plz-out/gen/a/foo", "plz-out/gen/a/z.go"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a/u.go", "a/z.go", "a/Foo/x.go", "plz-out/gen/a/u.go", "plz-out/gen/a/foo/y.go"} {
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &conf.Config{
+		Settings: &pb.Settings{
+			SourceMapping: []*pb.SourceMapping{{
+				FromActualDir:  "plz-out/gen",
+				ConflictPolicy: policy,
+				Filter: []*pb.SourceFilter{{
+					Match:        `.*`,
+					ToVirtualDir: "src",
+					Strip:        "plz-out/gen",
+					Prepend:      "{{.GoImportPath}}",
+				}},
+			}},
+		},
+		GoImportPath: "example.com/ws",
+		Workspace:    ws,
+	}
+	mapper := mapping.New(cfg)
+	tree, err := vfs.New(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(tree, mapper, checkCase)
+	scan.Walk(".", mapper, d, nil, nil)
+
+	conflicts := map[string]*Conflict{}
+	for _, c := range d.Report().Conflicts {
+		conflicts[string(c.Kind)+":"+strings.TrimPrefix(c.Virtual, "src/example.com/ws/")] = c
+	}
+	return d, conflicts
+}
+
+func TestDetect(t *testing.T) {
+	for _, policy := range []pb.ConflictPolicy{
+		pb.ConflictPolicy_PRIORITY,
+		pb.ConflictPolicy_FIRST_WINS,
+		pb.ConflictPolicy_ERROR,
+	} {
+		t.Run(policy.String(), func(t *testing.T) {
+			d, conflicts := detect(t, policy, true)
+
+			c := conflicts["sources:a/u.go"]
+			if c == nil {
+				t.Fatalf("sources conflict not detected, got %v", conflicts)
+			}
+			if c.Policy != policy.String() || c.Error != (policy == pb.ConflictPolicy_ERROR) {
+				t.Errorf("conflict has policy %s error %v", c.Policy, c.Error)
+			}
+			e, _ := d.MatchPath("src/example.com/ws/a/u.go")
+			sources := 1
+			if policy == pb.ConflictPolicy_PRIORITY {
+				sources = 2
+			}
+			if len(e.Sources()) != sources {
+				t.Errorf("virtual file has sources %v, expected %d", e.Sources(), sources)
+			}
+			if conflicts["type:a/z.go"] == nil {
+				t.Errorf("type conflict not detected, got %v", conflicts)
+			}
+			if c := conflicts["case:a/foo"]; c == nil || c.Other != "src/example.com/ws/a/Foo" {
+				t.Errorf("case conflict not detected, got %v", conflicts)
+			}
+		})
+	}
+}
+
+func TestCaseNotCheckedByDefault(t *testing.T) {
+	d, conflicts := detect(t, pb.ConflictPolicy_PRIORITY, false)
+	if c := conflicts["case:a/foo"]; c != nil {
+		t.Errorf("case conflict detected, %s", c)
+	}
+	if d.cases != nil {
+		t.Errorf("paths indexed by case, %v", d.cases)
+	}
+	if conflicts["sources:a/u.go"] == nil {
+		t.Errorf("sources conflict not detected, got %v", conflicts)
+	}
+}
+
+func TestDroppedCountedOnce(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	d := New(nil, nil, false)
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < maxConflicts+5; i++ {
+			d.report(&Conflict{Kind: Sources, Virtual: fmt.Sprintf("src/%d.go", i), Actual: []string{filepath.Join("a", fmt.Sprint(i))}})
+		}
+	}
+
+	if len(d.conflicts) != maxConflicts {
+		t.Errorf("kept %d conflicts, expected %d", len(d.conflicts), maxConflicts)
+	}
+	if len(d.dropped) != 5 {
+		t.Errorf("dropped %d conflicts, expected 5", len(d.dropped))
+	}
+	if n := strings.Count(logs.String(), "\n"); n != maxConflicts+5 {
+		t.Errorf("logged %d conflicts, expected each once, %d", n, maxConflicts+5)
+	}
+}
+
+func TestTypeFromSources(t *testing.T) {
+	tree, err := vfs.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(tree, mapping.New(&conf.Config{Settings: &pb.Settings{}}), false)
+	// The actual files don't exist, the types tracked are used.
+	d.TrackSource("src/a", vfs.Source{Actual: "missing/a", Dir: true})
+	d.TrackSource("src/a", vfs.Source{Actual: "missing/gen/a", Dir: true})
+	d.TrackSource("src/a/f.go", vfs.Source{Actual: "missing/a/f.go"})
+	d.TrackSource("src/a/f.go/g.go", vfs.Source{Actual: "missing/a/f.go/g.go"})
+	d.TrackSource("src/b", vfs.Source{Actual: "missing/b"})
+	d.TrackSource("src/b", vfs.Source{Actual: "missing/gen/b", Dir: true})
+
+	kinds := map[string]Kind{}
+	for _, c := range d.conflicts {
+		kinds[c.Virtual] = c.Kind
+	}
+	want := map[string]Kind{"src/a/f.go": Type, "src/b": Type}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got conflicts %v, want %v", kinds, want)
+	}
+	if e, _ := d.MatchPath("src/a"); len(e.Sources()) != 2 {
+		t.Errorf("directories not merged, sources %v", e.Sources())
+	}
+}
+
+func TestTrackParallel(t *testing.T) {
+	tree, err := vfs.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(tree, mapping.New(&conf.Config{Settings: &pb.Settings{}}), true)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				d.TrackSource(fmt.Sprintf("src/d%d", i%10), vfs.Source{Actual: fmt.Sprintf("w%d/d%d", w, i%10), Dir: true})
+				d.TrackSource(fmt.Sprintf("src/d%d/f%d.go", i%10, i), vfs.Source{Actual: fmt.Sprintf("w%d/f%d.go", w, i)})
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		virtual := fmt.Sprintf("src/d%d/f%d.go", i%10, i)
+		if e, _ := d.MatchPath(virtual); len(e.Sources()) != 8 {
+			t.Fatalf("%s has sources %v, want 8", virtual, e.Sources())
+		}
+		if d.conflicts["sources:"+virtual] == nil {
+			t.Errorf("conflict of %s not detected", virtual)
+		}
+	}
+}
+
+func TestDroppedForgottenOnceResolved(t *testing.T) {
+	ws := t.TempDir()
+	d := New(nil, nil, false)
+	for i := 0; i < maxConflicts+5; i++ {
+		actual := []string{filepath.Join(ws, fmt.Sprint(i)), filepath.Join(ws, "gen", fmt.Sprint(i))}
+		d.report(&Conflict{Kind: Sources, Virtual: fmt.Sprintf("src/%d.go", i), Actual: actual})
+	}
+	// The actual files don't exist, the conflicts were resolved.
+	if r := d.Report(); len(r.Conflicts) != 0 || r.Dropped != 0 {
+		t.Errorf("got %d conflicts and %d dropped after they were resolved", len(r.Conflicts), r.Dropped)
+	}
+}
+
+func TestDroppedKeptOnceRoomIsMade(t *testing.T) {
+	ws := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(ws, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := New(nil, nil, false)
+	for i := 0; i < maxConflicts; i++ {
+		d.report(&Conflict{Kind: Sources, Virtual: fmt.Sprintf("src/%d.go", i), Actual: []string{"missing", "missing/gen"}})
+	}
+	d.report(&Conflict{Kind: Sources, Virtual: "src/ab.go", Actual: []string{filepath.Join(ws, "a"), filepath.Join(ws, "b")}})
+
+	r := d.Report()
+	if len(r.Conflicts) != 1 || r.Conflicts[0].Virtual != "src/ab.go" || r.Dropped != 0 {
+		t.Errorf("got conflicts %v and %d dropped, want the dropped one kept", r.Conflicts, r.Dropped)
+	}
+}
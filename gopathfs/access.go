@@ -0,0 +1,133 @@
+package gopathfs
+
+import (
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// Access checks the access of the caller to the virtual file, against the
+// readonly flag of the entry and the mode and ownership of the actual file.
+// It's only called for access(2) unless the file system is mounted with
+// default_permissions, in which case the kernel checks all the accesses.
+func (gpf *GoPathFs) Access(virtual string, mask uint32, caller *fuse.Caller) syscall.Errno {
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	if len(remPath) != 0 {
+		return syscall.ENOENT
+	}
+	if mask&unix.W_OK != 0 && (entry.Readonly() || entry.Actual() == "") {
+		// The intermediate directories can't be written either.
+		return syscall.EROFS
+	}
+	attr, err := entry.Attr()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if caller != nil && !hasAccess(caller, attr, mask) {
+		return syscall.EACCES
+	}
+	return fs.OK
+}
+
+// hasAccess returns true if the mode of the file grants the access to the
+// caller, as in access(2): the owner, group or other bits apply, whichever
+// matches the caller first.
+func hasAccess(caller *fuse.Caller, attr *fuse.Attr, mask uint32) bool {
+	mask &= unix.R_OK | unix.W_OK | unix.X_OK
+	if mask == 0 {
+		return true
+	}
+	if caller.Uid == 0 {
+		// root can read and write anything, and execute the files
+		// executable by anyone.
+		if mask&unix.X_OK == 0 || attr.IsDir() {
+			return true
+		}
+		return attr.Mode&0111 != 0
+	}
+	var perm uint32
+	switch {
+	case caller.Uid == attr.Uid:
+		perm = attr.Mode >> 6
+	case caller.Gid == attr.Gid || inGroup(caller.Uid, attr.Gid):
+		perm = attr.Mode >> 3
+	default:
+		perm = attr.Mode
+	}
+	return perm&mask == mask
+}
+
+// groupsTTL is how long the supplementary groups of a user are cached.
+const groupsTTL = 30 * time.Second
+
+// userGroups caches the supplementary groups of the users, looking them up
+// may be slow, e.g. through NSS, and the accesses are checked often.
+var userGroups = &groupCache{lookup: lookupGroupIds, ttl: groupsTTL}
+
+// groupCache caches the supplementary groups by uid. The groups are looked
+// up again once they expire, in case they were changed.
+type groupCache struct {
+	lookup func(uid uint32) []string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[uint32]cachedGroups
+}
+
+type cachedGroups struct {
+	gids    []string
+	expires time.Time
+}
+
+// get returns the supplementary groups of the user, from the cache if
+// they haven't expired.
+func (c *groupCache) get(uid uint32) []string {
+	now := time.Now()
+	c.mu.Lock()
+	cg, ok := c.entries[uid]
+	c.mu.Unlock()
+	if ok && now.Before(cg.expires) {
+		return cg.gids
+	}
+
+	// Don't hold the lock while looking them up.
+	cg = cachedGroups{gids: c.lookup(uid), expires: now.Add(c.ttl)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[uint32]cachedGroups{}
+	}
+	c.entries[uid] = cg
+	return cg.gids
+}
+
+// lookupGroupIds returns the supplementary groups of the user, none if the
+// user is unknown.
+func lookupGroupIds(uid uint32) []string {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+	return gids
+}
+
+// inGroup returns true if the user is a member of the supplementary group.
+func inGroup(uid, gid uint32) bool {
+	g := strconv.FormatUint(uint64(gid), 10)
+	for _, id := range userGroups.get(uid) {
+		if id == g {
+			return true
+		}
+	}
+	return false
+}
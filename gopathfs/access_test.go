@@ -0,0 +1,66 @@
+package gopathfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestGroupCache(t *testing.T) {
+	lookups := map[uint32]int{}
+	c := groupCache{
+		lookup: func(uid uint32) []string {
+			lookups[uid]++
+			return []string{"100", "200"}
+		},
+		ttl: 50 * time.Millisecond,
+	}
+
+	for i := 0; i < 3; i++ {
+		if gids := c.get(1000); len(gids) != 2 {
+			t.Fatalf("got groups %v", gids)
+		}
+	}
+	c.get(1001)
+	if lookups[1000] != 1 || lookups[1001] != 1 {
+		t.Errorf("groups looked up %v times, expected once per user", lookups)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c.get(1000)
+	if lookups[1000] != 2 {
+		t.Errorf("expired groups looked up %d times, expected 2", lookups[1000])
+	}
+}
+
+func TestHasAccessSupplementaryGroup(t *testing.T) {
+	saved := userGroups
+	defer func() { userGroups = saved }()
+	userGroups = &groupCache{
+		lookup: func(uid uint32) []string {
+			if uid == 1000 {
+				return []string{"100"}
+			}
+			return nil
+		},
+		ttl: time.Minute,
+	}
+
+	attr := fuse.Attr{Mode: fuse.S_IFREG | 0640, Owner: fuse.Owner{Uid: 1, Gid: 100}}
+	for _, tc := range []struct {
+		uid, gid uint32
+		mask     uint32
+		want     bool
+	}{
+		{1000, 1000, 4, true},
+		{1000, 1000, 2, false},
+		{1001, 1001, 4, false},
+		{1001, 100, 4, true},
+	} {
+		caller := fuse.Caller{Owner: fuse.Owner{Uid: tc.uid, Gid: tc.gid}}
+		if got := hasAccess(&caller, &attr, tc.mask); got != tc.want {
+			t.Errorf("access %o of uid %d gid %d = %v, want %v", tc.mask, tc.uid, tc.gid, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package gopathfs
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// maxSymlinks is the number of symlinks followed when resolving a path, as
+// the kernel's limit.
+const maxSymlinks = 40
+
+// confineRoots returns the resolved directories the actual files are
+// confined to, the workspace and the allowed roots.
+func confineRoots(absWorkspace string, allowed []string) []string {
+	var roots []string
+	for _, root := range append([]string{absWorkspace}, allowed...) {
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(absWorkspace, root)
+		}
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			root = r
+		}
+		roots = append(roots, filepath.Clean(root))
+	}
+	return roots
+}
+
+// confine returns EACCES if the actual file resolves outside the workspace
+// and the allowed roots. The symlinks in its directories are followed, and
+// the file itself too if follow is true, e.g. for the operations opening it.
+// The missing files are resolved from their existing directories.
+func (gpf *GoPathFs) confine(actual string, follow bool) syscall.Errno {
+	resolved, err := resolve(gpf.abs(actual), follow, 0)
+	if err != nil {
+		log.Printf("Failed to resolve actual file %s, %v.\n", actual, err)
+		return fs.ToErrno(err)
+	}
+	for _, root := range gpf.roots {
+		if _, ok := within(root, resolved); ok {
+			return fs.OK
+		}
+	}
+	log.Printf("Refused actual file %s resolving to %s, out of the workspace and the allowed roots.\n", actual, resolved)
+	return syscall.EACCES
+}
+
+// resolve returns the absolute path with the symlinks evaluated. The missing
+// elements at its end are kept as is.
+func resolve(path string, follow bool, depth int) (string, error) {
+	if depth > maxSymlinks {
+		return "", syscall.ELOOP
+	}
+	dir := filepath.Dir(path)
+	if dir == path {
+		return path, nil
+	}
+	rdir, err := filepath.EvalSymlinks(dir)
+	if os.IsNotExist(err) {
+		rdir, err = resolve(dir, true, depth)
+	}
+	if err != nil {
+		if _, ok := err.(*os.PathError); !ok {
+			// EvalSymlinks fails with a plain error on too many links.
+			err = syscall.ELOOP
+		}
+		return "", err
+	}
+	p := filepath.Join(rdir, filepath.Base(path))
+	if !follow {
+		return p, nil
+	}
+	target, err := os.Readlink(p)
+	if err != nil {
+		// Not a symlink, or missing.
+		return p, nil
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(rdir, target)
+	}
+	return resolve(target, true, depth+1)
+}
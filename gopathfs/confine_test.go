@@ -0,0 +1,130 @@
+package gopathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// confineWorkspace creates a workspace with symlinks leading in and out of
+// it, and returns a GoPathFs confined to it.
+func confineWorkspace(t testing.TB) *GoPathFs {
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := filepath.Join(tmp, "ws")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{filepath.Join(ws, "a/b"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fn := range []string{filepath.Join(ws, "a/f.go"), filepath.Join(outside, "secret")} {
+		if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"in":       "a",
+		"in-file":  "a/f.go",
+		"up":       "..",
+		"rel-out":  "../outside",
+		"abs-out":  outside,
+		"abs-in":   filepath.Join(ws, "a"),
+		"abs-root": "/",
+		"dangling": "../outside/missing",
+		"loop":     "loop",
+		"a/b/back": "../../rel-out",
+	} {
+		if err := os.Symlink(target, filepath.Join(ws, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &GoPathFs{absWorkspace: ws, roots: confineRoots(ws, nil)}
+}
+
+func TestConfine(t *testing.T) {
+	gpf := confineWorkspace(t)
+	for _, tc := range []struct {
+		actual string
+		follow bool
+		want   syscall.Errno
+	}{
+		{"a/f.go", true, fs.OK},
+		{"a/new.go", true, fs.OK},
+		{"a/new/new.go", true, fs.OK},
+		{"in/f.go", true, fs.OK},
+		{"in-file", true, fs.OK},
+		{"abs-in/f.go", true, fs.OK},
+		{"up", false, fs.OK},
+		{"rel-out", false, fs.OK},
+		{"abs-out", false, fs.OK},
+		{"up", true, syscall.EACCES},
+		{"up/outside/secret", true, syscall.EACCES},
+		{"../outside/secret", true, syscall.EACCES},
+		{"a/../../outside/secret", true, syscall.EACCES},
+		{"rel-out", true, syscall.EACCES},
+		{"rel-out/secret", false, syscall.EACCES},
+		{"abs-out/secret", true, syscall.EACCES},
+		{"abs-root/etc", false, syscall.EACCES},
+		{"dangling", true, syscall.EACCES},
+		{"dangling/new.go", false, syscall.EACCES},
+		{"a/b/back/secret", true, syscall.EACCES},
+		{"loop", true, syscall.ELOOP},
+		{"loop/x", false, syscall.ELOOP},
+	} {
+		if got := gpf.confine(tc.actual, tc.follow); got != tc.want {
+			t.Errorf("confine(%q, %v) = %v, want %v", tc.actual, tc.follow, got, tc.want)
+		}
+	}
+}
+
+// FuzzConfine checks no path confined to the workspace resolves out of it:
+// the existing directories it's in, the file itself if it's followed, and the
+// targets of the dangling symlinks.
+func FuzzConfine(f *testing.F) {
+	for _, actual := range []string{
+		"a/f.go", "in/f.go", "../outside/secret", "a/../../outside", "up/outside/secret",
+		"rel-out/secret", "abs-out", "abs-root/etc/passwd", "dangling/x", "a/b/back/secret",
+		"loop/x", "/etc/passwd", "in/../up/outside",
+	} {
+		f.Add(actual, true)
+		f.Add(actual, false)
+	}
+	gpf := confineWorkspace(f)
+	ws := gpf.absWorkspace
+	f.Fuzz(func(t *testing.T, actual string, follow bool) {
+		if gpf.confine(actual, follow) != fs.OK {
+			return
+		}
+		path := gpf.abs(actual)
+		if fi, err := os.Lstat(path); !follow && err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			// The symlink itself is in its directory.
+			path = filepath.Dir(path)
+		}
+		for p := path; ; p = filepath.Dir(p) {
+			if resolved, err := filepath.EvalSymlinks(p); err == nil {
+				if _, ok := within(ws, resolved); !ok {
+					t.Fatalf("confined %q (follow %v) resolves out of the workspace through %s to %s", actual, follow, p, resolved)
+				}
+				break
+			}
+			if target, err := os.Readlink(p); err == nil {
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(filepath.Dir(p), target)
+				}
+				if _, ok := within(ws, filepath.Clean(target)); !ok {
+					t.Fatalf("confined %q (follow %v) has dangling symlink %s out of the workspace to %s", actual, follow, p, target)
+				}
+			}
+			if p == filepath.Dir(p) {
+				break
+			}
+		}
+	})
+}
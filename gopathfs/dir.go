@@ -2,53 +2,117 @@ package gopathfs
 
 import (
 	"log"
-	"os"
-	"path/filepath"
+	"syscall"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
-// OpenDir overrides the parent's OpenDir method.
-func (gpf *GoPathFs) OpenDir(virtual string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+// OpenDir lists the virtual directory.
+func (gpf *GoPathFs) OpenDir(virtual string) ([]fuse.DirEntry, syscall.Errno) {
 	if verbose {
 		log.Printf("open virtual directory %s\n", virtual)
 	}
+	gpf.populate(virtual)
 	entry, remPath := gpf.vfs.MatchPath(virtual)
 	if len(remPath) != 0 {
-		return nil, fuse.ENOENT
+		return nil, syscall.ENOENT
 	}
 
-	return entry.Children(), fuse.OK
+	return entry.Children(), fs.OK
 }
 
-// Mkdir overrides the parent's Mkdir method.
-func (gpf *GoPathFs) Mkdir(virtual string, mode uint32, context *fuse.Context) fuse.Status {
+// Mkdir makes the virtual directory. The mode is already masked by the
+// caller's umask.
+func (gpf *GoPathFs) Mkdir(virtual string, mode uint32) syscall.Errno {
 	if verbose {
 		log.Printf("make virtual directory %s\n", virtual)
 	}
-	entry, remPath := gpf.vfs.MatchPath(virtual)
-	if len(remPath) == 0 {
-		return fuse.EINVAL
+	actual, errno := gpf.newActual(virtual)
+	if errno != fs.OK {
+		return errno
 	}
-	if entry.Readonly() {
-		return fuse.EROFS
+	if errno := gpf.confine(actual, false); errno != fs.OK {
+		return errno
 	}
 
-	actual := filepath.Join(entry.Actual(), filepath.Join(remPath...))
-	if err := os.MkdirAll(actual, os.ModePerm); err != nil {
-		return fuse.EINVAL
+	if err := unix.Mkdir(actual, mode&07777); err != nil {
+		log.Printf("Failed to make virtual directory %s => %s, %v.\n", virtual, actual, err)
+		return fs.ToErrno(err)
+	}
+	if mode&gpf.umask != 0 {
+		// Don't mask the mode again by goplz's umask.
+		if err := unix.Chmod(actual, mode&07777); err != nil {
+			log.Printf("Failed to chmod actual directory %s, %v.\n", actual, err)
+		}
 	}
-	gpf.vfs.Track(virtual, actual, false)
-	return fuse.OK
+	invalidateAttrs(actual)
+	gpf.track(virtual, actual, true)
+	return fs.OK
 }
 
-// Rmdir overrides the parent's Rmdir method.
-func (gpf *GoPathFs) Rmdir(virtual string, context *fuse.Context) fuse.Status {
+// Rmdir deletes the empty virtual directory.
+func (gpf *GoPathFs) Rmdir(virtual string) syscall.Errno {
 	if verbose {
 		log.Printf("delete vitual directory %s\n", virtual)
 	}
-	if err := gpf.vfs.Untrack(virtual); err != nil {
-		return fuse.EINVAL
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	if len(remPath) != 0 {
+		return syscall.ENOENT
+	}
+	if entry.Readonly() {
+		return syscall.EROFS
+	}
+	// The intermediate directory exists as long as it has children, and the
+	// children of a directory can come from the other sources.
+	if len(entry.Children()) != 0 {
+		return syscall.ENOTEMPTY
+	}
+	actual := entry.Actual()
+	var err error
+	if actual == "" {
+		err = gpf.vfs.Untrack(virtual)
+	} else {
+		if errno := gpf.confine(actual, false); errno != fs.OK {
+			return errno
+		}
+		if err := unix.Rmdir(actual); err != nil {
+			if verbose {
+				log.Printf("Failed to delete virtual directory %s => %s, %v.\n", virtual, actual, err)
+			}
+			return fs.ToErrno(err)
+		}
+		// The next source of the virtual directory shows through, if any.
+		err = gpf.vfs.UntrackSource(virtual, actual)
+	}
+	if err != nil {
+		log.Printf("Failed to untrack virtual directory %s, %v.\n", virtual, err)
+	}
+	gpf.forget(virtual)
+	if actual != "" {
+		invalidateAttrs(actual)
+	}
+	return fs.OK
+}
+
+// FsyncDir flushes the actual directory of the virtual directory to disk.
+// The intermediate directories have nothing to flush.
+func (gpf *GoPathFs) FsyncDir(virtual string) syscall.Errno {
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	if len(remPath) != 0 {
+		return syscall.ENOENT
+	}
+	if entry.Actual() == "" {
+		return fs.OK
+	}
+	if errno := gpf.confine(entry.Actual(), true); errno != fs.OK {
+		return errno
+	}
+	fd, err := unix.Open(entry.Actual(), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fs.ToErrno(err)
 	}
-	return fuse.OK
+	defer unix.Close(fd)
+	return fs.ToErrno(unix.Fsync(fd))
 }
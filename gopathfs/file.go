@@ -1,124 +1,308 @@
 package gopathfs
 
 import (
+	"context"
 	"log"
 	"os"
-	"path/filepath"
+	"sync/atomic"
+	"syscall"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/linuxerwang/goplz/mapping"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/vfs"
 	"golang.org/x/sys/unix"
 )
 
-// Open overrides the parent's Open method.
-func (gpf *GoPathFs) Open(virtual string, flags uint32, context *fuse.Context) (file nodefs.File, st fuse.Status) {
+// Open opens the virtual file.
+func (gpf *GoPathFs) Open(virtual string, flags uint32) (fs.FileHandle, syscall.Errno) {
 	if verbose {
 		log.Printf("open virtual file %s\n", virtual)
 	}
 	entry, remPath := gpf.vfs.MatchPath(virtual)
 	if len(remPath) != 0 {
-		return nil, fuse.ENOENT
+		return nil, syscall.ENOENT
 	}
-
-	flag := int(flags)
-	if entry.Readonly() {
-		flag = os.O_RDONLY
+	src := topSource(entry)
+	if src.Readonly && (flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0) {
+		return nil, syscall.EROFS
+	}
+	if errno := gpf.confine(src.Actual, true); errno != fs.OK {
+		return nil, errno
 	}
-	f, err := os.OpenFile(entry.Actual(), flag, 0)
+
+	fd, err := unix.Open(src.Actual, int(flags)|unix.O_CLOEXEC, 0)
 	if err != nil {
-		log.Printf("Failed to open virtual file: %s => %s, %+v.\n", virtual, entry.Actual(), err)
-		return nil, fuse.EIO
+		log.Printf("Failed to open virtual file: %s => %s, %+v.\n", virtual, src.Actual, err)
+		return nil, fs.ToErrno(err)
 	}
 
-	return nodefs.NewLoopbackFile(f), fuse.OK
+	return gpf.newFile(fd, src.Actual), fs.OK
 }
 
-// Create overrides the parent's Create method.
-func (gpf *GoPathFs) Create(virtual string, flags uint32, mode uint32,
-	context *fuse.Context) (file nodefs.File, st fuse.Status) {
+// topSource returns the source of the entry showing through. The watcher
+// changes the sources concurrently, the actual file and whether it's
+// readonly are read at once, and the actual file is not read again.
+func topSource(e vfs.Entry) vfs.Source {
+	if sources := e.Sources(); len(sources) > 0 {
+		return sources[0]
+	}
+	return vfs.Source{Readonly: e.Readonly()}
+}
 
+// Create creates the virtual file. The mode is already masked by the
+// caller's umask.
+func (gpf *GoPathFs) Create(virtual string, flags uint32, mode uint32) (fs.FileHandle, syscall.Errno) {
 	if verbose {
 		log.Printf("create virtual file %s\n", virtual)
 	}
-	entry, remPath := gpf.vfs.MatchPath(virtual)
-	if len(remPath) != 1 {
-		if verbose {
-			log.Printf("Failed to create virtual file %s, extra remaining paths %v\n", virtual, remPath)
+	var actual string
+	if entry, remPath := gpf.vfs.MatchPath(virtual); len(remPath) == 0 {
+		// The file exists, open it as O_CREAT does, or fail with O_EXCL.
+		src := topSource(entry)
+		if src.Readonly {
+			return nil, syscall.EROFS
+		}
+		actual = src.Actual
+	} else {
+		var errno syscall.Errno
+		if actual, errno = gpf.newActual(virtual); errno != fs.OK {
+			return nil, errno
 		}
-		return nil, fuse.EINVAL
 	}
-	if entry.Readonly() {
-		return nil, fuse.EROFS
+	if errno := gpf.confine(actual, true); errno != fs.OK {
+		return nil, errno
 	}
 
-	actual := filepath.Join(entry.Actual(), remPath[0])
-	f, err := os.OpenFile(actual, int(flags), os.FileMode(mode))
+	flag := int(flags) | unix.O_CREAT | unix.O_CLOEXEC
+	// Find out whether the file is created, only a new file gets the mode.
+	fd, err := unix.Open(actual, flag|unix.O_EXCL, mode)
+	created := err == nil
+	if err == unix.EEXIST && flag&unix.O_EXCL == 0 {
+		fd, err = unix.Open(actual, flag, mode)
+	}
 	if err != nil {
-		log.Printf("Failed to create virtual file %s => %s, %v\n", virtual, entry.Actual(), err)
-		return nil, fuse.EINVAL
+		log.Printf("Failed to create virtual file %s => %s, %v.\n", virtual, actual, err)
+		return nil, fs.ToErrno(err)
+	}
+	if created && mode&gpf.umask != 0 {
+		// Don't mask the mode again by goplz's umask.
+		if err := unix.Fchmod(fd, mode&07777); err != nil {
+			log.Printf("Failed to chmod actual file %s, %v.\n", actual, err)
+		}
 	}
-	gpf.vfs.Track(virtual, actual, false)
-	return nodefs.NewLoopbackFile(f), fuse.OK
+	invalidateAttrs(actual)
+	gpf.track(virtual, actual, false)
+	return gpf.newFile(fd, actual), fs.OK
 }
 
-// Unlink overrides the parent's Unlink method.
-func (gpf *GoPathFs) Unlink(virtual string, context *fuse.Context) (st fuse.Status) {
+// Unlink deletes the virtual file.
+func (gpf *GoPathFs) Unlink(virtual string) syscall.Errno {
 	if verbose {
 		log.Printf("unlink virtual file %s\n", virtual)
 	}
 	entry, remPath := gpf.vfs.MatchPath(virtual)
 	if len(remPath) != 0 {
-		return fuse.ENOENT
+		return syscall.ENOENT
 	}
-	if entry.Readonly() {
-		return fuse.EROFS
+	// The watcher may untrack the actual file as soon as it's unlinked, the
+	// next source must not be untracked then.
+	src := topSource(entry)
+	actual := src.Actual
+	if src.Readonly || actual == "" {
+		return syscall.EROFS
+	}
+	if errno := gpf.confine(actual, false); errno != fs.OK {
+		return errno
 	}
 
-	if err := unix.Unlink(entry.Actual()); err != nil {
-		log.Printf("Failed to unlink virtual file %s => %s, %v\n", virtual, entry.Actual(), err)
-		return fuse.EINVAL
+	if err := unix.Unlink(actual); err != nil {
+		log.Printf("Failed to unlink virtual file %s => %s, %v.\n", virtual, actual, err)
+		return fs.ToErrno(err)
+	}
+	invalidateAttrs(actual)
+	// Don't wait for the watcher, the name can be reused right away. The
+	// next source of the virtual file shows through, if any.
+	if err := gpf.vfs.UntrackSource(virtual, actual); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to untrack virtual file %s, %v.\n", virtual, err)
 	}
-	return fuse.OK
+	return fs.OK
 }
 
-// Rename overrides the parent's Rename method.
-func (gpf *GoPathFs) Rename(oldVirtual string, newVirtual string, context *fuse.Context) (st fuse.Status) {
+// Rename renames the virtual file, the flags are the renameat2(2) flags
+// RENAME_NOREPLACE and RENAME_EXCHANGE. The virtual files are moved in the
+// vfs tree along with the actual files. The files can't be renamed across
+// the rules mapping different actual directories, that would change how
+// they're mapped, EXDEV lets the tools copy them instead.
+func (gpf *GoPathFs) Rename(oldVirtual string, newVirtual string, flags uint32) syscall.Errno {
 	if verbose {
-		log.Printf("rename virtual file %s to %s\n", oldVirtual, newVirtual)
+		log.Printf("rename virtual file %s to %s, flags %#x\n", oldVirtual, newVirtual, flags)
+	}
+	if flags&^(renameNoreplace|renameExchange) != 0 || flags == renameNoreplace|renameExchange {
+		// RENAME_WHITEOUT is for overlay file systems.
+		return syscall.EINVAL
 	}
 
 	entry, remPath := gpf.vfs.MatchPath(oldVirtual)
 	if len(remPath) != 0 {
-		return fuse.ENOENT
+		return syscall.ENOENT
 	}
-	if entry.Readonly() {
+	sources := entry.Sources()
+	if len(sources) == 0 || sources[0].Readonly {
 		log.Printf("failed to rename readonly virtual file %s to %s", oldVirtual, newVirtual)
-		return fuse.EROFS
+		return syscall.EROFS
+	}
+	oldActual := sources[0].Actual
+	if len(sources) > 1 {
+		// The other sources would show through at the old path, which
+		// rename(2) can't do.
+		return syscall.EXDEV
+	}
+
+	var newActual string
+	if dst, remPath := gpf.vfs.MatchPath(newVirtual); len(remPath) == 0 {
+		if flags&renameNoreplace != 0 {
+			return syscall.EEXIST
+		}
+		sources := dst.Sources()
+		if len(sources) == 0 || sources[0].Readonly {
+			log.Printf("failed to rename virtual file %s to readonly %s", oldVirtual, newVirtual)
+			return syscall.EROFS
+		}
+		if len(sources) > 1 && (flags&renameExchange != 0 || sources[0].Dir) {
+			// Only the mapped file is replaced, the others keep showing
+			// through under it. The files in a merged directory can't be
+			// told apart once it's replaced.
+			return syscall.EXDEV
+		}
+		newActual = sources[0].Actual
+	} else {
+		if flags&renameExchange != 0 {
+			return syscall.ENOENT
+		}
+		var errno syscall.Errno
+		if newActual, errno = gpf.newActual(newVirtual); errno != fs.OK {
+			return errno
+		}
+	}
+	// The scratch files are moved in and out of the workspace, e.g. by
+	// the atomic saves.
+	scratch := gpf.scratch.contains(oldActual) || gpf.scratch.contains(newActual)
+	if oldRoot, newRoot := gpf.mapper.Root(oldActual), gpf.mapper.Root(newActual); !scratch && oldRoot != newRoot {
+		if verbose {
+			log.Printf("rename actual file %s in %s to %s in %s crosses the rules", oldActual, oldRoot, newActual, newRoot)
+		}
+		return syscall.EXDEV
+	}
+
+	for _, actual := range []string{oldActual, newActual} {
+		if errno := gpf.confine(actual, false); errno != fs.OK {
+			return errno
+		}
 	}
 
-	dir, remPath := gpf.vfs.MatchPath(newVirtual)
-	newActual := filepath.Join(dir.Actual(), filepath.Join(remPath...))
 	if verbose {
-		log.Printf("rename actual file %s to %s", entry.Actual(), newActual)
+		log.Printf("rename actual file %s to %s", oldActual, newActual)
 	}
-	if err := os.Rename(entry.Actual(), newActual); err != nil {
-		log.Printf("Failed to rename %s to %s, %v", entry.Actual(), newActual, err)
-		return fuse.EINVAL
+	if err := renameActual(oldActual, newActual, flags); err != nil {
+		log.Printf("Failed to rename %s to %s, %v", oldActual, newActual, err)
+		return fs.ToErrno(err)
 	}
+	invalidateAttrs(oldActual)
+	invalidateAttrs(newActual)
 
-	if err := gpf.vfs.Untrack(oldVirtual); err != nil {
-		log.Printf("Failed to untrack virtual file %s, %v\n", oldVirtual, err)
+	var err error
+	if flags&renameExchange != 0 {
+		err = gpf.vfs.Exchange(oldVirtual, newVirtual)
+	} else {
+		err = gpf.vfs.Move(oldVirtual, newVirtual, newActual)
 	}
-	filepath.Walk(dir.Actual(), func(actual string, info os.FileInfo, err error) error {
-		virtual, readonly, st := gpf.mapper.Map(actual)
-		if st == mapping.Excluded {
-			return filepath.SkipDir
-		}
-		if virtual != "" {
-			gpf.vfs.Track(virtual, actual, readonly)
-		}
-		return nil
-	})
-	return fuse.OK
+	switch {
+	case os.IsNotExist(err) && flags&renameExchange == 0:
+		// The watcher saw the actual file go and untracked it first.
+		gpf.retrack(newVirtual, newActual)
+	case err != nil:
+		log.Printf("Failed to move virtual file %s to %s, %v\n", oldVirtual, newVirtual, err)
+	}
+	gpf.forget(oldVirtual)
+	return fs.OK
+}
+
+// retrack tracks the actual file renamed through the mount at its new
+// virtual path, once it couldn't be moved there.
+func (gpf *GoPathFs) retrack(virtual, actual string) {
+	fi, err := os.Lstat(actual)
+	if err != nil {
+		return
+	}
+	gpf.track(virtual, actual, fi.IsDir())
+	if !fi.IsDir() || gpf.scratch.contains(actual) {
+		return
+	}
+	if gpf.lazy != nil {
+		// It's populated again when accessed.
+		gpf.lazy.Forget(virtual)
+		return
+	}
+	scan.Walk(actual, gpf.mapper, gpf.vfs, nil, gpf.dirs)
+}
+
+// file is a loopback file invalidating the cached attrs of the actual file
+// when it's changed.
+type file struct {
+	loopbackFile
+	actual string
+}
+
+// loopbackFile is the file operations forwarded to the loopback file.
+type loopbackFile interface {
+	fs.FileReader
+	fs.FileWriter
+	fs.FileFlusher
+	fs.FileReleaser
+	fs.FileFsyncer
+	fs.FileGetattrer
+	fs.FileSetattrer
+	fs.FileAllocater
+	fs.FileGetlker
+	fs.FileSetlker
+	fs.FileSetlkwer
+	fs.FileLseeker
+}
+
+func (gpf *GoPathFs) newFile(fd int, actual string) fs.FileHandle {
+	f := file{
+		loopbackFile: fs.NewLoopbackFile(fd).(loopbackFile),
+		actual:       actual,
+	}
+	if atomic.LoadInt32(&gpf.passthrough) != 0 {
+		return &passthroughFile{file: f}
+	}
+	return &f
+}
+
+func (f *file) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	defer vfs.InvalidateAttr(f.actual)
+	return f.loopbackFile.Write(ctx, data, off)
+}
+
+func (f *file) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	defer vfs.InvalidateAttr(f.actual)
+	return f.loopbackFile.Setattr(ctx, in, out)
+}
+
+func (f *file) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	defer vfs.InvalidateAttr(f.actual)
+	return f.loopbackFile.Allocate(ctx, off, size, mode)
+}
+
+// passthroughFile is a file read and written by the kernel directly on the
+// actual file, when FUSE passthrough is available. The writes don't go
+// through Write, the cached attrs are invalidated by the watcher instead.
+type passthroughFile struct {
+	file
+}
+
+func (f *passthroughFile) PassthroughFd() (int, bool) {
+	return f.loopbackFile.(fs.FilePassthroughFder).PassthroughFd()
 }
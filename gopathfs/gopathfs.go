@@ -2,89 +2,388 @@ package gopathfs
 
 import (
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/rjeczalik/notify"
 	cli "github.com/urfave/cli/v2"
 
 	"github.com/linuxerwang/goplz/conf"
 	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/trace"
 	"github.com/linuxerwang/goplz/vfs"
+	"golang.org/x/sys/unix"
 )
 
 var (
-	verbose bool
+	verbose       bool
+	fuseDebug     bool
+	pathSeparator = string(os.PathSeparator)
 )
 
 // Init initialize the gopathfs package.
 func Init(ctx *cli.Context) {
 	verbose = ctx.Bool("verbose")
+	fuseDebug = ctx.Bool("fuse_debug")
 }
 
-type changeCallbackFunc func(notify.EventInfo)
-
-// GoPathFs implements a virtual tree for src folder of GOPATH.
+// GoPathFs implements a virtual tree for src folder of GOPATH. The
+// operations are implemented on virtual paths, the FUSE nodes resolve their
+// paths and delegate to them.
 type GoPathFs struct {
-	pathfs.FileSystem
-	cfg            *conf.Config
-	vfs            vfs.FileSystem
-	mapper         mapping.SourceMapper
-	changeCallback changeCallbackFunc
-	notifyCh       chan notify.EventInfo
+	cfg          *conf.Config
+	vfs          vfs.FileSystem
+	mapper       mapping.SourceMapper
+	lazy         *scan.Lazy
+	root         *node
+	absWorkspace string
+	notifyCh     chan notify.EventInfo
+	// changes queues the changes from notifyCh to be handled, they're
+	// dropped when it's full.
+	changes chan notify.EventInfo
+	// mountpoint is the absolute path the file system is mounted on.
+	mountpoint string
+	scratch    *scratch
+	// umask is goplz's umask, the new files are chmod'ed if it masks their
+	// modes.
+	umask uint32
+	// roots are the directories the actual files accessed through the mount
+	// are confined to, resolved.
+	roots []string
+	// tracer writes the trace of the operations and the changes, nil if
+	// they're not traced.
+	tracer *trace.Writer
+	// measure is true if the operations and the changes are measured for
+	// the metrics.
+	measure bool
+	// dirs records the actual directories walked for the snapshot, nil if
+	// they're not recorded.
+	dirs *scan.DirSet
+	// dropped is the number of the changes dropped, the virtual tree might
+	// be stale if it's not 0.
+	dropped int64
+
+	// passthrough is not 0 if the files are opened in passthrough mode.
+	passthrough int32
+	report      atomic.Value
+}
+
+// Report is a report of the FUSE file system.
+type Report struct {
+	// IO is how the files are read and written, "passthrough" or
+	// "loopback".
+	IO string `json:"io"`
+	// Reason is why passthrough is not used.
+	Reason string `json:"reason,omitempty"`
+}
+
+// RecordDirs records the actual directories walked on changes into dirs,
+// so that the snapshot covers the directories created since the workspace
+// was scanned. It must be called before the file system is mounted.
+func (gpf *GoPathFs) RecordDirs(dirs *scan.DirSet) {
+	gpf.dirs = dirs
+}
+
+// DroppedChanges returns the number of the changes in the workspace dropped
+// because too many were queued. The virtual tree might be stale if it's not
+// 0.
+func (gpf *GoPathFs) DroppedChanges() int64 {
+	return atomic.LoadInt64(&gpf.dropped)
 }
 
-// Access overrides the parent's Access method.
-func (gpf *GoPathFs) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
-	return fuse.OK
+// Report returns the report of the mounted file system.
+func (gpf *GoPathFs) Report() *Report {
+	r, _ := gpf.report.Load().(*Report)
+	return r
 }
 
-// GetAttr overrides the parent's GetAttr method.
-func (gpf *GoPathFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	entry, relpath := gpf.vfs.MatchPath(name)
+// GetAttr gets the attrs of the virtual file.
+func (gpf *GoPathFs) GetAttr(virtual string, out *fuse.Attr) syscall.Errno {
+	gpf.populate(filepath.Dir(virtual))
+	entry, relpath := gpf.vfs.MatchPath(virtual)
 	if len(relpath) != 0 {
-		return nil, fuse.ENOENT
+		return syscall.ENOENT
 	}
 	attr, err := entry.Attr()
 	if err != nil {
-		return nil, fuse.ENOENT
+		return fs.ToErrno(err)
 	}
-	return attr, fuse.OK
+	*out = *attr
+	return fs.OK
 }
 
-// OnMount overrides the parent's OnMount method.
-func (gpf *GoPathFs) OnMount(nodeFs *pathfs.PathNodeFs) {
-	root := filepath.Join(gpf.cfg.Workspace, "...")
+// SetAttr changes the attrs of the virtual file: the mode, the owner, the
+// size and the times, whichever are set in the request. They are changed on
+// the actual file, the readonly files can't be changed.
+func (gpf *GoPathFs) SetAttr(virtual string, in *fuse.SetAttrIn, out *fuse.Attr) syscall.Errno {
 	if verbose {
-		log.Printf("Watching directory %s for changes.", root)
+		log.Printf("setattr virtual file %s, valid %#x\n", virtual, in.Valid)
+	}
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	if len(remPath) != 0 {
+		return syscall.ENOENT
+	}
+	actual := entry.Actual()
+	if entry.Readonly() || actual == "" {
+		// The intermediate directories have no actual file to change.
+		return syscall.EROFS
+	}
+	if errno := gpf.confine(actual, true); errno != fs.OK {
+		return errno
+	}
+
+	errno := setAttr(entry, actual, in)
+	vfs.InvalidateAttr(actual)
+	if errno != fs.OK {
+		log.Printf("Failed to setattr virtual file %s => %s, %v.\n", virtual, actual, errno)
+		return errno
+	}
+	return gpf.GetAttr(virtual, out)
+}
+
+func setAttr(entry vfs.Entry, actual string, in *fuse.SetAttrIn) syscall.Errno {
+	if mode, ok := in.GetMode(); ok {
+		if err := unix.Chmod(actual, mode&07777); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		u, g := -1, -1
+		if uok {
+			u = int(uid)
+		}
+		if gok {
+			g = int(gid)
+		}
+		if err := unix.Lchown(actual, u, g); err != nil {
+			return fs.ToErrno(err)
+		}
 	}
-	if err := notify.Watch(root, gpf.notifyCh, notify.Create|notify.Remove|notify.Rename); err != nil {
-		log.Fatal(err)
+
+	if size, ok := in.GetSize(); ok {
+		if err := unix.Truncate(actual, int64(size)); err != nil {
+			return fs.ToErrno(err)
+		}
 	}
 
-	go func() {
-		for ei := range gpf.notifyCh {
-			gpf.changeCallback(ei)
+	// The times go last, truncating changes the mtime.
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		if !aok || !mok {
+			// Keep the time not being changed.
+			vfs.InvalidateAttr(actual)
+			attr, err := entry.Attr()
+			if err != nil {
+				return fs.ToErrno(err)
+			}
+			if !aok {
+				atime = attr.AccessTime()
+			}
+			if !mok {
+				mtime = attr.ModTime()
+			}
 		}
-	}()
+		if err := os.Chtimes(actual, atime, mtime); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	return fs.OK
 }
 
-// OnUnmount overwrites the parent's OnUnmount method.
-func (gpf *GoPathFs) OnUnmount() {
-	notify.Stop(gpf.notifyCh)
+// StatFs reports the file system of the actual file of the virtual file, or
+// of the workspace for the intermediate directories.
+func (gpf *GoPathFs) StatFs(virtual string, out *fuse.StatfsOut) syscall.Errno {
+	actual := gpf.absWorkspace
+	if entry, remPath := gpf.vfs.MatchPath(virtual); len(remPath) == 0 && entry.Actual() != "" {
+		actual = entry.Actual()
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(actual, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStatfsT(&st)
+	return fs.OK
 }
 
-// NewGoPathFs returns a new GoPathFs.
-func NewGoPathFs(cfg *conf.Config, fs vfs.FileSystem, mapper mapping.SourceMapper, changeCallback changeCallbackFunc) *GoPathFs {
+// populate populates the virtual directory when the tree is populated lazily.
+func (gpf *GoPathFs) populate(virtualDir string) {
+	if gpf.lazy != nil {
+		gpf.lazy.Populate(virtualDir)
+	}
+}
+
+// forget lets the untracked virtual directory be populated again when it's
+// recreated.
+func (gpf *GoPathFs) forget(virtual string) {
+	if gpf.lazy == nil {
+		return
+	}
+	if _, remPath := gpf.vfs.MatchPath(virtual); len(remPath) != 0 {
+		gpf.lazy.Forget(virtual)
+	}
+}
+
+// newActual returns the actual path for the new virtual file, in the actual
+// directory of its virtual directory.
+func (gpf *GoPathFs) newActual(virtual string) (string, syscall.Errno) {
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	switch {
+	case len(remPath) == 0:
+		return "", syscall.EEXIST
+	case len(remPath) > 1:
+		return "", syscall.ENOENT
+	case entry.Readonly() || entry.Actual() == "":
+		return "", syscall.EROFS
+	case remPath[0] == "." || remPath[0] == ".." || strings.Contains(remPath[0], pathSeparator):
+		// The kernel doesn't send such names, don't let them escape the
+		// actual directory anyway.
+		return "", syscall.EINVAL
+	}
+	if gpf.scratch.matches(virtual) {
+		actual, err := gpf.scratch.actual(virtual)
+		if err != nil {
+			log.Printf("Failed to create the scratch directory for %s, %v.\n", virtual, err)
+			return "", fs.ToErrno(err)
+		}
+		return actual, fs.OK
+	}
+	return filepath.Join(entry.Actual(), remPath[0]), fs.OK
+}
+
+// track tracks the actual file or directory created through the mount,
+// ranked by the rule mapping it among the other sources of the virtual file.
+func (gpf *GoPathFs) track(virtual, actual string, dir bool) {
+	_, _, rank, _ := gpf.mapper.MapRule(actual)
+	if rank < 0 {
+		rank = vfs.MaxPriority
+	}
+	gpf.vfs.TrackSource(virtual, vfs.Source{Actual: actual, Priority: rank, Dir: dir})
+}
+
+// invalidateAttrs invalidates the cached attrs of the changed actual file
+// and its directory.
+func invalidateAttrs(actual string) {
+	vfs.InvalidateAttr(actual)
+	vfs.InvalidateAttr(filepath.Dir(actual))
+}
+
+// Mount mounts the file system on the directory, and starts watching the
+// workspace for changes.
+func (gpf *GoPathFs) Mount(dir string) (*fuse.Server, error) {
+	opts, err := gpf.mountOptions()
+	if err != nil {
+		return nil, err
+	}
+	return gpf.mount(dir, opts)
+}
+
+// mount mounts the file system on the directory with the options.
+func (gpf *GoPathFs) mount(dir string, opts *fs.Options) (*fuse.Server, error) {
+	// Remove the scratch files left by a crash.
+	gpf.cleanScratch()
+	raw := fs.NewNodeFS(gpf.root, opts)
+	if gpf.cfg.Settings.GetMountOptions().GetAllowRoot() {
+		raw = newRootOnlyFS(raw)
+	}
+	server, err := fuse.NewServer(raw, dir, &opts.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		return nil, err
+	}
+	if gpf.mountpoint, err = filepath.Abs(dir); err != nil {
+		server.Unmount()
+		return nil, err
+	}
+	gpf.setupPassthrough(server)
+	if err := gpf.watch(); err != nil {
+		server.Unmount()
+		return nil, err
+	}
+	return server, nil
+}
+
+// setupPassthrough enables passthrough if the kernel supports it and it's
+// not disabled, otherwise the files are read and written through goplz.
+func (gpf *GoPathFs) setupPassthrough(server *fuse.Server) {
+	r := Report{IO: "loopback"}
+	if gpf.cfg.Settings.GetMountOptions().GetDisablePassthrough() {
+		r.Reason = "disabled by mount_options.disable_passthrough"
+	} else if err := probePassthrough(server, gpf.cfg.PlzConf); err != nil {
+		r.Reason = err.Error()
+	} else {
+		r.IO = "passthrough"
+		atomic.StoreInt32(&gpf.passthrough, 1)
+	}
+	if verbose {
+		log.Printf("File I/O mode %s %s\n", r.IO, r.Reason)
+	}
+	gpf.report.Store(&r)
+}
+
+// inode returns the inode of the virtual file, or nil if the kernel hasn't
+// looked it up.
+func (gpf *GoPathFs) inode(virtual string) *fs.Inode {
+	if gpf.mountpoint == "" {
+		// Not mounted, e.g. when replaying a trace.
+		return nil
+	}
+	in := gpf.root.EmbeddedInode()
+	if virtual == "" || virtual == "." {
+		return in
+	}
+	for _, name := range strings.Split(virtual, pathSeparator) {
+		if in = in.GetChild(name); in == nil {
+			return nil
+		}
+	}
+	return in
+}
+
+// NewGoPathFs returns a new GoPathFs. If lazy is not nil, the virtual
+// directories are populated on first access.
+func NewGoPathFs(cfg *conf.Config, fs vfs.FileSystem, mapper mapping.SourceMapper, lazy *scan.Lazy) *GoPathFs {
+	absWorkspace, err := filepath.Abs(cfg.Workspace)
+	if err != nil {
+		panic(err)
+	}
+	var scratchDir string
+	if cfg.GoplzScratch != "" {
+		if scratchDir, err = filepath.Rel(absWorkspace, cfg.GoplzScratch); err != nil {
+			panic(err)
+		}
+	}
 	gpfs := GoPathFs{
-		FileSystem:     pathfs.NewDefaultFileSystem(),
-		cfg:            cfg,
-		vfs:            fs,
-		mapper:         mapper,
-		changeCallback: changeCallback,
-		notifyCh:       make(chan notify.EventInfo, 1000),
-	}
-	gpfs.SetDebug(true)
+		cfg:          cfg,
+		vfs:          fs,
+		mapper:       mapper,
+		lazy:         lazy,
+		absWorkspace: absWorkspace,
+		notifyCh:     make(chan notify.EventInfo, 1000),
+		changes:      make(chan notify.EventInfo, 1000),
+		scratch:      newScratch(scratchDir, cfg.Settings.ScratchFile),
+		umask:        processUmask(),
+		roots:        confineRoots(absWorkspace, cfg.Settings.AllowedRoot),
+	}
+	gpfs.root = &node{gpf: &gpfs}
 	return &gpfs
 }
+
+// processUmask returns the umask of the process.
+func processUmask() uint32 {
+	mask := unix.Umask(0)
+	unix.Umask(mask)
+	return uint32(mask)
+}
@@ -0,0 +1,165 @@
+package gopathfs
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/vfs"
+	"golang.org/x/sys/unix"
+)
+
+// Readlink reads the target of the virtual symlink. A target in the
+// workspace is rewritten to the virtual path of the target relative to the
+// link, so that it can be followed in the virtual tree.
+func (gpf *GoPathFs) Readlink(virtual string) ([]byte, syscall.Errno) {
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	if len(remPath) != 0 {
+		return nil, syscall.ENOENT
+	}
+	target, err := os.Readlink(entry.Actual())
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if t, ok := gpf.virtualTarget(virtual, entry.Actual(), target); ok {
+		if verbose {
+			log.Printf("readlink virtual file %s, rewrite %s to %s\n", virtual, target, t)
+		}
+		target = t
+	}
+	return []byte(target), fs.OK
+}
+
+// Symlink creates the virtual symlink. A target in the virtual tree is
+// rewritten to the actual path of the target relative to the actual link,
+// other targets are kept as is.
+func (gpf *GoPathFs) Symlink(target, virtual string) syscall.Errno {
+	if verbose {
+		log.Printf("symlink virtual file %s to %s\n", virtual, target)
+	}
+	actual, errno := gpf.newActual(virtual)
+	if errno != fs.OK {
+		return errno
+	}
+	if errno := gpf.confine(actual, false); errno != fs.OK {
+		return errno
+	}
+	if t, ok := gpf.actualTarget(virtual, actual, target); ok {
+		target = t
+	}
+	if err := unix.Symlink(target, actual); err != nil {
+		log.Printf("Failed to symlink virtual file %s => %s, %v.\n", virtual, actual, err)
+		return fs.ToErrno(err)
+	}
+	invalidateAttrs(actual)
+	gpf.track(virtual, actual, false)
+	return fs.OK
+}
+
+// Link creates the virtual hard link to the virtual file. The readonly files
+// can't be linked, they would be writable through the link.
+func (gpf *GoPathFs) Link(targetVirtual, virtual string) syscall.Errno {
+	if verbose {
+		log.Printf("link virtual file %s to %s\n", virtual, targetVirtual)
+	}
+	target, remPath := gpf.vfs.MatchPath(targetVirtual)
+	if len(remPath) != 0 {
+		return syscall.ENOENT
+	}
+	if target.Readonly() || target.Actual() == "" {
+		return syscall.EROFS
+	}
+	actual, errno := gpf.newActual(virtual)
+	if errno != fs.OK {
+		return errno
+	}
+	for _, a := range []string{target.Actual(), actual} {
+		if errno := gpf.confine(a, false); errno != fs.OK {
+			return errno
+		}
+	}
+	if err := unix.Link(target.Actual(), actual); err != nil {
+		log.Printf("Failed to link virtual file %s => %s, %v.\n", virtual, actual, err)
+		return fs.ToErrno(err)
+	}
+	// The link count of the target is changed too.
+	vfs.InvalidateAttr(target.Actual())
+	invalidateAttrs(actual)
+	gpf.track(virtual, actual, false)
+	return fs.OK
+}
+
+// virtualTarget returns the virtual path relative to the virtual link for
+// the target of the actual link, if the target is a mapped file in the
+// workspace.
+func (gpf *GoPathFs) virtualTarget(virtual, actual, target string) (string, bool) {
+	abs := target
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(gpf.abs(filepath.Dir(actual)), target)
+	}
+	rel, ok := within(gpf.absWorkspace, abs)
+	if !ok {
+		return "", false
+	}
+	targetVirtual, _, st := gpf.mapper.Map(rel)
+	if st != mapping.Matched || targetVirtual == "" {
+		return "", false
+	}
+	t, err := filepath.Rel(filepath.Dir(virtual), targetVirtual)
+	if err != nil {
+		return "", false
+	}
+	return t, true
+}
+
+// actualTarget returns the actual path relative to the actual link for the
+// target of the virtual link, if the target is in the virtual tree.
+func (gpf *GoPathFs) actualTarget(virtual, actual, target string) (string, bool) {
+	var targetVirtual string
+	if filepath.IsAbs(target) {
+		rel, ok := within(gpf.mountpoint, target)
+		if !ok {
+			return "", false
+		}
+		targetVirtual = rel
+	} else {
+		targetVirtual = filepath.Join(filepath.Dir(virtual), target)
+		if targetVirtual == ".." || strings.HasPrefix(targetVirtual, ".."+pathSeparator) {
+			return "", false
+		}
+	}
+	entry, remPath := gpf.vfs.MatchPath(targetVirtual)
+	if len(remPath) != 0 || entry.Actual() == "" {
+		return "", false
+	}
+	t, err := filepath.Rel(gpf.abs(filepath.Dir(actual)), gpf.abs(entry.Actual()))
+	if err != nil {
+		return "", false
+	}
+	return t, true
+}
+
+// abs returns the absolute path of the actual path.
+func (gpf *GoPathFs) abs(actual string) string {
+	if filepath.IsAbs(actual) {
+		return actual
+	}
+	return filepath.Join(gpf.absWorkspace, actual)
+}
+
+// within returns the path relative to the directory if it's in the
+// directory.
+func within(dir, path string) (string, bool) {
+	if dir == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+pathSeparator) {
+		return "", false
+	}
+	return rel, true
+}
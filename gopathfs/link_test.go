@@ -0,0 +1,57 @@
+package gopathfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rjeczalik/notify"
+)
+
+func TestHardLinkInode(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{"a/g.go": "package a\n"})
+	if err := os.Link(filepath.Join(m.ws, "a/g.go"), filepath.Join(m.ws, "a/g2.go")); err != nil {
+		t.Fatal(err)
+	}
+	m.gpf.change("a/g2.go", notify.Create)
+
+	// Looked up before it's hard linked, with its virtual inode number.
+	f, err := os.Stat(m.virtual("a/f.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(m.virtual("a/f.go"), m.virtual("a/h.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, names := range [][2]string{
+		{"a/f.go", "a/h.go"},
+		{"a/g.go", "a/g2.go"},
+	} {
+		var fis [2]os.FileInfo
+		for i, name := range names {
+			if fis[i], err = os.Stat(m.virtual(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !os.SameFile(fis[0], fis[1]) {
+			t.Errorf("hard links %s and %s have inodes %d and %d, expected the same", names[0], names[1],
+				fis[0].Sys().(*syscall.Stat_t).Ino, fis[1].Sys().(*syscall.Stat_t).Ino)
+		}
+		if nlink := fis[0].Sys().(*syscall.Stat_t).Nlink; nlink != 2 {
+			t.Errorf("nlink of %s is %d, expected 2", names[0], nlink)
+		}
+	}
+	if h, err := os.Stat(m.virtual("a/h.go")); err != nil || !os.SameFile(f, h) {
+		t.Errorf("the new hard link is not the file looked up before, %v", err)
+	}
+
+	// The inode is still the link after unlinking its first name.
+	if err := os.Remove(m.virtual("a/f.go")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(m.virtual("a/h.go")); err != nil {
+		t.Errorf("stat of the remaining hard link failed, %v", err)
+	}
+}
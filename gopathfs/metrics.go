@@ -0,0 +1,65 @@
+package gopathfs
+
+import (
+	"time"
+
+	"github.com/linuxerwang/goplz/metrics"
+)
+
+var (
+	fuseOps = metrics.NewCounter("goplz_fuse_ops_total",
+		"The FUSE operations by their status, e.g. ENOENT.", "op", "status")
+	fuseOpDuration = metrics.NewHistogram("goplz_fuse_op_duration_seconds",
+		"The latency of the FUSE operations in goplz.",
+		[]float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1}, "op")
+	watchedChanges = metrics.NewCounter("goplz_watcher_changes_total",
+		"The changes in the workspace by how the virtual tree was updated, e.g. track.", "event", "result")
+	droppedChanges = metrics.NewCounter("goplz_watcher_dropped_changes_total",
+		"The changes in the workspace dropped because too many were queued.")
+)
+
+// EnableMetrics measures the operations and the changes, and registers the
+// metrics of the file system. It must be called once, before the file
+// system is mounted.
+func (gpf *GoPathFs) EnableMetrics() {
+	gpf.measure = true
+
+	metrics.RegisterGauge("goplz_watcher_queued_changes",
+		"The changes in the workspace queued to be handled.", nil,
+		func(set func(v float64, values ...string)) {
+			set(float64(len(gpf.changes)))
+		})
+	metrics.RegisterGauge("goplz_vfs_entries",
+		"The actual files and directories tracked in the virtual tree by the root and the rule mapping them.",
+		[]string{"root", "rule"},
+		func(set func(v float64, values ...string)) {
+			// The sources are counted by the ranks of their rules as
+			// they're tracked, the tree is too large to walk at every
+			// scrape.
+			ranks := gpf.vfs.SourcesByPriority()
+			type labels struct{ root, rule string }
+			counts := map[labels]int{}
+			for rank, n := range ranks {
+				rule, root := gpf.mapper.RankedRule(rank)
+				if rule == "" {
+					// The files created through the mount where no rule
+					// maps them.
+					rule = "none"
+				}
+				counts[labels{root, rule}] += n
+			}
+			for l, n := range counts {
+				set(float64(n), l.root, l.rule)
+			}
+		})
+}
+
+// observe adds the measures of the operation or change to the metrics.
+func (t *traceOp) observe(latency time.Duration) {
+	if t.r.Op == "event" {
+		watchedChanges.Inc(t.r.Event, t.r.Result)
+		return
+	}
+	fuseOps.Inc(t.r.Op, t.r.Status)
+	fuseOpDuration.ObserveDuration(latency, t.r.Op)
+}
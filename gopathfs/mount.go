@@ -0,0 +1,230 @@
+package gopathfs
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// subtype is the default subtype of the mount, the type shown by mount(8)
+// is "fuse.goplz".
+const subtype = "goplz"
+
+// mountOptions returns the options of the mount from the mount_options of
+// the settings.
+func (gpf *GoPathFs) mountOptions() (*fs.Options, error) {
+	mo := gpf.cfg.Settings.GetMountOptions()
+	if mo.GetAllowOther() && mo.GetAllowRoot() {
+		return nil, errors.New("allow_other and allow_root are mutually exclusive")
+	}
+
+	// The kernel is notified of the changes, it can cache the entries and
+	// attrs as long as goplz does.
+	timeout := time.Second
+	if ttl := time.Duration(gpf.cfg.Settings.AttrCacheTtlMs) * time.Millisecond; ttl > 0 {
+		timeout = ttl
+	}
+	entryTimeout, attrTimeout := timeout, timeout
+	if ms := mo.GetEntryTimeoutMs(); ms > 0 {
+		entryTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if ms := mo.GetAttrTimeoutMs(); ms > 0 {
+		attrTimeout = time.Duration(ms) * time.Millisecond
+	}
+
+	opts := fs.Options{
+		MountOptions: fuse.MountOptions{
+			// The POSIX and flock locks are taken on the actual files.
+			EnableLocks: true,
+			// allow_root is enforced by goplz, the kernel only knows
+			// allow_other.
+			AllowOther:    mo.GetAllowOther() || mo.GetAllowRoot(),
+			FsName:        mo.GetFsName(),
+			Name:          mo.GetSubtype(),
+			MaxBackground: int(mo.GetMaxBackground()),
+			MaxWrite:      int(mo.GetMaxWrite()),
+			Debug:         fuseDebug,
+		},
+		EntryTimeout: &entryTimeout,
+		AttrTimeout:  &attrTimeout,
+	}
+	if opts.FsName == "" {
+		opts.FsName = gpf.absWorkspace
+	}
+	if opts.Name == "" {
+		opts.Name = subtype
+	}
+	if mo.GetDefaultPermissions() {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "default_permissions")
+	}
+	if mo.GetReadOnly() {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+	return &opts, nil
+}
+
+// rootOnlyFS serves only root and the user running goplz, for allow_root.
+// The requests on the open files aren't checked, the files were opened by
+// them.
+type rootOnlyFS struct {
+	fuse.RawFileSystem
+	uid uint32
+}
+
+func newRootOnlyFS(raw fuse.RawFileSystem) fuse.RawFileSystem {
+	return &rootOnlyFS{RawFileSystem: raw, uid: uint32(os.Getuid())}
+}
+
+func (r *rootOnlyFS) allowed(header *fuse.InHeader) bool {
+	return header.Uid == 0 || header.Uid == r.uid
+}
+
+func (r *rootOnlyFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if !r.allowed(header) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (r *rootOnlyFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (r *rootOnlyFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (r *rootOnlyFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (r *rootOnlyFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (r *rootOnlyFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !r.allowed(header) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (r *rootOnlyFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !r.allowed(header) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (r *rootOnlyFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (r *rootOnlyFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (r *rootOnlyFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if !r.allowed(header) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (r *rootOnlyFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	if !r.allowed(header) {
+		return nil, fuse.EACCES
+	}
+	return r.RawFileSystem.Readlink(cancel, header)
+}
+
+func (r *rootOnlyFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Access(cancel, input)
+}
+
+func (r *rootOnlyFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	if !r.allowed(header) {
+		return 0, fuse.EACCES
+	}
+	return r.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (r *rootOnlyFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	if !r.allowed(header) {
+		return 0, fuse.EACCES
+	}
+	return r.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (r *rootOnlyFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (r *rootOnlyFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if !r.allowed(header) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (r *rootOnlyFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (r *rootOnlyFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Open(cancel, input, out)
+}
+
+func (r *rootOnlyFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (r *rootOnlyFS) StatFs(cancel <-chan struct{}, header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	if !r.allowed(header) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.StatFs(cancel, header, out)
+}
+
+func (r *rootOnlyFS) Statx(cancel <-chan struct{}, input *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
+	if !r.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return r.RawFileSystem.Statx(cancel, input, out)
+}
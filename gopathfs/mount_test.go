@@ -0,0 +1,378 @@
+package gopathfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/linuxerwang/goplz/conf"
+	pb "github.com/linuxerwang/goplz/conf/proto"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+// testMount is goplz mounted on a temp directory for a temp workspace.
+type testMount struct {
+	gpf *GoPathFs
+	// ws is the workspace, the current directory while it's mounted.
+	ws string
+	// mnt is the mountpoint.
+	mnt string
+	// src is the virtual directory of the workspace in the mount.
+	src string
+}
+
+// mountWorkspace mounts a temp workspace with the files, and the generated
+// x.pb.go mapped readonly next to a/f.go. The generated files rank after the
+// workspace files. The test is skipped if FUSE is not available.
+func mountWorkspace(t testing.TB, files map[string]string) *testMount {
+	return mountWith(t, files, nil)
+}
+
+// mountWith mounts the workspace as mountWorkspace, setup is called before
+// the file system is mounted if not nil.
+func mountWith(t testing.TB, files map[string]string, setup func(gpf *GoPathFs)) *testMount {
+	ws, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	files["a/f.go"] = "package a\n"
+	files["plz-out/gen/a/x.pb.go"] = "package a\n"
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := testConfig(ws)
+	mapper := mapping.New(cfg)
+	tree, err := vfs.New(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan.Walk(".", mapper, tree, nil, nil)
+	gpf := NewGoPathFs(cfg, tree, mapper, nil)
+	if setup != nil {
+		setup(gpf)
+	}
+
+	opts, err := gpf.mountOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fusermount may be missing, e.g. in containers running as root.
+	opts.DirectMount = true
+	server, err := gpf.mount(mnt, opts)
+	if err != nil {
+		t.Skipf("FUSE is not available, %v", err)
+	}
+	t.Cleanup(func() {
+		gpf.Stop()
+		server.Unmount()
+	})
+	return &testMount{
+		gpf: gpf,
+		ws:  ws,
+		mnt: mnt,
+		src: filepath.Join(mnt, "src", cfg.GoImportPath),
+	}
+}
+
+// testConfig returns the config of the test workspace, the current
+// directory.
+func testConfig(ws string) *conf.Config {
+	return &conf.Config{
+		Settings: &pb.Settings{
+			SourceMapping: []*pb.SourceMapping{{
+				FromActualDir: "plz-out/gen",
+				Priority:      -1,
+				Filter: []*pb.SourceFilter{{
+					Match:        `.*\.pb\.go$`,
+					ToVirtualDir: "src",
+					Strip:        "plz-out/gen",
+					Prepend:      "{{.GoImportPath}}",
+					Readonly:     true,
+				}},
+			}},
+			MountOptions: &pb.MountOptions{DisablePassthrough: true},
+		},
+		GoImportPath: "example.com/ws",
+		Workspace:    ws,
+		PlzConf:      filepath.Join(ws, "a/f.go"),
+		GoplzScratch: filepath.Join(ws, "plz-out/goplz/scratch"),
+	}
+}
+
+// virtual returns the path of the workspace file in the mount.
+func (m *testMount) virtual(name string) string {
+	return filepath.Join(m.src, name)
+}
+
+func TestOpenFileAttrsAfterUnlink(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{"a/g.go": "package a\n"})
+
+	f, err := os.OpenFile(m.virtual("a/g.go"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := os.Remove(m.virtual("a/g.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("fstat of unlinked file failed, %v", err)
+	}
+	if fi.Size() != int64(len("package a\n")) {
+		t.Errorf("size of unlinked file is %d, expected %d", fi.Size(), len("package a\n"))
+	}
+	if err := f.Truncate(2); err != nil {
+		t.Fatalf("ftruncate of unlinked file failed, %v", err)
+	}
+	if fi, err = f.Stat(); err != nil || fi.Size() != 2 {
+		t.Errorf("size of truncated unlinked file is %v %v, expected 2", fi.Size(), err)
+	}
+}
+
+func TestOpenFileAttrsAfterRename(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{"a/g.go": "package a\n"})
+
+	f, err := os.OpenFile(m.virtual("a/g.go"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := os.Rename(m.virtual("a/g.go"), m.virtual("a/h.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(3); err != nil {
+		t.Fatalf("ftruncate of renamed file failed, %v", err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != 3 {
+		t.Errorf("fstat size of renamed file is %v %v, expected 3", fi.Size(), err)
+	}
+	fi, err := os.Stat(filepath.Join(m.ws, "a/h.go"))
+	if err != nil || fi.Size() != 3 {
+		t.Errorf("actual size of renamed file is %v %v, expected 3", fi.Size(), err)
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		settings *pb.Settings
+		want     func(opts *fs.Options) string
+	}{
+		{"defaults", &pb.Settings{}, func(opts *fs.Options) string {
+			mo := opts.MountOptions
+			switch {
+			case mo.FsName != "/ws" || mo.Name != subtype:
+				return fmt.Sprintf("fsname %s subtype %s, want /ws %s", mo.FsName, mo.Name, subtype)
+			case *opts.EntryTimeout != time.Second || *opts.AttrTimeout != time.Second:
+				return fmt.Sprintf("timeouts %v %v, want 1s", *opts.EntryTimeout, *opts.AttrTimeout)
+			case mo.AllowOther || len(mo.Options) != 0:
+				return fmt.Sprintf("allow_other %v, options %q, want none", mo.AllowOther, mo.Options)
+			}
+			return ""
+		}},
+		{"allow_other", &pb.Settings{MountOptions: &pb.MountOptions{AllowOther: true}}, func(opts *fs.Options) string {
+			if !opts.MountOptions.AllowOther {
+				return "not allow_other"
+			}
+			return ""
+		}},
+		// The kernel only knows allow_other, goplz filters the users.
+		{"allow_root", &pb.Settings{MountOptions: &pb.MountOptions{AllowRoot: true}}, func(opts *fs.Options) string {
+			if !opts.MountOptions.AllowOther {
+				return "not allow_other"
+			}
+			return ""
+		}},
+		{"names", &pb.Settings{MountOptions: &pb.MountOptions{FsName: "ws", Subtype: "gp"}}, func(opts *fs.Options) string {
+			if mo := opts.MountOptions; mo.FsName != "ws" || mo.Name != "gp" {
+				return fmt.Sprintf("fsname %s subtype %s, want ws gp", mo.FsName, mo.Name)
+			}
+			return ""
+		}},
+		{"attr cache ttl", &pb.Settings{AttrCacheTtlMs: 5000}, func(opts *fs.Options) string {
+			if *opts.EntryTimeout != 5*time.Second || *opts.AttrTimeout != 5*time.Second {
+				return fmt.Sprintf("timeouts %v %v, want 5s", *opts.EntryTimeout, *opts.AttrTimeout)
+			}
+			return ""
+		}},
+		{"timeouts", &pb.Settings{AttrCacheTtlMs: 5000, MountOptions: &pb.MountOptions{EntryTimeoutMs: 200, AttrTimeoutMs: 300}}, func(opts *fs.Options) string {
+			if *opts.EntryTimeout != 200*time.Millisecond || *opts.AttrTimeout != 300*time.Millisecond {
+				return fmt.Sprintf("timeouts %v %v, want 200ms 300ms", *opts.EntryTimeout, *opts.AttrTimeout)
+			}
+			return ""
+		}},
+		{"limits", &pb.Settings{MountOptions: &pb.MountOptions{MaxBackground: 64, MaxWrite: 1 << 20}}, func(opts *fs.Options) string {
+			if mo := opts.MountOptions; mo.MaxBackground != 64 || mo.MaxWrite != 1<<20 {
+				return fmt.Sprintf("max_background %d max_write %d, want 64 %d", mo.MaxBackground, mo.MaxWrite, 1<<20)
+			}
+			return ""
+		}},
+		{"options", &pb.Settings{MountOptions: &pb.MountOptions{ReadOnly: true, DefaultPermissions: true}}, func(opts *fs.Options) string {
+			if o := strings.Join(opts.MountOptions.Options, ","); o != "default_permissions,ro" {
+				return fmt.Sprintf("options %s, want default_permissions,ro", o)
+			}
+			return ""
+		}},
+	} {
+		gpf := &GoPathFs{cfg: &conf.Config{Settings: tc.settings}, absWorkspace: "/ws"}
+		opts, err := gpf.mountOptions()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if msg := tc.want(opts); msg != "" {
+			t.Errorf("%s: %s", tc.name, msg)
+		}
+	}
+
+	gpf := &GoPathFs{cfg: &conf.Config{Settings: &pb.Settings{
+		MountOptions: &pb.MountOptions{AllowOther: true, AllowRoot: true},
+	}}}
+	if _, err := gpf.mountOptions(); err == nil {
+		t.Error("allow_other and allow_root are accepted together")
+	}
+}
+
+func TestRootOnlyFS(t *testing.T) {
+	raw := newRootOnlyFS(fuse.NewDefaultRawFileSystem())
+	cancel := make(chan struct{})
+	ops := map[string]func(h fuse.InHeader) fuse.Status{
+		"Lookup": func(h fuse.InHeader) fuse.Status { return raw.Lookup(cancel, &h, "a", &fuse.EntryOut{}) },
+		"GetAttr": func(h fuse.InHeader) fuse.Status {
+			return raw.GetAttr(cancel, &fuse.GetAttrIn{InHeader: h}, &fuse.AttrOut{})
+		},
+		"SetAttr": func(h fuse.InHeader) fuse.Status {
+			return raw.SetAttr(cancel, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: h}}, &fuse.AttrOut{})
+		},
+		"Mknod": func(h fuse.InHeader) fuse.Status {
+			return raw.Mknod(cancel, &fuse.MknodIn{InHeader: h}, "a", &fuse.EntryOut{})
+		},
+		"Mkdir": func(h fuse.InHeader) fuse.Status {
+			return raw.Mkdir(cancel, &fuse.MkdirIn{InHeader: h}, "a", &fuse.EntryOut{})
+		},
+		"Unlink": func(h fuse.InHeader) fuse.Status { return raw.Unlink(cancel, &h, "a") },
+		"Rmdir":  func(h fuse.InHeader) fuse.Status { return raw.Rmdir(cancel, &h, "a") },
+		"Rename": func(h fuse.InHeader) fuse.Status {
+			return raw.Rename(cancel, &fuse.RenameIn{InHeader: h}, "a", "b")
+		},
+		"Link": func(h fuse.InHeader) fuse.Status {
+			return raw.Link(cancel, &fuse.LinkIn{InHeader: h}, "a", &fuse.EntryOut{})
+		},
+		"Symlink": func(h fuse.InHeader) fuse.Status { return raw.Symlink(cancel, &h, "a", "b", &fuse.EntryOut{}) },
+		"Readlink": func(h fuse.InHeader) fuse.Status {
+			_, st := raw.Readlink(cancel, &h)
+			return st
+		},
+		"Access": func(h fuse.InHeader) fuse.Status { return raw.Access(cancel, &fuse.AccessIn{InHeader: h}) },
+		"GetXAttr": func(h fuse.InHeader) fuse.Status {
+			_, st := raw.GetXAttr(cancel, &h, "user.a", nil)
+			return st
+		},
+		"ListXAttr": func(h fuse.InHeader) fuse.Status {
+			_, st := raw.ListXAttr(cancel, &h, nil)
+			return st
+		},
+		"SetXAttr": func(h fuse.InHeader) fuse.Status {
+			return raw.SetXAttr(cancel, &fuse.SetXAttrIn{InHeader: h}, "user.a", nil)
+		},
+		"RemoveXAttr": func(h fuse.InHeader) fuse.Status { return raw.RemoveXAttr(cancel, &h, "user.a") },
+		"Create": func(h fuse.InHeader) fuse.Status {
+			return raw.Create(cancel, &fuse.CreateIn{InHeader: h}, "a", &fuse.CreateOut{})
+		},
+		"Open": func(h fuse.InHeader) fuse.Status {
+			return raw.Open(cancel, &fuse.OpenIn{InHeader: h}, &fuse.OpenOut{})
+		},
+		"OpenDir": func(h fuse.InHeader) fuse.Status {
+			return raw.OpenDir(cancel, &fuse.OpenIn{InHeader: h}, &fuse.OpenOut{})
+		},
+		"StatFs": func(h fuse.InHeader) fuse.Status { return raw.StatFs(cancel, &h, &fuse.StatfsOut{}) },
+		"Statx": func(h fuse.InHeader) fuse.Status {
+			return raw.Statx(cancel, &fuse.StatxIn{InHeader: h}, &fuse.StatxOut{})
+		},
+	}
+
+	caller := func(uid uint32) fuse.InHeader {
+		return fuse.InHeader{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uid}}}
+	}
+	other := uint32(os.Getuid()) + 1000
+	for name, op := range ops {
+		for _, uid := range []uint32{0, uint32(os.Getuid())} {
+			if st := op(caller(uid)); st == fuse.EACCES {
+				t.Errorf("%s by uid %d is denied", name, uid)
+			}
+		}
+		if st := op(caller(other)); st != fuse.EACCES {
+			t.Errorf("%s by uid %d = %v, want EACCES", name, other, st)
+		}
+	}
+}
+
+// BenchmarkStat compares the latency of stat(2) through the mount with the
+// actual file.
+func BenchmarkStat(b *testing.B) {
+	m := mountWorkspace(b, map[string]string{})
+	for _, bm := range []struct {
+		name string
+		path string
+	}{
+		{"actual", filepath.Join(m.ws, "a/f.go")},
+		{"mount", m.virtual("a/f.go")},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := os.Stat(bm.path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRead compares the latency of opening and reading a file through
+// the mount with the actual file.
+func BenchmarkRead(b *testing.B) {
+	m := mountWorkspace(b, map[string]string{})
+	for _, bm := range []struct {
+		name string
+		path string
+	}{
+		{"actual", filepath.Join(m.ws, "a/f.go")},
+		{"mount", m.virtual("a/f.go")},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ioutil.ReadFile(bm.path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package gopathfs
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/linuxerwang/goplz/trace"
+)
+
+// node is a FUSE inode of the virtual tree. It resolves its virtual path
+// from the inode tree, and delegates the operations to GoPathFs.
+type node struct {
+	fs.Inode
+	gpf *GoPathFs
+}
+
+// Make sure *node implements the node interfaces.
+var (
+	_ = (fs.NodeAccesser)((*node)(nil))
+	_ = (fs.NodeGetattrer)((*node)(nil))
+	_ = (fs.NodeSetattrer)((*node)(nil))
+	_ = (fs.NodeLookuper)((*node)(nil))
+	_ = (fs.NodeReaddirer)((*node)(nil))
+	_ = (fs.NodeMkdirer)((*node)(nil))
+	_ = (fs.NodeRmdirer)((*node)(nil))
+	_ = (fs.NodeOpener)((*node)(nil))
+	_ = (fs.NodeCreater)((*node)(nil))
+	_ = (fs.NodeUnlinker)((*node)(nil))
+	_ = (fs.NodeRenamer)((*node)(nil))
+	_ = (fs.NodeStatfser)((*node)(nil))
+	_ = (fs.NodeFsyncer)((*node)(nil))
+	_ = (fs.NodeReadlinker)((*node)(nil))
+	_ = (fs.NodeSymlinker)((*node)(nil))
+	_ = (fs.NodeLinker)((*node)(nil))
+	_ = (fs.NodeGetxattrer)((*node)(nil))
+	_ = (fs.NodeListxattrer)((*node)(nil))
+	_ = (fs.NodeSetxattrer)((*node)(nil))
+	_ = (fs.NodeRemovexattrer)((*node)(nil))
+)
+
+// virtual returns the virtual path of the node.
+func (n *node) virtual() string {
+	return n.Path(nil)
+}
+
+// child returns the virtual path of the child of the node.
+func (n *node) child(name string) string {
+	return filepath.Join(n.virtual(), name)
+}
+
+// newChild creates the inode for the virtual child of the node.
+func (n *node) newChild(ctx context.Context, virtual string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := n.gpf.GetAttr(virtual, &out.Attr); errno != fs.OK {
+		return nil, errno
+	}
+	stable := fs.StableAttr{
+		Mode: out.Attr.Mode & syscall.S_IFMT,
+		Ino:  out.Attr.Ino,
+	}
+	return n.NewInode(ctx, &node{gpf: n.gpf}, stable), fs.OK
+}
+
+func (n *node) Access(ctx context.Context, mask uint32) syscall.Errno {
+	caller, _ := fuse.FromContext(ctx)
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "access", Virtual: virtual, Mode: mask})
+	return t.end(n.gpf.Access(virtual, mask, caller))
+}
+
+func (n *node) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "getattr", Virtual: virtual})
+	if f, ok := fh.(fs.FileGetattrer); ok {
+		// The open file may be unlinked or renamed, fstat it instead of the
+		// virtual path.
+		errno := f.Getattr(ctx, out)
+		// The inode is the virtual one, not the actual file's.
+		out.Ino = 0
+		return t.end(errno)
+	}
+	return t.end(n.gpf.GetAttr(virtual, &out.Attr))
+}
+
+func (n *node) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "setattr", Virtual: virtual, Flags: in.Valid, Mode: in.Mode, Size: in.Size})
+	if f, ok := fh.(fs.FileSetattrer); ok {
+		// E.g. ftruncate(2) on a file unlinked or renamed since it was
+		// opened.
+		errno := f.Setattr(ctx, in, out)
+		out.Ino = 0
+		return t.end(errno)
+	}
+	return t.end(n.gpf.SetAttr(virtual, in, &out.Attr))
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	virtual := n.child(name)
+	t := n.gpf.begin(trace.Record{Op: "lookup", Virtual: virtual})
+	child, errno := n.newChild(ctx, virtual, out)
+	return child, t.end(errno)
+}
+
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "readdir", Virtual: virtual})
+	entries, errno := n.gpf.OpenDir(virtual)
+	if t.end(errno) != fs.OK {
+		return nil, errno
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	virtual := n.child(name)
+	t := n.gpf.begin(trace.Record{Op: "mkdir", Virtual: virtual, Mode: mode})
+	if errno := t.end(n.gpf.Mkdir(virtual, mode)); errno != fs.OK {
+		return nil, errno
+	}
+	return n.newChild(ctx, virtual, out)
+}
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	virtual := n.child(name)
+	t := n.gpf.begin(trace.Record{Op: "rmdir", Virtual: virtual})
+	return t.end(n.gpf.Rmdir(virtual))
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "open", Virtual: virtual, Flags: flags})
+	fh, errno := n.gpf.Open(virtual, flags)
+	return fh, 0, t.end(errno)
+}
+
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	virtual := n.child(name)
+	t := n.gpf.begin(trace.Record{Op: "create", Virtual: virtual, Flags: flags, Mode: mode})
+	fh, errno := n.gpf.Create(virtual, flags, mode)
+	if t.end(errno) != fs.OK {
+		return nil, nil, 0, errno
+	}
+	child, errno := n.newChild(ctx, virtual, out)
+	if errno != fs.OK {
+		if r, ok := fh.(fs.FileReleaser); ok {
+			r.Release(ctx)
+		}
+		return nil, nil, 0, errno
+	}
+	return child, fh, 0, fs.OK
+}
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	virtual := n.child(name)
+	t := n.gpf.begin(trace.Record{Op: "unlink", Virtual: virtual})
+	return t.end(n.gpf.Unlink(virtual))
+}
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "readlink", Virtual: virtual})
+	target, errno := n.gpf.Readlink(virtual)
+	return target, t.end(errno)
+}
+
+func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	virtual := n.child(name)
+	t := n.gpf.begin(trace.Record{Op: "symlink", Virtual: virtual, Target: target})
+	if errno := t.end(n.gpf.Symlink(target, virtual)); errno != fs.OK {
+		return nil, errno
+	}
+	return n.newChild(ctx, virtual, out)
+}
+
+func (n *node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	virtual := n.child(name)
+	targetVirtual := target.EmbeddedInode().Path(nil)
+	t := n.gpf.begin(trace.Record{Op: "link", Virtual: virtual, Target: targetVirtual})
+	if errno := t.end(n.gpf.Link(targetVirtual, virtual)); errno != fs.OK {
+		return nil, errno
+	}
+	if errno := n.gpf.GetAttr(virtual, &out.Attr); errno != fs.OK {
+		return nil, errno
+	}
+	// The link is the same inode as the target, which the kernel may have
+	// looked up before it was hard linked, with its virtual inode number.
+	return target.EmbeddedInode(), fs.OK
+}
+
+func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	newVirtual := filepath.Join(newParent.EmbeddedInode().Path(nil), newName)
+	virtual := n.child(name)
+	t := n.gpf.begin(trace.Record{Op: "rename", Virtual: virtual, NewVirtual: newVirtual, Flags: flags})
+	return t.end(n.gpf.Rename(virtual, newVirtual, flags))
+}
+
+func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "statfs", Virtual: virtual})
+	return t.end(n.gpf.StatFs(virtual, out))
+}
+
+func (n *node) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
+	if f, ok := fh.(fs.FileFsyncer); ok {
+		return f.Fsync(ctx, flags)
+	}
+	// The directories have no file handle.
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "fsyncdir", Virtual: virtual})
+	return t.end(n.gpf.FsyncDir(virtual))
+}
+
+func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "getxattr", Virtual: virtual, Attr: attr})
+	data, errno := n.gpf.GetXAttr(virtual, attr)
+	if t.end(errno) != fs.OK {
+		return 0, errno
+	}
+	if len(dest) < len(data) {
+		return uint32(len(data)), syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), fs.OK
+}
+
+func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "listxattr", Virtual: virtual})
+	attrs, errno := n.gpf.ListXAttr(virtual)
+	if t.end(errno) != fs.OK {
+		return 0, errno
+	}
+	var buf []byte
+	for _, attr := range attrs {
+		buf = append(append(buf, attr...), 0)
+	}
+	if len(dest) < len(buf) {
+		return uint32(len(buf)), syscall.ERANGE
+	}
+	return uint32(copy(dest, buf)), fs.OK
+}
+
+func (n *node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "setxattr", Virtual: virtual, Attr: attr, Data: data, Flags: flags})
+	return t.end(n.gpf.SetXAttr(virtual, attr, data, int(flags)))
+}
+
+func (n *node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	virtual := n.virtual()
+	t := n.gpf.begin(trace.Record{Op: "removexattr", Virtual: virtual, Attr: attr})
+	return t.end(n.gpf.RemoveXAttr(virtual, attr))
+}
@@ -0,0 +1,304 @@
+package gopathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+func TestStatFs(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	var actual, virtual unix.Statfs_t
+	if err := unix.Statfs(m.ws, &actual); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Statfs(m.virtual("a"), &virtual); err != nil {
+		t.Fatal(err)
+	}
+	if virtual.Blocks != actual.Blocks || virtual.Bsize != actual.Bsize {
+		t.Errorf("statfs blocks %d of %d bytes, expected %d of %d bytes", virtual.Blocks, virtual.Bsize, actual.Blocks, actual.Bsize)
+	}
+	// The synthetic directories have no actual directory.
+	if err := unix.Statfs(filepath.Join(m.mnt, "src"), &virtual); err != nil || virtual.Blocks != actual.Blocks {
+		t.Errorf("statfs of synthetic directory got %d blocks %v, expected %d", virtual.Blocks, err, actual.Blocks)
+	}
+}
+
+func TestFlock(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	f, err := os.Open(m.virtual("a/f.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		t.Fatalf("flock failed, %v", err)
+	}
+
+	// The lock is taken on the actual file.
+	for _, fn := range []string{m.virtual("a/f.go"), filepath.Join(m.ws, "a/f.go")} {
+		other, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unix.Flock(int(other.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != unix.EWOULDBLOCK {
+			t.Errorf("second flock on %s got %v, expected EWOULDBLOCK", fn, err)
+		}
+		other.Close()
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
+		t.Fatalf("unlock failed, %v", err)
+	}
+	other, err := os.Open(m.virtual("a/f.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := unix.Flock(int(other.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		t.Errorf("flock after unlock failed, %v", err)
+	}
+}
+
+func TestPosixLock(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	f, err := os.OpenFile(m.virtual("a/f.go"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Start: 0, Len: 4}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &lk); err != nil {
+		t.Fatalf("fcntl lock failed, %v", err)
+	}
+
+	other, err := os.OpenFile(m.virtual("a/f.go"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	lk = unix.Flock_t{Type: unix.F_WRLCK, Start: 2, Len: 4}
+	if err := unix.FcntlFlock(other.Fd(), unix.F_OFD_SETLK, &lk); err != unix.EAGAIN {
+		t.Errorf("overlapping lock got %v, expected EAGAIN", err)
+	}
+	lk = unix.Flock_t{Type: unix.F_WRLCK, Start: 2, Len: 4}
+	if err := unix.FcntlFlock(other.Fd(), unix.F_OFD_GETLK, &lk); err != nil {
+		t.Fatal(err)
+	}
+	if lk.Type != unix.F_WRLCK || lk.Start != 0 || lk.Len != 4 {
+		t.Errorf("getlk got type %d [%d, +%d), expected the write lock [0, +4)", lk.Type, lk.Start, lk.Len)
+	}
+	lk = unix.Flock_t{Type: unix.F_WRLCK, Start: 4, Len: 4}
+	if err := unix.FcntlFlock(other.Fd(), unix.F_OFD_SETLK, &lk); err != nil {
+		t.Errorf("lock of disjoint range failed, %v", err)
+	}
+}
+
+func TestFallocate(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	f, err := os.OpenFile(m.virtual("a/f.go"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := unix.Fallocate(int(f.Fd()), 0, 0, 1<<20); err != nil {
+		t.Fatalf("fallocate failed, %v", err)
+	}
+	for _, fn := range []string{m.virtual("a/f.go"), filepath.Join(m.ws, "a/f.go")} {
+		if fi, err := os.Stat(fn); err != nil || fi.Size() != 1<<20 {
+			t.Errorf("size of %s after fallocate is %v %v, expected %d", fn, fi.Size(), err, 1<<20)
+		}
+	}
+}
+
+func TestLseek(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	// A sparse file with data in the first block only.
+	fn := filepath.Join(m.ws, "a/sparse.go")
+	if err := ioutil.WriteFile(fn, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(fn, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	m.gpf.change("a/sparse.go", notify.Create)
+
+	seek := func(fn string, offset int64, whence int) (int64, error) {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return unix.Seek(int(f.Fd()), offset, whence)
+	}
+	for _, tc := range []struct {
+		name   string
+		offset int64
+		whence int
+	}{
+		{"SEEK_DATA", 0, unix.SEEK_DATA},
+		{"SEEK_HOLE", 0, unix.SEEK_HOLE},
+		{"SEEK_DATA in hole", 8192, unix.SEEK_DATA},
+		{"SEEK_END", -1, unix.SEEK_END},
+	} {
+		expected, expectedErr := seek(fn, tc.offset, tc.whence)
+		got, err := seek(m.virtual("a/sparse.go"), tc.offset, tc.whence)
+		if got != expected || err != expectedErr {
+			t.Errorf("%s got %d %v, expected %d %v as the actual file", tc.name, got, err, expected, expectedErr)
+		}
+	}
+}
+
+func TestFsync(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	for _, fn := range []string{
+		m.virtual("a/f.go"),
+		m.virtual("a"),
+		// A synthetic directory.
+		filepath.Join(m.mnt, "src"),
+	} {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Sync(); err != nil {
+			t.Errorf("fsync of %s failed, %v", fn, err)
+		}
+		f.Close()
+	}
+}
+
+func TestGetXAttr(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	for _, tc := range []struct {
+		path, attr, want string
+	}{
+		{"a/f.go", xattrActual, "a/f.go"},
+		{"a/f.go", xattrReadonly, "false"},
+		{"a/x.pb.go", xattrActual, "plz-out/gen/a/x.pb.go"},
+		{"a/x.pb.go", xattrRule, m.gpf.mapper.Rule("plz-out/gen/a/x.pb.go")},
+		{"a/x.pb.go", xattrReadonly, "true"},
+	} {
+		buf := make([]byte, 256)
+		n, err := unix.Lgetxattr(m.virtual(tc.path), tc.attr, buf)
+		if err != nil || string(buf[:n]) != tc.want {
+			t.Errorf("xattr %s of %s is %q %v, want %q", tc.attr, tc.path, buf[:n], err, tc.want)
+		}
+	}
+	if rule := m.gpf.mapper.Rule("plz-out/gen/a/x.pb.go"); !strings.HasPrefix(rule, "source_mapping[0].filter[0] ") {
+		t.Errorf("rule of x.pb.go is %q, want source_mapping[0].filter[0]", rule)
+	}
+
+	// The synthetic directories have no actual file, and are readonly.
+	src := filepath.Join(m.mnt, "src")
+	if _, err := unix.Lgetxattr(src, xattrActual, make([]byte, 256)); err != unix.ENODATA {
+		t.Errorf("actual of synthetic directory got %v, want ENODATA", err)
+	}
+	buf := make([]byte, 256)
+	if n, err := unix.Lgetxattr(src, xattrReadonly, buf); err != nil || string(buf[:n]) != "true" {
+		t.Errorf("readonly of synthetic directory is %q %v, want true", buf[:n], err)
+	}
+	if _, err := unix.Lgetxattr(m.virtual("a/f.go"), xattrPrefix+"other", buf); err != unix.ENODATA {
+		t.Errorf("unknown goplz xattr got %v, want ENODATA", err)
+	}
+}
+
+func TestXAttrSizes(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+	path := m.virtual("a/f.go")
+
+	// A nil buffer probes the size.
+	n, err := unix.Lgetxattr(path, xattrActual, nil)
+	if err != nil || n != len("a/f.go") {
+		t.Errorf("size of actual is %d %v, want %d", n, err, len("a/f.go"))
+	}
+	if _, err := unix.Lgetxattr(path, xattrActual, make([]byte, 2)); err != unix.ERANGE {
+		t.Errorf("get into a short buffer got %v, want ERANGE", err)
+	}
+
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		t.Fatalf("size of xattr list failed, %v", err)
+	}
+	if _, err := unix.Llistxattr(path, make([]byte, size-1)); err != unix.ERANGE {
+		t.Errorf("list into a short buffer got %v, want ERANGE", err)
+	}
+	buf := make([]byte, size)
+	n, err = unix.Llistxattr(path, buf)
+	if err != nil || n != size {
+		t.Fatalf("list got %d %v, want %d", n, err, size)
+	}
+	want := xattrActual + "\x00" + xattrRule + "\x00" + xattrReadonly + "\x00"
+	if string(buf[:n]) != want {
+		t.Errorf("xattrs are %q, want %q", buf[:n], want)
+	}
+}
+
+func TestRealXAttrs(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+	if err := unix.Lsetxattr(filepath.Join(m.ws, "a/f.go"), "user.probe", []byte("x"), 0); err != nil {
+		t.Skipf("user xattrs are not supported, %v", err)
+	}
+	// An xattr of the goplz namespace can't be forged on the actual file.
+	if err := unix.Lsetxattr(filepath.Join(m.ws, "a/f.go"), xattrActual, []byte("/etc/passwd"), 0); err != nil {
+		t.Fatal(err)
+	}
+	path := m.virtual("a/f.go")
+
+	if err := unix.Lsetxattr(path, "user.test", []byte("value"), 0); err != nil {
+		t.Fatalf("setxattr failed, %v", err)
+	}
+	buf := make([]byte, 256)
+	if n, err := unix.Lgetxattr(filepath.Join(m.ws, "a/f.go"), "user.test", buf); err != nil || string(buf[:n]) != "value" {
+		t.Errorf("actual xattr is %q %v, want value", buf[:n], err)
+	}
+	if n, err := unix.Lgetxattr(path, "user.test", buf); err != nil || string(buf[:n]) != "value" {
+		t.Errorf("xattr through the mount is %q %v, want value", buf[:n], err)
+	}
+	if n, err := unix.Lgetxattr(path, xattrActual, buf); err != nil || string(buf[:n]) != "a/f.go" {
+		t.Errorf("actual is %q %v, want a/f.go", buf[:n], err)
+	}
+	n, err := unix.Llistxattr(path, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := string(buf[:n]); !strings.Contains(names, "user.test\x00") || strings.Count(names, xattrActual+"\x00") != 1 {
+		t.Errorf("xattrs are %q, want user.test and one %s", names, xattrActual)
+	}
+
+	if err := unix.Lremovexattr(path, "user.test"); err != nil {
+		t.Fatalf("removexattr failed, %v", err)
+	}
+	if _, err := unix.Lgetxattr(filepath.Join(m.ws, "a/f.go"), "user.test", buf); err != unix.ENODATA {
+		t.Errorf("actual xattr after removal got %v, want ENODATA", err)
+	}
+}
+
+func TestSetGoplzXAttr(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+	path := m.virtual("a/f.go")
+
+	for _, attr := range []string{xattrActual, xattrRule, xattrReadonly, xattrPrefix + "other"} {
+		if err := unix.Lsetxattr(path, attr, []byte("x"), 0); err != unix.EPERM {
+			t.Errorf("setting %s got %v, want EPERM", attr, err)
+		}
+		if err := unix.Lremovexattr(path, attr); err != unix.EPERM {
+			t.Errorf("removing %s got %v, want EPERM", attr, err)
+		}
+	}
+	if err := unix.Lsetxattr(m.virtual("a/x.pb.go"), "user.test", []byte("x"), 0); err != unix.EROFS {
+		t.Errorf("setting xattr of readonly file got %v, want EROFS", err)
+	}
+}
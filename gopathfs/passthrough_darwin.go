@@ -0,0 +1,11 @@
+package gopathfs
+
+import (
+	"errors"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func probePassthrough(server *fuse.Server, fn string) error {
+	return errors.New("not supported on darwin")
+}
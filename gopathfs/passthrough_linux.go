@@ -0,0 +1,30 @@
+package gopathfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// probePassthrough returns nil if the kernel accepts the actual file fn as
+// the backing file of a passthrough file on the mount.
+func probePassthrough(server *fuse.Server, fn string) error {
+	if server.KernelSettings().Flags64()&fuse.CAP_PASSTHROUGH == 0 {
+		return errors.New("not supported by the kernel, it requires Linux 6.9+")
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	id, errno := server.RegisterBackingFd(&fuse.BackingMap{Fd: int32(f.Fd())})
+	if errno != 0 {
+		// goplz needs CAP_SYS_ADMIN to register backing files.
+		return fmt.Errorf("failed to register backing file, %v", errno)
+	}
+	server.UnregisterBackingFd(id)
+	return nil
+}
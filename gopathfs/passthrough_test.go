@@ -0,0 +1,49 @@
+package gopathfs
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	pb "github.com/linuxerwang/goplz/conf/proto"
+)
+
+// expectLoopback checks that the files are read and written through goplz,
+// for the reason.
+func expectLoopback(t *testing.T, m *testMount, reason string) {
+	t.Helper()
+	if r := m.gpf.Report(); r == nil || r.IO != "loopback" || !strings.Contains(r.Reason, reason) {
+		t.Errorf("report %+v, want loopback because %s", r, reason)
+	}
+	fh, errno := m.gpf.Open("src/example.com/ws/a/f.go", syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("open failed, %v", errno)
+	}
+	defer fh.(fs.FileReleaser).Release(context.Background())
+	if _, ok := fh.(*file); !ok {
+		t.Errorf("opened %T, want a loopback *file", fh)
+	}
+}
+
+func TestPassthroughDisabled(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+	expectLoopback(t, m, "disabled by mount_options.disable_passthrough")
+}
+
+func TestPassthroughProbeFailed(t *testing.T) {
+	m := mountWith(t, map[string]string{}, func(gpf *GoPathFs) {
+		gpf.cfg.Settings.MountOptions = &pb.MountOptions{}
+		// The probe opens .plzconfig.
+		gpf.cfg.PlzConf = filepath.Join(gpf.cfg.Workspace, "missing")
+	})
+	// The kernel may not support passthrough, the file is missing anyway.
+	r := m.gpf.Report()
+	if r == nil || r.Reason == "" {
+		t.Fatalf("report %+v, want a reason", r)
+	}
+	expectLoopback(t, m, r.Reason)
+}
@@ -0,0 +1,266 @@
+package gopathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/linuxerwang/goplz/vfs"
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+// The POSIX conformance tests, in the spirit of pjdfstest: each operation is
+// checked for the errno, and for the effects on the actual files.
+
+// expectErrno checks the error of the operation is the errno, or nil if
+// errno is 0.
+func expectErrno(t *testing.T, op string, err error, errno syscall.Errno) {
+	t.Helper()
+	if errno == 0 {
+		if err != nil {
+			t.Errorf("%s failed, %v", op, err)
+		}
+		return
+	}
+	if e, ok := err.(syscall.Errno); !ok || e != errno {
+		t.Errorf("%s got %v, expected %v", op, err, errno)
+	}
+}
+
+// expectActual checks whether the actual file exists.
+func expectActual(t *testing.T, m *testMount, name string, exists bool) {
+	t.Helper()
+	_, err := os.Lstat(filepath.Join(m.ws, name))
+	if exists && err != nil {
+		t.Errorf("actual file %s is missing, %v", name, err)
+	} else if !exists && !os.IsNotExist(err) {
+		t.Errorf("actual file %s exists, %v", name, err)
+	}
+}
+
+func TestPosixUnlink(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{
+		"a/g.go":   "package a\n",
+		"a/d/h.go": "package d\n",
+	})
+
+	expectErrno(t, "unlink", unix.Unlink(m.virtual("a/g.go")), 0)
+	expectActual(t, m, "a/g.go", false)
+	expectErrno(t, "stat of unlinked file", statErr(m.virtual("a/g.go")), syscall.ENOENT)
+	expectErrno(t, "unlink of missing file", unix.Unlink(m.virtual("a/g.go")), syscall.ENOENT)
+	expectErrno(t, "unlink of directory", unix.Unlink(m.virtual("a/d")), syscall.EISDIR)
+	expectActual(t, m, "a/d/h.go", true)
+	expectErrno(t, "unlink of readonly file", unix.Unlink(m.virtual("a/x.pb.go")), syscall.EROFS)
+	expectActual(t, m, "plz-out/gen/a/x.pb.go", true)
+	expectErrno(t, "unlink in missing directory", unix.Unlink(m.virtual("a/zz/g.go")), syscall.ENOENT)
+}
+
+func TestPosixRmdir(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{"a/d/h.go": "package d\n"})
+	if err := os.MkdirAll(filepath.Join(m.ws, "a/e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m.gpf.change("a/e", notify.Create)
+
+	expectErrno(t, "rmdir of non-empty directory", unix.Rmdir(m.virtual("a/d")), syscall.ENOTEMPTY)
+	expectActual(t, m, "a/d/h.go", true)
+	expectErrno(t, "rmdir of non-empty synthetic directory", unix.Rmdir(filepath.Join(m.mnt, "src")), syscall.ENOTEMPTY)
+	expectErrno(t, "rmdir of file", unix.Rmdir(m.virtual("a/f.go")), syscall.ENOTDIR)
+	expectErrno(t, "rmdir of missing directory", unix.Rmdir(m.virtual("a/zz")), syscall.ENOENT)
+
+	expectErrno(t, "rmdir of empty directory", unix.Rmdir(m.virtual("a/e")), 0)
+	expectActual(t, m, "a/e", false)
+	expectErrno(t, "stat of removed directory", statErr(m.virtual("a/e")), syscall.ENOENT)
+
+	expectErrno(t, "unlink", unix.Unlink(m.virtual("a/d/h.go")), 0)
+	expectErrno(t, "rmdir of emptied directory", unix.Rmdir(m.virtual("a/d")), 0)
+	expectActual(t, m, "a/d", false)
+}
+
+func TestPosixModes(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+	defer unix.Umask(unix.Umask(0))
+
+	for _, tc := range []struct {
+		name  string
+		umask int
+		mode  uint32
+		dir   bool
+		want  os.FileMode
+	}{
+		{"a/d1", 022, 0777, true, 0755},
+		{"a/d2", 027, 0777, true, 0750},
+		{"a/d3", 022, 0700, true, 0700},
+		{"a/d4", 0, 0777, true, 0777},
+		{"a/f1.go", 022, 0666, false, 0644},
+		{"a/f2.go", 077, 0666, false, 0600},
+		{"a/f3.go", 0, 0777, false, 0777},
+	} {
+		unix.Umask(tc.umask)
+		if tc.dir {
+			expectErrno(t, "mkdir "+tc.name, unix.Mkdir(m.virtual(tc.name), tc.mode), 0)
+		} else {
+			fd, err := unix.Open(m.virtual(tc.name), unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY, tc.mode)
+			expectErrno(t, "create "+tc.name, err, 0)
+			unix.Close(fd)
+		}
+		for _, fn := range []string{m.virtual(tc.name), filepath.Join(m.ws, tc.name)} {
+			if fi, err := os.Stat(fn); err != nil || fi.Mode().Perm() != tc.want {
+				t.Errorf("mode of %s with umask %03o is %v %v, expected %v", fn, tc.umask, fi.Mode().Perm(), err, tc.want)
+			}
+		}
+	}
+	unix.Umask(022)
+
+	expectErrno(t, "mkdir of existing directory", unix.Mkdir(m.virtual("a/d1"), 0777), syscall.EEXIST)
+	expectErrno(t, "mkdir of existing file", unix.Mkdir(m.virtual("a/f.go"), 0777), syscall.EEXIST)
+	expectErrno(t, "mkdir in missing directory", unix.Mkdir(m.virtual("a/zz/d"), 0777), syscall.ENOENT)
+	_, err := unix.Open(m.virtual("a/f1.go"), unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY, 0644)
+	expectErrno(t, "exclusive create of existing file", err, syscall.EEXIST)
+	_, err = unix.Open(m.virtual("a/zz.go"), unix.O_RDONLY, 0)
+	expectErrno(t, "open of missing file", err, syscall.ENOENT)
+	_, err = unix.Open(m.virtual("a/x.pb.go"), unix.O_WRONLY, 0)
+	expectErrno(t, "open of readonly file for writing", err, syscall.EROFS)
+}
+
+func TestPosixRenameOverExisting(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{
+		"a/g.go":   "g",
+		"a/h.go":   "h",
+		"a/d/i.go": "i",
+		"a/e/j.go": "j",
+	})
+	if err := os.MkdirAll(filepath.Join(m.ws, "a/empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m.gpf.change("a/empty", notify.Create)
+
+	expectErrno(t, "rename over file", unix.Rename(m.virtual("a/g.go"), m.virtual("a/h.go")), 0)
+	for _, fn := range []string{m.virtual("a/h.go"), filepath.Join(m.ws, "a/h.go")} {
+		if b, err := ioutil.ReadFile(fn); err != nil || string(b) != "g" {
+			t.Errorf("content of %s is %q %v, expected the renamed file", fn, b, err)
+		}
+	}
+	expectErrno(t, "stat of renamed file", statErr(m.virtual("a/g.go")), syscall.ENOENT)
+	expectActual(t, m, "a/g.go", false)
+
+	expectErrno(t, "rename of file over directory", unix.Rename(m.virtual("a/h.go"), m.virtual("a/empty")), syscall.EISDIR)
+	expectErrno(t, "rename of directory over file", unix.Rename(m.virtual("a/empty"), m.virtual("a/h.go")), syscall.ENOTDIR)
+	expectErrno(t, "rename over non-empty directory", unix.Rename(m.virtual("a/d"), m.virtual("a/e")), syscall.ENOTEMPTY)
+	expectActual(t, m, "a/e/j.go", true)
+	expectErrno(t, "rename over readonly file", unix.Rename(m.virtual("a/h.go"), m.virtual("a/x.pb.go")), syscall.EROFS)
+
+	expectErrno(t, "rename over empty directory", unix.Rename(m.virtual("a/d"), m.virtual("a/empty")), 0)
+	if b, err := ioutil.ReadFile(m.virtual("a/empty/i.go")); err != nil || string(b) != "i" {
+		t.Errorf("content of moved file is %q %v", b, err)
+	}
+	expectActual(t, m, "a/empty/i.go", true)
+	expectActual(t, m, "a/d", false)
+}
+
+func TestPosixRenameOverShadowingFile(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{
+		"a/g.go":                "hand-written",
+		"a/h.pb.go":             "old",
+		"plz-out/gen/a/h.pb.go": "generated",
+	})
+	if e, _ := m.gpf.vfs.MatchPath("src/example.com/ws/a/h.pb.go"); len(e.Sources()) != 2 {
+		t.Fatalf("sources of a/h.pb.go %v, expected the file and the generated file", e.Sources())
+	}
+
+	expectErrno(t, "rename over file with several sources", unix.Rename(m.virtual("a/g.go"), m.virtual("a/h.pb.go")), 0)
+	if b, err := ioutil.ReadFile(m.virtual("a/h.pb.go")); err != nil || string(b) != "hand-written" {
+		t.Errorf("content of renamed file is %q %v", b, err)
+	}
+	expectActual(t, m, "plz-out/gen/a/h.pb.go", true)
+
+	// The generated file shows through once the renamed one is deleted.
+	expectErrno(t, "unlink", unix.Unlink(m.virtual("a/h.pb.go")), 0)
+	if b, err := ioutil.ReadFile(m.virtual("a/h.pb.go")); err != nil || string(b) != "generated" {
+		t.Errorf("content after unlink is %q %v, expected the generated file", b, err)
+	}
+}
+
+func TestPosixRenameOverMergedDirectory(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{"plz-out/gen/a/d/y.pb.go": "package d\n"})
+	for _, dir := range []string{"a/d", "a/e"} {
+		if err := os.MkdirAll(filepath.Join(m.ws, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		m.gpf.change(dir, notify.Create)
+	}
+	m.gpf.vfs.TrackSource("src/example.com/ws/a/d", vfs.Source{Actual: "plz-out/gen/a/d", Readonly: true, Priority: 1, Dir: true})
+
+	expectErrno(t, "rename over merged directory", unix.Rename(m.virtual("a/e"), m.virtual("a/d")), syscall.EXDEV)
+	expectActual(t, m, "a/e", true)
+	if _, err := os.Stat(m.virtual("a/d/y.pb.go")); err != nil {
+		t.Errorf("generated file in merged directory is gone, %v", err)
+	}
+}
+
+func TestPosixOpenThenUnlink(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{"a/g.go": "old"})
+
+	f, err := os.OpenFile(m.virtual("a/g.go"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	expectErrno(t, "unlink of open file", unix.Unlink(m.virtual("a/g.go")), 0)
+	expectActual(t, m, "a/g.go", false)
+
+	// The name can be reused right away, by an unrelated file.
+	if err := ioutil.WriteFile(m.virtual("a/g.go"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("OLD"), 0); err != nil {
+		t.Errorf("write to unlinked file failed, %v", err)
+	}
+	b := make([]byte, 3)
+	if _, err := f.ReadAt(b, 0); err != nil || string(b) != "OLD" {
+		t.Errorf("read of unlinked file got %q %v", b, err)
+	}
+	if b, err := ioutil.ReadFile(m.virtual("a/g.go")); err != nil || string(b) != "new" {
+		t.Errorf("content of the new file is %q %v, expected it unchanged", b, err)
+	}
+}
+
+func TestPosixRemovalHandledAfterRecreation(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{"a/g.go": "old"})
+
+	// The watcher reports the removal only after the file was created
+	// again, e.g. by an atomic save.
+	expectErrno(t, "unlink", unix.Unlink(m.virtual("a/g.go")), 0)
+	if err := ioutil.WriteFile(m.virtual("a/g.go"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.gpf.change("a/g.go", notify.Remove); got != "ignored" {
+		t.Errorf("stale removal %s, want ignored", got)
+	}
+	if b, err := ioutil.ReadFile(m.virtual("a/g.go")); err != nil || string(b) != "new" {
+		t.Errorf("content of the new file is %q %v, expected it tracked", b, err)
+	}
+}
+
+func TestUntrackKeepsActualFiles(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{"a/d/h.go": "package d\n"})
+
+	if err := m.gpf.vfs.Untrack("src/example.com/ws/a"); err != nil {
+		t.Fatal(err)
+	}
+	// Untracking only changes the virtual tree.
+	expectActual(t, m, "a/f.go", true)
+	expectActual(t, m, "a/d/h.go", true)
+	if _, remPath := m.gpf.vfs.MatchPath("src/example.com/ws/a"); len(remPath) == 0 {
+		t.Error("untracked directory is still in the virtual tree")
+	}
+}
+
+func statErr(fn string) error {
+	var st unix.Stat_t
+	return unix.Stat(fn, &st)
+}
@@ -0,0 +1,25 @@
+package gopathfs
+
+import "golang.org/x/sys/unix"
+
+// The rename flags of FUSE are the ones of renameat2(2) on Linux.
+const (
+	renameNoreplace = 0x1
+	renameExchange  = 0x2
+)
+
+// renameActual renames the actual file, the flags are translated to the
+// ones of renamex_np(2).
+func renameActual(oldActual, newActual string, flags uint32) error {
+	var flag uint32
+	if flags&renameNoreplace != 0 {
+		flag |= unix.RENAME_EXCL
+	}
+	if flags&renameExchange != 0 {
+		flag |= unix.RENAME_SWAP
+	}
+	if flag == 0 {
+		return unix.Rename(oldActual, newActual)
+	}
+	return unix.RenamexNp(oldActual, newActual, flag)
+}
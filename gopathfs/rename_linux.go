@@ -0,0 +1,17 @@
+package gopathfs
+
+import "golang.org/x/sys/unix"
+
+const (
+	renameNoreplace = unix.RENAME_NOREPLACE
+	renameExchange  = unix.RENAME_EXCHANGE
+)
+
+// renameActual renames the actual file, the flags are the renameat2(2)
+// flags.
+func renameActual(oldActual, newActual string, flags uint32) error {
+	if flags == 0 {
+		return unix.Rename(oldActual, newActual)
+	}
+	return unix.Renameat2(unix.AT_FDCWD, oldActual, unix.AT_FDCWD, newActual, uint(flags))
+}
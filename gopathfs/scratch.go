@@ -0,0 +1,99 @@
+package gopathfs
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+// defaultScratchFiles are the names of the swap, lock and backup files of
+// Vim, Emacs and JetBrains IDEs. 4913 is the file Vim creates to check the
+// directory is writable.
+var defaultScratchFiles = []string{
+	".*.sw?",
+	"*~",
+	"4913",
+	".#*",
+	"#*#",
+	"*___jb_tmp___",
+	"*___jb_old___",
+}
+
+// scratch stores the ephemeral files created through the mount in a scratch
+// directory instead of the workspace, mirroring their virtual paths. They
+// are tracked in the virtual tree like the other files, until the scratch
+// directory is removed at unmount.
+type scratch struct {
+	// dir is the scratch directory relative to the workspace, as the other
+	// actual paths.
+	dir      string
+	patterns []string
+}
+
+func newScratch(dir string, patterns []string) *scratch {
+	if len(patterns) == 0 {
+		patterns = defaultScratchFiles
+	}
+	return &scratch{
+		dir:      dir,
+		patterns: patterns,
+	}
+}
+
+// matches returns true if the virtual file is an ephemeral file.
+func (s *scratch) matches(virtual string) bool {
+	if s.dir == "" {
+		return false
+	}
+	name := filepath.Base(virtual)
+	for _, p := range s.patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// actual returns the actual path in the scratch directory for the virtual
+// file, creating its directory if needed.
+func (s *scratch) actual(virtual string) (string, error) {
+	actual := filepath.Join(s.dir, virtual)
+	if err := os.MkdirAll(filepath.Dir(actual), 0700); err != nil {
+		return "", err
+	}
+	return actual, nil
+}
+
+// contains returns true if the actual file is in the scratch directory.
+func (s *scratch) contains(actual string) bool {
+	if s.dir == "" {
+		return false
+	}
+	return actual == s.dir || strings.HasPrefix(actual, s.dir+pathSeparator)
+}
+
+// cleanScratch untracks the files in the scratch directory and removes it.
+func (gpf *GoPathFs) cleanScratch() {
+	if gpf.scratch.dir == "" {
+		return
+	}
+	var sources []vfs.Source
+	var virtuals []string
+	gpf.vfs.Walk(func(virtual string, e vfs.Entry) {
+		for _, src := range e.Sources() {
+			if gpf.scratch.contains(src.Actual) {
+				sources = append(sources, src)
+				virtuals = append(virtuals, virtual)
+			}
+		}
+	})
+	for i, virtual := range virtuals {
+		gpf.vfs.UntrackSource(virtual, sources[i].Actual)
+	}
+	if err := os.RemoveAll(gpf.scratch.dir); err != nil {
+		log.Printf("Failed to remove the scratch directory %s, %v.\n", gpf.scratch.dir, err)
+	}
+}
@@ -0,0 +1,105 @@
+package gopathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// scratchActual returns the path of the workspace file in the scratch
+// directory.
+func (m *testMount) scratchActual(name string) string {
+	return filepath.Join(m.gpf.cfg.GoplzScratch, "src", m.gpf.cfg.GoImportPath, name)
+}
+
+func TestScratchFiles(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	for _, name := range []string{"a/.f.go.swp", "a/f.go~", "a/4913"} {
+		if err := ioutil.WriteFile(m.virtual(name), []byte(name), 0644); err != nil {
+			t.Fatalf("creating %s failed, %v", name, err)
+		}
+		if b, err := ioutil.ReadFile(m.scratchActual(name)); err != nil || string(b) != name {
+			t.Errorf("%s in the scratch directory is %q %v", name, b, err)
+		}
+		if _, err := os.Lstat(filepath.Join(m.ws, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is created in the workspace, %v", name, err)
+		}
+		if b, err := ioutil.ReadFile(m.virtual(name)); err != nil || string(b) != name {
+			t.Errorf("%s through the mount is %q %v", name, b, err)
+		}
+	}
+	// The other files are created in the workspace.
+	if err := ioutil.WriteFile(m.virtual("a/g.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectActual(t, m, "a/g.go", true)
+}
+
+func TestScratchAtomicSave(t *testing.T) {
+	m := mountWorkspace(t, map[string]string{})
+
+	// Vim's backupcopy=no moves the file away and writes it anew.
+	expectErrno(t, "rename to backup", unix.Rename(m.virtual("a/f.go"), m.virtual("a/f.go~")), 0)
+	if _, err := os.Lstat(m.scratchActual("a/f.go~")); err != nil {
+		t.Errorf("backup is not in the scratch directory, %v", err)
+	}
+	if err := ioutil.WriteFile(m.virtual("a/f.go"), []byte("package b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The swap file is written and renamed over the file.
+	if err := ioutil.WriteFile(m.virtual("a/.f.go.swp"), []byte("package c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectErrno(t, "rename of scratch file over workspace file", unix.Rename(m.virtual("a/.f.go.swp"), m.virtual("a/f.go")), 0)
+	// And to a new file.
+	if err := ioutil.WriteFile(m.virtual("a/.g.go.swp"), []byte("package d\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectErrno(t, "rename of scratch file to new file", unix.Rename(m.virtual("a/.g.go.swp"), m.virtual("a/g.go")), 0)
+
+	for name, want := range map[string]string{"a/f.go": "package c\n", "a/g.go": "package d\n"} {
+		for _, fn := range []string{m.virtual(name), filepath.Join(m.ws, name)} {
+			if b, err := ioutil.ReadFile(fn); err != nil || string(b) != want {
+				t.Errorf("%s is %q %v, want %q", fn, b, err, want)
+			}
+		}
+	}
+	for _, name := range []string{"a/.f.go.swp", "a/.g.go.swp"} {
+		expectErrno(t, "stat of renamed scratch file", statErr(m.virtual(name)), syscall.ENOENT)
+	}
+}
+
+func TestScratchCleaned(t *testing.T) {
+	var stale string
+	m := mountWith(t, map[string]string{}, func(gpf *GoPathFs) {
+		// Left by a crash.
+		stale = filepath.Join(gpf.cfg.GoplzScratch, "src/example.com/ws/a/.f.go.swp")
+		if err := os.MkdirAll(filepath.Dir(stale), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(stale, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale scratch file is kept by the mount, %v", err)
+	}
+
+	if err := ioutil.WriteFile(m.virtual("a/f.go~"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m.gpf.Stop()
+	if _, err := os.Lstat(m.gpf.cfg.GoplzScratch); !os.IsNotExist(err) {
+		t.Errorf("scratch directory is kept by Stop, %v", err)
+	}
+	if _, remPath := m.gpf.vfs.MatchPath("src/example.com/ws/a/f.go~"); len(remPath) == 0 {
+		t.Error("scratch file is still tracked after Stop")
+	}
+	expectActual(t, m, "a/f.go", true)
+}
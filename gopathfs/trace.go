@@ -0,0 +1,263 @@
+package gopathfs
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/trace"
+)
+
+var (
+	// eventNames is the names of the watched changes in the traces.
+	eventNames = map[notify.Event]string{
+		notify.Create: "create",
+		notify.Remove: "remove",
+		notify.Rename: "rename",
+		notify.Write:  "write",
+	}
+	eventsByName = map[string]notify.Event{
+		"create": notify.Create,
+		"remove": notify.Remove,
+		"rename": notify.Rename,
+		"write":  notify.Write,
+	}
+)
+
+// SetTracer traces the operations and the changes to w. It must be called
+// before the file system is mounted.
+func (gpf *GoPathFs) SetTracer(w *trace.Writer) {
+	gpf.tracer = w
+}
+
+// traceOp is a traced or measured operation or change in progress.
+type traceOp struct {
+	w       *trace.Writer
+	measure bool
+	r       trace.Record
+}
+
+// begin starts tracing and measuring the operation or change, it returns
+// nil if they're neither traced nor measured. The actual file the operation
+// is on is looked up for the trace if it's not given.
+func (gpf *GoPathFs) begin(r trace.Record) *traceOp {
+	if gpf.tracer == nil && !gpf.measure {
+		return nil
+	}
+	if gpf.tracer != nil {
+		if r.Actual == "" && r.Virtual != "" {
+			if entry, remPath := gpf.vfs.MatchPath(r.Virtual); len(remPath) == 0 {
+				r.Actual = entry.Actual()
+			}
+		}
+		if r.Actual != "" {
+			r.Type, r.Symlink = actualType(r.Actual)
+		}
+	}
+	r.Time = time.Now()
+	return &traceOp{w: gpf.tracer, measure: gpf.measure, r: r}
+}
+
+// end traces and measures the operation with its result, and returns the
+// errno.
+func (t *traceOp) end(errno syscall.Errno) syscall.Errno {
+	if t != nil {
+		t.r.Status = errnoName(errno)
+		t.finish()
+	}
+	return errno
+}
+
+// done traces and measures the change with how the virtual tree was
+// updated.
+func (t *traceOp) done(result string) {
+	if t != nil {
+		t.r.Result = result
+		t.finish()
+	}
+}
+
+func (t *traceOp) finish() {
+	latency := time.Since(t.r.Time)
+	if t.measure {
+		t.observe(latency)
+	}
+	if t.w == nil {
+		return
+	}
+	t.r.LatencyUs = latency.Microseconds()
+	if err := t.w.Write(&t.r); err != nil {
+		log.Printf("Failed to write trace, %v.\n", err)
+	}
+}
+
+// actualType returns the type of the actual file for the traces, and the
+// target if it's a symlink.
+func actualType(actual string) (string, string) {
+	fi, err := os.Lstat(actual)
+	switch {
+	case err != nil:
+		return "missing", ""
+	case fi.IsDir():
+		return "dir", ""
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, _ := os.Readlink(actual)
+		return "symlink", target
+	}
+	return "file", ""
+}
+
+func errnoName(errno syscall.Errno) string {
+	if errno == fs.OK {
+		return "OK"
+	}
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+	return errno.Error()
+}
+
+// Replay replays the traced operation or change on the file system, which
+// must not be mounted, and returns the replayed record. The actual files
+// existing in the trace before the operation are created first if they're
+// missing, empty, so that the trace can be replayed in an empty workspace.
+func (gpf *GoPathFs) Replay(r *trace.Record) *trace.Record {
+	gpf.seed(r)
+
+	out := *r
+	out.Time = time.Now()
+	out.Status, out.Result = "", ""
+	ctx := context.Background()
+	var errno syscall.Errno
+	switch r.Op {
+	case "event":
+		event, ok := eventsByName[r.Event]
+		if !ok {
+			out.Result = "unknown event"
+			break
+		}
+		out.Result = gpf.change(r.Actual, event)
+	case "access":
+		caller := fuse.Caller{Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}}
+		errno = gpf.Access(r.Virtual, r.Mode, &caller)
+	case "getattr", "lookup":
+		errno = gpf.GetAttr(r.Virtual, &fuse.Attr{})
+	case "setattr":
+		// The times and the ownership aren't replayed.
+		in := fuse.SetAttrIn{}
+		in.Valid = r.Flags & (fuse.FATTR_MODE | fuse.FATTR_SIZE)
+		in.Mode, in.Size = r.Mode, r.Size
+		errno = gpf.SetAttr(r.Virtual, &in, &fuse.Attr{})
+	case "readdir":
+		_, errno = gpf.OpenDir(r.Virtual)
+	case "mkdir":
+		errno = gpf.Mkdir(r.Virtual, r.Mode)
+	case "rmdir":
+		errno = gpf.Rmdir(r.Virtual)
+	case "open", "create":
+		var fh fs.FileHandle
+		if r.Op == "open" {
+			fh, errno = gpf.Open(r.Virtual, r.Flags)
+		} else {
+			fh, errno = gpf.Create(r.Virtual, r.Flags, r.Mode)
+		}
+		if r, ok := fh.(fs.FileReleaser); ok && errno == fs.OK {
+			r.Release(ctx)
+		}
+	case "unlink":
+		errno = gpf.Unlink(r.Virtual)
+	case "readlink":
+		_, errno = gpf.Readlink(r.Virtual)
+	case "symlink":
+		errno = gpf.Symlink(r.Target, r.Virtual)
+	case "link":
+		errno = gpf.Link(r.Target, r.Virtual)
+	case "rename":
+		errno = gpf.Rename(r.Virtual, r.NewVirtual, r.Flags)
+	case "statfs":
+		errno = gpf.StatFs(r.Virtual, &fuse.StatfsOut{})
+	case "fsyncdir":
+		errno = gpf.FsyncDir(r.Virtual)
+	case "getxattr":
+		_, errno = gpf.GetXAttr(r.Virtual, r.Attr)
+	case "listxattr":
+		_, errno = gpf.ListXAttr(r.Virtual)
+	case "setxattr":
+		errno = gpf.SetXAttr(r.Virtual, r.Attr, r.Data, int(r.Flags))
+	case "removexattr":
+		errno = gpf.RemoveXAttr(r.Virtual, r.Attr)
+	default:
+		out.Status = "unknown op"
+	}
+	if r.Op != "event" && out.Status == "" {
+		out.Status = errnoName(errno)
+	}
+	out.LatencyUs = time.Since(out.Time).Microseconds()
+	return &out
+}
+
+// seed makes the actual file of the record exist, or not for a removed
+// file, as it was before the operation or change.
+func (gpf *GoPathFs) seed(r *trace.Record) {
+	if r.Actual == "" || r.Type == "" || !mapping.Confined(r.Actual) {
+		// The trace file is not trusted to stay in the workspace.
+		return
+	}
+	_, err := os.Lstat(r.Actual)
+	if r.Type == "missing" {
+		if err == nil && r.Op == "event" {
+			// The file was removed out of the mount.
+			if err := os.RemoveAll(r.Actual); err != nil {
+				log.Printf("Failed to remove actual file %s, %v.\n", r.Actual, err)
+			}
+		}
+		return
+	}
+	if err == nil {
+		return
+	}
+
+	// The missing directories are created too, the topmost one is tracked
+	// with all in it.
+	top := r.Actual
+	for dir := filepath.Dir(r.Actual); dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		top = dir
+	}
+	if err := os.MkdirAll(filepath.Dir(r.Actual), 0755); err != nil {
+		log.Printf("Failed to create actual directory %s, %v.\n", filepath.Dir(r.Actual), err)
+		return
+	}
+	switch r.Type {
+	case "dir":
+		err = os.Mkdir(r.Actual, 0755)
+	case "symlink":
+		err = os.Symlink(r.Symlink, r.Actual)
+	default:
+		err = ioutil.WriteFile(r.Actual, nil, 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to create actual file %s, %v.\n", r.Actual, err)
+		return
+	}
+	if top != r.Actual {
+		// The created directories may not be mapped themselves, e.g.
+		// plz-out, the change would be ignored.
+		scan.Walk(top, gpf.mapper, gpf.vfs, nil, gpf.dirs)
+		return
+	}
+	gpf.change(top, notify.Create)
+}
@@ -0,0 +1,138 @@
+package gopathfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/trace"
+	"github.com/linuxerwang/goplz/vfs"
+	"golang.org/x/sys/unix"
+)
+
+// replayWorkspace returns a GoPathFs for an empty temp workspace, the current
+// directory until the test ends, as goplz trace replay does.
+func replayWorkspace(t *testing.T) (*GoPathFs, string) {
+	ws, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	cfg := testConfig(ws)
+	mapper := mapping.New(cfg)
+	tree, err := vfs.New(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan.Walk(".", mapper, tree, nil, nil)
+	return NewGoPathFs(cfg, tree, mapper, nil), ws
+}
+
+func TestTraceReplay(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "trace.jsonl")
+	w, err := trace.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The kernel may still send operations until it's unmounted.
+	t.Cleanup(func() { w.Close() })
+	m := mountWith(t, map[string]string{"a/g.go": "package a\n"}, func(gpf *GoPathFs) {
+		gpf.SetTracer(w)
+	})
+
+	// A short editing session, with some failing operations.
+	if err := os.Mkdir(m.virtual("a/d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(m.virtual("a/d/h.go"), []byte("package d\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(m.virtual("a/d/h.go"), m.virtual("a/d/i.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("i.go", m.virtual("a/d/l")); err != nil {
+		t.Fatal(err)
+	}
+	os.Readlink(m.virtual("a/d/l"))
+	os.Stat(m.virtual("a/zz.go"))
+	ioutil.ReadDir(m.virtual("a"))
+	unix.Rmdir(m.virtual("a/d"))
+	os.OpenFile(m.virtual("a/x.pb.go"), os.O_WRONLY, 0)
+	unix.Getxattr(m.virtual("a/g.go"), "user.goplz.actual", make([]byte, 256))
+	for _, name := range []string{"a/d/i.go", "a/d/l", "a/g.go"} {
+		if err := os.Remove(m.virtual(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(m.virtual("a/d")); err != nil {
+		t.Fatal(err)
+	}
+
+	gpf, _ := replayWorkspace(t)
+	ops := map[string]int{}
+	err = trace.Read(fn, func(line int, r *trace.Record) error {
+		ops[r.Op]++
+		got := gpf.Replay(r)
+		if got.Status != r.Status || got.Result != r.Result {
+			t.Errorf("line %d: %s %s recorded %s%s, replayed %s%s", line, r.Op, r.Virtual, r.Status, r.Result, got.Status, got.Result)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"mkdir", "create", "rename", "symlink", "rmdir", "unlink", "getxattr"} {
+		if ops[op] == 0 {
+			t.Errorf("no %s recorded, got %v", op, ops)
+		}
+	}
+}
+
+func TestReplaySeedConfined(t *testing.T) {
+	gpf, ws := replayWorkspace(t)
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	if err := ioutil.WriteFile(secret, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(ws, outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []trace.Record{
+		{Op: "event", Event: "remove", Actual: secret, Type: "missing"},
+		{Op: "event", Event: "remove", Actual: rel, Type: "missing"},
+		{Op: "event", Event: "remove", Actual: "a/../" + filepath.Join(rel, "secret"), Type: "missing"},
+		{Op: "getattr", Virtual: "src/example.com/ws/b.go", Actual: filepath.Join(rel, "new"), Type: "file"},
+		{Op: "getattr", Virtual: "src/example.com/ws/c", Actual: filepath.Join(outside, "dir"), Type: "dir"},
+		{Op: "readlink", Virtual: "src/example.com/ws/l", Actual: "a/../../l", Type: "symlink", Symlink: secret},
+		{Op: "getattr", Virtual: "src/example.com/ws/a/f.go", Actual: "a/f.go", Type: "file"},
+	} {
+		gpf.Replay(&r)
+	}
+
+	if _, err := os.Stat(secret); err != nil {
+		t.Errorf("file out of the workspace removed, %v", err)
+	}
+	for _, fn := range []string{filepath.Join(outside, "new"), filepath.Join(outside, "dir"), filepath.Join(filepath.Dir(ws), "l")} {
+		if _, err := os.Lstat(fn); !os.IsNotExist(err) {
+			t.Errorf("file out of the workspace %s created, %v", fn, err)
+		}
+	}
+	// The records in the workspace are seeded.
+	if _, err := os.Stat(filepath.Join(ws, "a/f.go")); err != nil {
+		t.Errorf("actual file of the record not created, %v", err)
+	}
+}
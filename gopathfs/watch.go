@@ -0,0 +1,144 @@
+package gopathfs
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/rjeczalik/notify"
+
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/trace"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+// watch starts watching the workspace for changes.
+func (gpf *GoPathFs) watch() error {
+	root := filepath.Join(gpf.cfg.Workspace, "...")
+	if verbose {
+		log.Printf("Watching directory %s for changes.", root)
+	}
+	if err := notify.Watch(root, gpf.notifyCh, notify.Create|notify.Remove|notify.Rename|notify.Write); err != nil {
+		return err
+	}
+
+	// notify drops the changes silently when notifyCh is full, they're
+	// queued right away to be counted when they're dropped.
+	go func() {
+		for ei := range gpf.notifyCh {
+			select {
+			case gpf.changes <- ei:
+			default:
+				droppedChanges.Inc()
+				atomic.AddInt64(&gpf.dropped, 1)
+				if verbose {
+					log.Printf("Dropped change %s of %s, too many changes.\n", ei.Event(), ei.Path())
+				}
+			}
+		}
+	}()
+	go func() {
+		for ei := range gpf.changes {
+			gpf.onChange(ei)
+		}
+	}()
+	return nil
+}
+
+// Stop stops watching the workspace for changes, and removes the scratch
+// files.
+func (gpf *GoPathFs) Stop() {
+	notify.Stop(gpf.notifyCh)
+	gpf.cleanScratch()
+}
+
+// onChange updates the virtual tree for the change in the workspace.
+func (gpf *GoPathFs) onChange(ei notify.EventInfo) {
+	actual, _ := filepath.Rel(gpf.absWorkspace, ei.Path())
+	if verbose {
+		log.Println("file changed:", actual, ei.Event(), ei.Sys())
+	}
+	t := gpf.begin(trace.Record{Op: "event", Event: eventNames[ei.Event()], Actual: actual})
+	t.done(gpf.change(actual, ei.Event()))
+}
+
+// change updates the virtual tree for the change of the actual file, and
+// notifies the kernel. It returns how the tree was updated, "ignored",
+// "content", "deferred", "track", "untrack", "walk", or "error".
+func (gpf *GoPathFs) change(actual string, event notify.Event) string {
+	vfs.InvalidateAttr(actual)
+	if event != notify.Write {
+		vfs.InvalidateAttr(filepath.Dir(actual))
+	}
+
+	virtual, readonly, rank, st := gpf.mapper.MapRule(actual)
+	if st == mapping.Excluded || st == mapping.Unmatched {
+		if verbose {
+			log.Printf("file %s is excluded or unmatched\n", actual)
+		}
+		return "ignored"
+	}
+
+	var result string
+	switch event {
+	case notify.Write:
+		// Let the kernel drop the cached attrs and content.
+		if in := gpf.inode(virtual); in != nil {
+			in.NotifyContent(0, 0)
+		}
+		return "content"
+	case notify.Create, notify.Rename:
+		if gpf.lazy != nil && !gpf.lazy.Populated(filepath.Dir(virtual)) {
+			// It will be tracked when its directory gets populated.
+			return "deferred"
+		}
+		// Don't follow the symlinks, they are tracked as links.
+		fi, err := os.Lstat(actual)
+		switch {
+		case os.IsNotExist(err) && event == notify.Rename:
+			// The file was moved away, e.g. an editor's backup.
+			gpf.untrack(virtual, actual)
+			result = "untrack"
+		case err != nil:
+			log.Printf("Failed to stat actual file %s, %v\n", actual, err)
+			return "error"
+		case fi.IsDir() && gpf.lazy == nil:
+			scan.Walk(actual, gpf.mapper, gpf.vfs, nil, gpf.dirs)
+			result = "walk"
+		default:
+			gpf.vfs.TrackSource(virtual, vfs.Source{Actual: actual, Readonly: readonly, Priority: rank, Dir: fi.IsDir()})
+			result = "track"
+		}
+	case notify.Remove:
+		if _, err := os.Lstat(actual); err == nil {
+			// The file was created again since, its creation is handled
+			// next.
+			return "ignored"
+		}
+		gpf.untrack(virtual, actual)
+		result = "untrack"
+	}
+	// Let the kernel drop the cached lookup of the file.
+	if in := gpf.inode(filepath.Dir(virtual)); in != nil {
+		in.NotifyEntry(filepath.Base(virtual))
+	}
+	return result
+}
+
+// untrack removes the removed actual file from the sources of the virtual
+// file. If the next source shows through, the kernel drops the cached
+// content of the previous one.
+func (gpf *GoPathFs) untrack(virtual, actual string) {
+	if err := gpf.vfs.UntrackSource(virtual, actual); err != nil {
+		return
+	}
+	if _, remPath := gpf.vfs.MatchPath(virtual); len(remPath) != 0 {
+		gpf.forget(virtual)
+		return
+	}
+	if in := gpf.inode(virtual); in != nil {
+		in.NotifyContent(0, 0)
+	}
+}
@@ -0,0 +1,172 @@
+package gopathfs
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+)
+
+// The xattrs describing where the virtual file comes from. They can't be
+// changed, the other xattrs are the ones of the actual file.
+const (
+	xattrPrefix   = "user.goplz."
+	xattrActual   = xattrPrefix + "actual"
+	xattrRule     = xattrPrefix + "rule"
+	xattrReadonly = xattrPrefix + "readonly"
+)
+
+// GetXAttr gets the xattr of the virtual file.
+func (gpf *GoPathFs) GetXAttr(virtual string, attr string) ([]byte, syscall.Errno) {
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	if len(remPath) != 0 {
+		return nil, syscall.ENOENT
+	}
+	actual := entry.Actual()
+	switch attr {
+	case xattrActual:
+		if actual == "" {
+			return nil, fs.ENOATTR
+		}
+		return []byte(actual), fs.OK
+	case xattrRule:
+		rule := ""
+		if actual != "" {
+			rule = gpf.mapper.Rule(actual)
+		}
+		if rule == "" {
+			return nil, fs.ENOATTR
+		}
+		return []byte(rule), fs.OK
+	case xattrReadonly:
+		return []byte(strconv.FormatBool(entry.Readonly() || actual == "")), fs.OK
+	}
+	if actual == "" || strings.HasPrefix(attr, xattrPrefix) {
+		return nil, fs.ENOATTR
+	}
+	data, err := getxattr(actual, attr)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return data, fs.OK
+}
+
+// ListXAttr lists the xattrs of the virtual file.
+func (gpf *GoPathFs) ListXAttr(virtual string) ([]string, syscall.Errno) {
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	if len(remPath) != 0 {
+		return nil, syscall.ENOENT
+	}
+	actual := entry.Actual()
+	if actual == "" {
+		return []string{xattrReadonly}, fs.OK
+	}
+	attrs := []string{xattrActual}
+	if gpf.mapper.Rule(actual) != "" {
+		attrs = append(attrs, xattrRule)
+	}
+	attrs = append(attrs, xattrReadonly)
+	names, err := listxattr(actual)
+	if err != nil && err != unix.ENOTSUP {
+		return nil, fs.ToErrno(err)
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, xattrPrefix) {
+			attrs = append(attrs, name)
+		}
+	}
+	return attrs, fs.OK
+}
+
+// SetXAttr sets the xattr of the actual file.
+func (gpf *GoPathFs) SetXAttr(virtual string, attr string, data []byte, flags int) syscall.Errno {
+	actual, errno := gpf.xattrActual(virtual, attr)
+	if errno != fs.OK {
+		return errno
+	}
+	if err := unix.Lsetxattr(actual, attr, data, flags); err != nil {
+		return fs.ToErrno(err)
+	}
+	return fs.OK
+}
+
+// RemoveXAttr removes the xattr of the actual file.
+func (gpf *GoPathFs) RemoveXAttr(virtual string, attr string) syscall.Errno {
+	actual, errno := gpf.xattrActual(virtual, attr)
+	if errno != fs.OK {
+		return errno
+	}
+	if err := unix.Lremovexattr(actual, attr); err != nil {
+		return fs.ToErrno(err)
+	}
+	return fs.OK
+}
+
+// xattrActual returns the actual file whose xattr is to be changed.
+func (gpf *GoPathFs) xattrActual(virtual string, attr string) (string, syscall.Errno) {
+	entry, remPath := gpf.vfs.MatchPath(virtual)
+	if len(remPath) != 0 {
+		return "", syscall.ENOENT
+	}
+	if strings.HasPrefix(attr, xattrPrefix) {
+		return "", syscall.EPERM
+	}
+	if entry.Readonly() || entry.Actual() == "" {
+		return "", syscall.EROFS
+	}
+	if errno := gpf.confine(entry.Actual(), false); errno != fs.OK {
+		return "", errno
+	}
+	return entry.Actual(), fs.OK
+}
+
+// getxattr reads the xattr of the file, not following the symlinks.
+func getxattr(path, attr string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, attr, buf)
+		if err == unix.ERANGE {
+			// The xattr grew in between.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+// listxattr lists the xattrs of the file, not following the symlinks.
+func listxattr(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
@@ -6,10 +6,13 @@ import (
 
 	cli "github.com/urfave/cli/v2"
 
+	"github.com/linuxerwang/goplz/commands/check"
 	"github.com/linuxerwang/goplz/commands/debug"
 	initialize "github.com/linuxerwang/goplz/commands/init"
 	"github.com/linuxerwang/goplz/commands/start"
+	"github.com/linuxerwang/goplz/commands/status"
 	"github.com/linuxerwang/goplz/commands/stop"
+	"github.com/linuxerwang/goplz/commands/trace"
 	"github.com/linuxerwang/goplz/commands/version"
 )
 
@@ -25,10 +28,13 @@ func main() {
 			},
 		},
 		Commands: []*cli.Command{
+			check.CheckCmd,
 			debug.DebugCmd,
 			initialize.InitCmd,
 			start.StartCmd,
+			status.StatusCmd,
 			stop.StopCmd,
+			trace.TraceCmd,
 			version.VersionCmd,
 		},
 	}
@@ -0,0 +1,132 @@
+package mapping
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// ruleTrie indexes the source mappings by the path components of their
+// from_actual_dir, so that only the mappings which can match an actual path
+// are evaluated. It is immutable once built, thus safe for concurrent use.
+type ruleTrie struct {
+	rules    []int
+	children map[string]*ruleTrie
+}
+
+func (t *ruleTrie) insert(dir string, idx int) {
+	n := t
+	dir = filepath.Clean(dir)
+	if dir != "." {
+		for _, c := range strings.Split(dir, pathSeparator) {
+			if n.children == nil {
+				n.children = make(map[string]*ruleTrie)
+			}
+			child, ok := n.children[c]
+			if !ok {
+				child = &ruleTrie{}
+				n.children[c] = child
+			}
+			n = child
+		}
+	}
+	n.rules = append(n.rules, idx)
+}
+
+// lookup returns the indices of the mappings whose from_actual_dir contains
+// the actual path, in the order the mappings were inserted.
+func (t *ruleTrie) lookup(actual string) []int {
+	rules := append([]int(nil), t.rules...)
+	n, rest := t, actual
+	for rest != "" && n.children != nil {
+		var c string
+		if i := strings.IndexByte(rest, os.PathSeparator); i >= 0 {
+			c, rest = rest[:i], rest[i+1:]
+		} else {
+			c, rest = rest, ""
+		}
+		if n = n.children[c]; n == nil {
+			break
+		}
+		rules = append(rules, n.rules...)
+	}
+	if len(rules) > 1 {
+		sort.Ints(rules)
+	}
+	return rules
+}
+
+// dirSet matches the paths containing any of the given directories, the same
+// as ContainsDir but without scanning all the directories for each path.
+type dirSet struct {
+	names map[string]bool
+	paths []string
+}
+
+func newDirSet(dirs []string) *dirSet {
+	ds := dirSet{
+		names: make(map[string]bool),
+	}
+	for _, d := range dirs {
+		if strings.Contains(d, pathSeparator) {
+			ds.paths = append(ds.paths, d)
+		} else {
+			ds.names[d] = true
+		}
+	}
+	return &ds
+}
+
+// Contains returns true if path contains any of the directories.
+func (ds *dirSet) Contains(path string) bool {
+	if len(ds.names) > 0 {
+		for rest := path; rest != ""; {
+			var c string
+			if i := strings.IndexByte(rest, os.PathSeparator); i >= 0 {
+				c, rest = rest[:i], rest[i+1:]
+			} else {
+				c, rest = rest, ""
+			}
+			if ds.names[c] {
+				return true
+			}
+		}
+	}
+	for _, p := range ds.paths {
+		if ContainsDir(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// combineRegexps compiles the given regexps into one alternation without
+// capture groups, which rejects the paths matching none of them in a single
+// pass. It returns nil if there are no regexps.
+func combineRegexps(res []*regexp.Regexp) (*regexp.Regexp, error) {
+	if len(res) == 0 {
+		return nil, nil
+	}
+	alts := make([]string, 0, len(res))
+	for _, re := range res {
+		tree, err := syntax.Parse(re.String(), syntax.Perl)
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, "(?:"+stripCaptures(tree).String()+")")
+	}
+	return regexp.Compile(strings.Join(alts, "|"))
+}
+
+func stripCaptures(re *syntax.Regexp) *syntax.Regexp {
+	for i, sub := range re.Sub {
+		re.Sub[i] = stripCaptures(sub)
+	}
+	if re.Op == syntax.OpCapture {
+		return re.Sub[0]
+	}
+	return re
+}
@@ -1,29 +1,51 @@
 package mapping
 
 import (
-	"bytes"
+	"fmt"
 	"log"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 
 	"github.com/linuxerwang/goplz/conf"
 	pb "github.com/linuxerwang/goplz/conf/proto"
 )
 
+// maxCachedRenderings caps the number of template renderings cached per
+// filter, paths with distinct capture groups beyond it are rendered on the
+// fly.
+const maxCachedRenderings = 10000
+
+// rendering is the result of the templates of a filter for a set of capture
+// groups.
+type rendering struct {
+	strip        string
+	toVirtualDir string
+	prepend      string
+}
+
 type sourceFilter struct {
 	cfg          *conf.Config
 	match        *regexp.Regexp
-	toVirtualDir string
-	strip        string
+	toVirtualDir *template.Template
+	strip        *template.Template
 	prepend      *template.Template
 	excludes     []*regexp.Regexp
-	buf          *bytes.Buffer
 	readonly     bool
+
+	// static is the rendering of the templates when none of them refers to
+	// the capture groups, otherwise the renderings are cached by the groups.
+	static     *rendering
+	cache      sync.Map
+	cacheCount int64
 }
 
 func (sf *sourceFilter) Map(from string) (string, bool, MatchStatus) {
-	if !sf.match.MatchString(from) {
+	match := sf.match.FindStringSubmatch(from)
+	if match == nil {
 		return "", false, Unmatched
 	}
 	for _, e := range sf.excludes {
@@ -31,37 +53,117 @@ func (sf *sourceFilter) Map(from string) (string, bool, MatchStatus) {
 			return "", false, Unmatched
 		}
 	}
-	if sf.strip != "" {
-		var err error
-		from, err = filepath.Rel(sf.strip, from)
-		if err != nil {
+	r, err := sf.render(match)
+	if err != nil {
+		log.Print(err)
+		return "", false, Unmatched
+	}
+	if r.strip != "" {
+		from, err = filepath.Rel(r.strip, from)
+		if err != nil || !Confined(from) {
+			// The file is not in the stripped directory, it would be mapped
+			// out of the virtual directory.
 			return "", false, Unmatched
 		}
 	}
-	prepend := ""
-	if sf.prepend != nil {
-		sf.buf.Reset()
-		if err := sf.prepend.Execute(sf.buf, sf.cfg); err != nil {
-			log.Print(err)
-			return "", false, Unmatched
+	virtual := filepath.Join(r.toVirtualDir, r.prepend, from)
+	if virtual == "." {
+		// The root is not mapped.
+		return "", false, Unmatched
+	}
+	return virtual, sf.readonly, Matched
+}
+
+func (sf *sourceFilter) render(match []string) (*rendering, error) {
+	if sf.static != nil {
+		return sf.static, nil
+	}
+	key := strings.Join(match, "\x00")
+	if r, ok := sf.cache.Load(key); ok {
+		return r.(*rendering), nil
+	}
+	r, err := sf.execute(newTemplateData(sf.cfg, sf.match, match))
+	if err != nil {
+		return nil, err
+	}
+	if err := r.validate(); err != nil {
+		return nil, fmt.Errorf("match %q: %v", sf.match, err)
+	}
+	if atomic.AddInt64(&sf.cacheCount, 1) <= maxCachedRenderings {
+		sf.cache.Store(key, r)
+	}
+	return r, nil
+}
+
+func (sf *sourceFilter) execute(data *templateData) (*rendering, error) {
+	var r rendering
+	var err error
+	if r.strip, err = executeTemplate(sf.strip, data); err != nil {
+		return nil, err
+	}
+	if r.toVirtualDir, err = executeTemplate(sf.toVirtualDir, data); err != nil {
+		return nil, err
+	}
+	if r.prepend, err = executeTemplate(sf.prepend, data); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// validate returns an error if the rendered paths could escape the
+// workspace or the virtual root.
+func (r *rendering) validate() error {
+	for _, p := range []struct{ name, path string }{
+		{"strip", r.strip},
+		{"to_virtual_dir", r.toVirtualDir},
+		{"prepend", r.prepend},
+	} {
+		if !Confined(p.path) {
+			return fmt.Errorf("%s %q is absolute or has a \"..\" element", p.name, p.path)
 		}
-		prepend = sf.buf.String()
 	}
-	return filepath.Join(sf.toVirtualDir, prepend, from), sf.readonly, Matched
+	return nil
 }
 
-func newSourceFilter(cfg *conf.Config, f *pb.SourceFilter) *sourceFilter {
+func newSourceFilter(cfg *conf.Config, f *pb.SourceFilter) (*sourceFilter, error) {
+	match, err := regexp.Compile(f.Match)
+	if err != nil {
+		return nil, err
+	}
 	sf := sourceFilter{
-		cfg:          cfg,
-		match:        regexp.MustCompile(f.Match),
-		toVirtualDir: f.ToVirtualDir,
-		strip:        f.Strip,
-		prepend:      template.Must(template.New("prepend").Parse(f.Prepend)),
-		buf:          &bytes.Buffer{},
-		readonly:     f.Readonly,
+		cfg:      cfg,
+		match:    match,
+		readonly: f.Readonly,
+	}
+	if sf.toVirtualDir, err = parseTemplate("to_virtual_dir", f.ToVirtualDir); err != nil {
+		return nil, err
+	}
+	if sf.strip, err = parseTemplate("strip", f.Strip); err != nil {
+		return nil, err
+	}
+	if sf.prepend, err = parseTemplate("prepend", f.Prepend); err != nil {
+		return nil, err
 	}
 	for _, e := range f.ExcludeRegexp {
-		sf.excludes = append(sf.excludes, regexp.MustCompile(e))
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, err
+		}
+		sf.excludes = append(sf.excludes, re)
+	}
+	// Execute the templates with empty capture groups, to catch errors such
+	// as unknown fields or group names, and paths escaping the workspace or
+	// the virtual root, when the config loads. The renderings depending on
+	// the capture groups are checked again when the files are mapped.
+	r, err := sf.execute(newTemplateData(cfg, match, make([]string, match.NumSubexp()+1)))
+	if err != nil {
+		return nil, err
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	if !usesCaptureGroups(sf.toVirtualDir) && !usesCaptureGroups(sf.strip) && !usesCaptureGroups(sf.prepend) {
+		sf.static = r
 	}
-	return &sf
+	return &sf, nil
 }
@@ -0,0 +1,127 @@
+package mapping
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// globRule is an exclusion rule in the .gitignore syntax, with doublestar
+// glob patterns:
+//   - a leading "!" negates the rule, re-including what earlier rules excluded;
+//   - a leading or middle "/" anchors the pattern to the base directory,
+//     otherwise the pattern matches at any depth;
+//   - a trailing "/" makes the rule only match directories.
+type globRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// globRules is an ordered list of glob rules, the last matching rule wins.
+type globRules []*globRule
+
+func parseGlobRule(pattern string) (*globRule, error) {
+	gr := globRule{}
+	if strings.HasPrefix(pattern, "!") {
+		gr.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		gr.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.HasPrefix(pattern, "/") {
+		pattern = strings.TrimLeft(pattern, "/")
+	} else if pattern != "" && !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	if pattern == "" || !doublestar.ValidatePattern(pattern) {
+		return nil, fmt.Errorf("invalid glob pattern %q", pattern)
+	}
+	gr.pattern = filepath.FromSlash(pattern)
+	return &gr, nil
+}
+
+func parseGlobRules(patterns []string) (globRules, error) {
+	var rules globRules
+	for _, p := range patterns {
+		gr, err := parseGlobRule(p)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, gr)
+	}
+	return rules, nil
+}
+
+// match returns whether the rules exclude the path, and whether any rule
+// matched at all. The path is relative to the base directory of the rules.
+func (rs globRules) match(path string, isDir func() bool) (excluded, matched bool) {
+	for i := len(rs) - 1; i >= 0; i-- {
+		gr := rs[i]
+		if ok, _ := doublestar.PathMatch(gr.pattern, path); !ok {
+			continue
+		}
+		if gr.dirOnly && !isDir() {
+			continue
+		}
+		return !gr.negate, true
+	}
+	return false, false
+}
+
+// Excludes returns true if the rules exclude path or any of its parent
+// directories. Both path and base are relative to the workspace.
+func (rs globRules) Excludes(base, path string) bool {
+	if len(rs) == 0 {
+		return false
+	}
+	rel, ok := relPath(base, path)
+	if !ok {
+		return false
+	}
+	for _, p := range pathPrefixes(rel) {
+		isDir := func() bool { return true }
+		if len(p) == len(rel) {
+			isDir = func() bool { return isActualDir(path) }
+		}
+		if excluded, _ := rs.match(p, isDir); excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// relPath returns path relative to base, and false if path is not in base.
+func relPath(base, path string) (string, bool) {
+	if base == "" || base == "." {
+		return path, path != "." && path != ""
+	}
+	if !strings.HasPrefix(path, base+pathSeparator) {
+		return "", false
+	}
+	return path[len(base)+1:], true
+}
+
+// pathPrefixes returns the prefixes of path made of whole components, from
+// the shortest to path itself.
+func pathPrefixes(path string) []string {
+	var prefixes []string
+	for i := 0; i < len(path); i++ {
+		if path[i] == os.PathSeparator {
+			prefixes = append(prefixes, path[:i])
+		}
+	}
+	return append(prefixes, path)
+}
+
+func isActualDir(actual string) bool {
+	fi, err := os.Lstat(actual)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,94 @@
+package mapping
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobRulesMatch(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		path     string
+		dir      bool
+		excluded bool
+		matched  bool
+	}{
+		// Patterns without a slash match at any depth.
+		{[]string{"*.pb.go"}, "a.pb.go", false, true, true},
+		{[]string{"*.pb.go"}, "a/b/c.pb.go", false, true, true},
+		{[]string{"*.pb.go"}, "a/b/c.go", false, false, false},
+		// A leading or middle slash anchors the pattern.
+		{[]string{"/*.pb.go"}, "a.pb.go", false, true, true},
+		{[]string{"/*.pb.go"}, "a/b.pb.go", false, false, false},
+		{[]string{"a/*.go"}, "a/b.go", false, true, true},
+		{[]string{"a/*.go"}, "x/a/b.go", false, false, false},
+		// A leading **/ matches at any depth, including none.
+		{[]string{"**/gen"}, "gen", true, true, true},
+		{[]string{"**/gen"}, "a/b/gen", true, true, true},
+		{[]string{"a/**/gen"}, "a/gen", true, true, true},
+		{[]string{"a/**/gen"}, "a/b/c/gen", true, true, true},
+		{[]string{"a/**/gen"}, "b/a/gen", true, false, false},
+		// A trailing slash only matches directories.
+		{[]string{"gen/"}, "a/gen", true, true, true},
+		{[]string{"gen/"}, "a/gen", false, false, false},
+		{[]string{"/gen/"}, "a/gen", true, false, false},
+		// The last matching rule wins.
+		{[]string{"*.go", "!keep.go"}, "keep.go", false, false, true},
+		{[]string{"*.go", "!keep.go"}, "a.go", false, true, true},
+		{[]string{"!keep.go", "*.go"}, "keep.go", false, true, true},
+		{[]string{"gen/", "!gen"}, "gen", true, false, true},
+		// Escaped leading ! and #.
+		{[]string{`\!bang`}, "!bang", false, true, true},
+		{[]string{`\#hash`}, "a/#hash", false, true, true},
+	} {
+		rules, err := parseGlobRules(tc.patterns)
+		if err != nil {
+			t.Fatalf("parseGlobRules(%q) failed, %v", tc.patterns, err)
+		}
+		isDir := func() bool { return tc.dir }
+		excluded, matched := rules.match(filepath.FromSlash(tc.path), isDir)
+		if excluded != tc.excluded || matched != tc.matched {
+			t.Errorf("%q match %s (dir %v) = %v, %v, want %v, %v",
+				tc.patterns, tc.path, tc.dir, excluded, matched, tc.excluded, tc.matched)
+		}
+	}
+}
+
+func TestParseGlobRuleInvalid(t *testing.T) {
+	for _, pattern := range []string{"!", "/", "//", "a/[b"} {
+		if _, err := parseGlobRule(pattern); err == nil {
+			t.Errorf("parseGlobRule(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestGlobRulesExcludes(t *testing.T) {
+	chdirWorkspace(t, map[string]string{
+		"a/gen/x.go": "",
+		"a/gen.go":   "",
+		"b/c/d.go":   "",
+	})
+	rules, err := parseGlobRules([]string{"gen/", "c", "!d.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{
+		"a/gen":      true,
+		"a/gen/x.go": true,
+		"a/gen.go":   false,
+		// A file can't be re-included if its directory is excluded.
+		"b/c/d.go": true,
+		"b":        false,
+	} {
+		if got := rules.Excludes(".", path); got != want {
+			t.Errorf("Excludes(%s) = %v, want %v", path, got, want)
+		}
+	}
+	// The paths out of the base directory are not excluded.
+	if rules.Excludes("a", "b/c") {
+		t.Error("b/c out of a is excluded by the rules of a")
+	}
+	if !rules.Excludes("b", "b/c/d.go") {
+		t.Error("b/c/d.go is not excluded by the rules of b")
+	}
+}
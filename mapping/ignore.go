@@ -0,0 +1,135 @@
+package mapping
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxCachedIgnoreDirs limits the number of directories whose rules are
+// cached. When reached, the cache is cleared, so that the directories gone
+// since don't stay cached forever.
+const maxCachedIgnoreDirs = 100000
+
+// ignoreFiles honors the .gitignore-like files (e.g. .gitignore, .plzignore)
+// found in the actual directories. The parsed rules are cached per directory.
+type ignoreFiles struct {
+	names []string
+	limit int64
+	rules sync.Map
+	// count is approximate, it's only used to limit the cache size.
+	count int64
+}
+
+func newIgnoreFiles(names []string) *ignoreFiles {
+	return &ignoreFiles{
+		names: names,
+		limit: maxCachedIgnoreDirs,
+	}
+}
+
+// IsIgnoreFile returns true if actual is one of the ignore files.
+func (ig *ignoreFiles) IsIgnoreFile(actual string) bool {
+	base := filepath.Base(actual)
+	for _, n := range ig.names {
+		if base == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Invalidate drops the cached rules of the given directory.
+func (ig *ignoreFiles) Invalidate(dir string) {
+	if _, ok := ig.rules.LoadAndDelete(dir); ok {
+		atomic.AddInt64(&ig.count, -1)
+	}
+}
+
+// Excludes returns true if the ignore files in the parent directories of
+// actual exclude it. Like git, a path can not be re-included if one of its
+// parent directories is excluded.
+func (ig *ignoreFiles) Excludes(actual string) bool {
+	if len(ig.names) == 0 || actual == "." || actual == "" {
+		return false
+	}
+	prefixes := pathPrefixes(actual)
+	for i, p := range prefixes {
+		isDir := func() bool { return true }
+		if i == len(prefixes)-1 {
+			isDir = func() bool { return isActualDir(actual) }
+		}
+		// Rules in deeper directories take precedence.
+		excluded := false
+		for j := i; j >= 0; j-- {
+			dir := "."
+			if j > 0 {
+				dir = prefixes[j-1]
+			}
+			rel, _ := relPath(dir, p)
+			if ex, matched := ig.dirRules(dir).match(rel, isDir); matched {
+				excluded = ex
+				break
+			}
+		}
+		if excluded {
+			return true
+		}
+	}
+	return false
+}
+
+func (ig *ignoreFiles) dirRules(dir string) globRules {
+	if rules, ok := ig.rules.Load(dir); ok {
+		return rules.(globRules)
+	}
+
+	var rules globRules
+	for _, n := range ig.names {
+		rules = append(rules, readIgnoreFile(filepath.Join(dir, n))...)
+	}
+	if atomic.LoadInt64(&ig.count) >= ig.limit {
+		ig.rules.Range(func(dir, _ interface{}) bool {
+			ig.Invalidate(dir.(string))
+			return true
+		})
+	}
+	if _, loaded := ig.rules.LoadOrStore(dir, rules); !loaded {
+		atomic.AddInt64(&ig.count, 1)
+	}
+	return rules
+}
+
+func readIgnoreFile(fn string) globRules {
+	f, err := os.Open(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read ignore file %s, %v.\n", fn, err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	var rules globRules
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " \t")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		gr, err := parseGlobRule(line)
+		if err != nil {
+			log.Printf("Ignored pattern %q in %s, %v.\n", line, fn, err)
+			continue
+		}
+		rules = append(rules, gr)
+	}
+	return rules
+}
@@ -0,0 +1,127 @@
+package mapping
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chdirWorkspace creates a workspace with the files of the given contents,
+// and changes into it.
+func chdirWorkspace(t *testing.T, files map[string]string) {
+	ws := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for fn, content := range files {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIgnoreFilesExcludes(t *testing.T) {
+	chdirWorkspace(t, map[string]string{
+		".gitignore":       "# Logs.\n*.log\n!keep.log\n/build/\n",
+		".plzignore":       "*.tmp\n",
+		"x.log":            "",
+		"keep.log":         "",
+		"x.tmp":            "",
+		"build/out.go":     "",
+		"build/.gitignore": "!out.go\n",
+		"a/.gitignore":     "!*.log\nsub/\n/local.go\n",
+		"a/y.log":          "",
+		"a/build/out.go":   "",
+		"a/sub/z.go":       "",
+		"a/b/sub":          "",
+		"a/local.go":       "",
+		"a/b/local.go":     "",
+		"c/z.log":          "",
+	})
+	ig := newIgnoreFiles([]string{".gitignore", ".plzignore"})
+	for path, want := range map[string]bool{
+		"x.log":    true,
+		"keep.log": false,
+		"x.tmp":    true,
+		"build":    true,
+		// A file can't be re-included if its directory is excluded.
+		"build/out.go": true,
+		// The anchored pattern only matches in the directory of its file.
+		"a/build/out.go": false,
+		// The nested ignore file overrides its parents.
+		"a/y.log": false,
+		"c/z.log": true,
+		// The directory-only pattern doesn't match files.
+		"a/sub":        true,
+		"a/sub/z.go":   true,
+		"a/b/sub":      false,
+		"a/local.go":   true,
+		"a/b/local.go": false,
+		".gitignore":   false,
+	} {
+		if got := ig.Excludes(filepath.FromSlash(path)); got != want {
+			t.Errorf("Excludes(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestIgnoreFilesInvalidate(t *testing.T) {
+	chdirWorkspace(t, map[string]string{
+		"a/.gitignore": "*.log\n",
+		"a/x.log":      "",
+	})
+	ig := newIgnoreFiles([]string{".gitignore"})
+	if !ig.Excludes("a/x.log") {
+		t.Fatal("a/x.log is not excluded")
+	}
+
+	if err := ioutil.WriteFile("a/.gitignore", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !ig.Excludes("a/x.log") {
+		t.Error("a/x.log is not excluded by the cached rules")
+	}
+	ig.Invalidate("a")
+	if ig.Excludes("a/x.log") {
+		t.Error("a/x.log is excluded after the rules were invalidated")
+	}
+}
+
+func TestIgnoreFilesLimit(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("d%d/.gitignore", i)] = "*.log\n"
+	}
+	chdirWorkspace(t, files)
+	ig := newIgnoreFiles([]string{".gitignore"})
+	ig.limit = 4
+
+	for i := 0; i < 10; i++ {
+		fn := fmt.Sprintf("d%d/x.log", i)
+		if !ig.Excludes(fn) {
+			t.Errorf("%s is not excluded", fn)
+		}
+		if ig.count > ig.limit {
+			t.Fatalf("%d directories cached, over the limit %d", ig.count, ig.limit)
+		}
+	}
+	n := int64(0)
+	ig.rules.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	if n != ig.count {
+		t.Errorf("%d directories cached, counted %d", n, ig.count)
+	}
+}
@@ -1,7 +1,10 @@
 package mapping
 
 import (
-	"sync"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
 
 	"github.com/linuxerwang/goplz/conf"
 	pb "github.com/linuxerwang/goplz/conf/proto"
@@ -15,36 +18,192 @@ const (
 
 type MatchStatus int
 
+func init() {
+	conf.RegisterInitializer(func(cfg *conf.Config) {
+		if err := Validate(cfg); err != nil {
+			log.Fatalf("Invalid source mapping in %s, %v.\n", cfg.GoplzConf, err)
+		}
+	})
+}
+
 // SourceMapper is an interface for source code mapping.
 type SourceMapper interface {
 	// Map returns the virtual file mapped to the given actual file. It returns
 	// true if the mapping is valid according the predefined mapping rules. It
 	// also returns the match status.
 	Map(actual string) (string, bool, MatchStatus)
+
+	// MapRule is Map also returning the rank of the rule mapping the actual
+	// file, 0 being the rule with the highest priority. The actual files
+	// mapped to the same virtual file are ordered by the ranks of their
+	// rules. The rank is -1 if no rule maps the file.
+	MapRule(actual string) (virtual string, readonly bool, rank int, st MatchStatus)
+
+	// ConflictPolicy returns the conflict policy of the rule of the rank
+	// returned by MapRule, or PRIORITY if there is no such rule.
+	ConflictPolicy(rank int) pb.ConflictPolicy
+
+	// Prefixes returns the virtual directories the rules map files into,
+	// with the actual directories the files are taken from, in the order of
+	// the rules. Rules whose templates depend on the capture groups can't be
+	// reversed this way and are left out.
+	Prefixes() []Prefix
+
+	// EagerDirs returns the actual directories of the rules which are left
+	// out by Prefixes, they have to be scanned eagerly.
+	EagerDirs() []string
+
+	// Excludes returns true if the rule of the prefix excludes the actual
+	// directory.
+	Excludes(p Prefix, actual string) bool
+
+	// Rule describes the rule mapping the actual file, e.g.
+	// `source_mapping[0].filter[1] (from_actual_dir "a", match "b")`, or
+	// returns an empty string if no rule maps it.
+	Rule(actual string) string
+
+	// RankedRule returns the name of the rule of the rank returned by
+	// MapRule, e.g. "source_mapping[0]", and its from_actual_dir. It
+	// returns empty strings if there is no such rule.
+	RankedRule(rank int) (rule, root string)
+
+	// Root returns the from_actual_dir of the rule mapping the actual file.
+	// The files no rule maps belong to the rule with the deepest directory
+	// containing them.
+	Root(actual string) string
+
+	// IgnoreFiles returns the names of the ignore files honored in the
+	// actual directories, e.g. ".gitignore".
+	IgnoreFiles() []string
 }
 
+// Prefix is the virtual directory a rule maps its files into, along with the
+// actual directory stripped from them, i.e. the actual file Actual/a/b can
+// only be mapped into Virtual/a/b by the rule.
+type Prefix struct {
+	Virtual string
+	Actual  string
+	// Scope is the actual directory the rule is restricted to.
+	Scope string
+
+	mapping int
+}
+
+// sourceMapper evaluates the compiled mapping rules. The rules are immutable
+// once compiled and the caches are lock-free, so Map can be called
+// concurrently.
 type sourceMapper struct {
-	excludes   []string
-	mappings   []*sourceMapping
-	mappingsMu sync.Mutex
+	excludes     *dirSet
+	excludeGlobs globRules
+	ignoreFiles  *ignoreFiles
+	mappings     []*sourceMapping
+	trie         ruleTrie
+	prefixes     []Prefix
+	eagerDirs    []string
+	// ranks are the ranks of the mappings by their priorities.
+	ranks []int
+	// policies are the conflict policies by the ranks.
+	policies []pb.ConflictPolicy
 }
 
 func (sm *sourceMapper) Map(actual string) (string, bool, MatchStatus) {
-	for _, e := range sm.excludes {
-		if ContainsDir(actual, e) {
-			return "", false, Excluded
+	virtual, readonly, _, st := sm.MapRule(actual)
+	return virtual, readonly, st
+}
+
+func (sm *sourceMapper) MapRule(actual string) (string, bool, int, MatchStatus) {
+	if sm.ignoreFiles.IsIgnoreFile(actual) {
+		// The ignore file might have changed, reload it when needed.
+		sm.ignoreFiles.Invalidate(filepath.Dir(actual))
+	}
+	if sm.excluded(actual) {
+		return "", false, -1, Excluded
+	}
+
+	for _, idx := range sm.trie.lookup(actual) {
+		if virtual, readonly, st := sm.mappings[idx].Map(actual); virtual != "" {
+			return virtual, readonly, sm.ranks[idx], st
+		}
+	}
+	return "", false, -1, Unmatched
+}
+
+func (sm *sourceMapper) ConflictPolicy(rank int) pb.ConflictPolicy {
+	if rank < 0 || rank >= len(sm.policies) {
+		return pb.ConflictPolicy_PRIORITY
+	}
+	return sm.policies[rank]
+}
+
+// excluded returns true if the actual file is excluded regardless of the
+// rules.
+func (sm *sourceMapper) excluded(actual string) bool {
+	return sm.excludes.Contains(actual) ||
+		sm.excludeGlobs.Excludes("", actual) ||
+		sm.ignoreFiles.Excludes(actual)
+}
+
+func (sm *sourceMapper) Prefixes() []Prefix {
+	return sm.prefixes
+}
+
+func (sm *sourceMapper) EagerDirs() []string {
+	return sm.eagerDirs
+}
+
+func (sm *sourceMapper) Excludes(p Prefix, actual string) bool {
+	m := sm.mappings[p.mapping]
+	return m.excludes.Contains(actual) || m.excludeGlobs.Excludes(m.actualDir, actual)
+}
+
+func (sm *sourceMapper) IgnoreFiles() []string {
+	return sm.ignoreFiles.names
+}
+
+func (sm *sourceMapper) Root(actual string) string {
+	rules := sm.trie.lookup(actual)
+	for _, idx := range rules {
+		if virtual, _, _ := sm.mappings[idx].Map(actual); virtual != "" {
+			return filepath.Clean(sm.mappings[idx].actualDir)
+		}
+	}
+	root := "."
+	for _, idx := range rules {
+		if dir := filepath.Clean(sm.mappings[idx].actualDir); len(dir) > len(root) || root == "." {
+			root = dir
+		}
+	}
+	return root
+}
+
+func (sm *sourceMapper) RankedRule(rank int) (string, string) {
+	for idx, r := range sm.ranks {
+		if r == rank {
+			return sm.ruleName(idx), filepath.Clean(sm.mappings[idx].actualDir)
 		}
 	}
+	return "", ""
+}
 
-	sm.mappingsMu.Lock()
-	defer sm.mappingsMu.Unlock()
+// ruleName returns the name of the mapping in the config.
+func (sm *sourceMapper) ruleName(idx int) string {
+	if idx == len(sm.mappings)-1 {
+		return "default"
+	}
+	return fmt.Sprintf("source_mapping[%d]", idx)
+}
 
-	for _, mapping := range sm.mappings {
-		if virtual, readonly, st := mapping.Map(actual); virtual != "" {
-			return virtual, readonly, st
+func (sm *sourceMapper) Rule(actual string) string {
+	if sm.excluded(actual) {
+		return ""
+	}
+	for _, idx := range sm.trie.lookup(actual) {
+		m := sm.mappings[idx]
+		if f := m.filter(actual); f >= 0 {
+			return fmt.Sprintf("%s.filter[%d] (from_actual_dir %q, match %q)", sm.ruleName(idx), f, m.actualDir, m.filters[f].match)
 		}
 	}
-	return "", false, Unmatched
+	return ""
 }
 
 // Make sure sourceMapper implements SourceMapper.
@@ -52,15 +211,91 @@ var _ = (SourceMapper)(&sourceMapper{})
 
 // New creates and returns a new SourceMapping.
 func New(cfg *conf.Config) SourceMapper {
+	smapper, err := newSourceMapper(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create source mapper, %v.\n", err)
+	}
+	return smapper
+}
+
+// Validate returns an error if the mapping rules in the config are invalid,
+// e.g. malformed regexps or templates referring to unknown fields or capture
+// groups.
+func Validate(cfg *conf.Config) error {
+	_, err := newSourceMapper(cfg)
+	return err
+}
+
+func newSourceMapper(cfg *conf.Config) (*sourceMapper, error) {
+	excludes := cfg.Settings.Exclude
+	if cfg.Settings.HonorPlzBlacklistDirs {
+		excludes = append(append([]string(nil), excludes...), cfg.PlzBlacklistDirs...)
+	}
 	smapper := sourceMapper{
-		excludes: cfg.Settings.Exclude,
+		excludes:    newDirSet(excludes),
+		ignoreFiles: newIgnoreFiles(cfg.Settings.IgnoreFile),
+	}
+	var err error
+	if smapper.excludeGlobs, err = parseGlobRules(cfg.Settings.ExcludeGlob); err != nil {
+		return nil, fmt.Errorf("exclude_glob: %v", err)
 	}
-	for _, sm := range cfg.Settings.SourceMapping {
-		smapper.mappings = append(smapper.mappings, newSourceMapping(cfg, sm))
+	for i, sm := range cfg.Settings.SourceMapping {
+		smapping, err := newSourceMapping(cfg, sm)
+		if err != nil {
+			return nil, fmt.Errorf("source_mapping[%d]: %v", i, err)
+		}
+		smapper.mappings = append(smapper.mappings, smapping)
 	}
 	// Default mapping must be at the last.
-	smapper.mappings = append(smapper.mappings, newSourceMapping(cfg, defaultMapping()))
-	return &smapper
+	smapping, err := newSourceMapping(cfg, defaultMapping())
+	if err != nil {
+		return nil, err
+	}
+	smapper.mappings = append(smapper.mappings, smapping)
+	smapper.ranks = rankMappings(smapper.mappings)
+	smapper.policies = make([]pb.ConflictPolicy, len(smapper.mappings))
+	for i, rank := range smapper.ranks {
+		smapper.policies[rank] = smapper.mappings[i].policy
+	}
+
+	eagerDirs := make(map[string]bool)
+	for i, sm := range smapper.mappings {
+		smapper.trie.insert(sm.actualDir, i)
+		scope := filepath.Clean(sm.actualDir)
+		for _, f := range sm.filters {
+			if f.static == nil {
+				if !eagerDirs[scope] {
+					eagerDirs[scope] = true
+					smapper.eagerDirs = append(smapper.eagerDirs, scope)
+				}
+				continue
+			}
+			smapper.prefixes = append(smapper.prefixes, Prefix{
+				Virtual: filepath.Join(f.static.toVirtualDir, f.static.prepend),
+				Actual:  filepath.Clean(f.static.strip),
+				Scope:   scope,
+				mapping: i,
+			})
+		}
+	}
+	return &smapper, nil
+}
+
+// rankMappings ranks the mappings by their priorities, the highest first,
+// keeping the order of the mappings with the same priority.
+func rankMappings(mappings []*sourceMapping) []int {
+	order := make([]int, len(mappings))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return mappings[order[i]].priority > mappings[order[j]].priority
+	})
+	ranks := make([]int, len(mappings))
+	for rank, idx := range order {
+		ranks[idx] = rank
+	}
+	return ranks
 }
 
 func defaultMapping() *pb.SourceMapping {
@@ -0,0 +1,101 @@
+package mapping
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/linuxerwang/goplz/conf"
+	pb "github.com/linuxerwang/goplz/conf/proto"
+)
+
+// benchConfig returns a config with a static rule for the generated protos
+// and a rule depending on the capture groups, besides the default mapping.
+func benchConfig() *conf.Config {
+	return &conf.Config{
+		GoImportPath: "example.com/ws",
+		Settings: &pb.Settings{
+			Exclude: []string{".git"},
+			SourceMapping: []*pb.SourceMapping{
+				{
+					FromActualDir: "plz-out/gen",
+					Filter: []*pb.SourceFilter{{
+						Match:        `.*\.pb\.go$`,
+						ToVirtualDir: "src",
+						Strip:        "plz-out/gen",
+						Prepend:      "{{.GoImportPath}}",
+						Readonly:     true,
+					}},
+				},
+				{
+					FromActualDir: "third_party",
+					Filter: []*pb.SourceFilter{{
+						Match:        `^third_party/(?P<repo>[^/]+)/`,
+						ToVirtualDir: "src",
+						Strip:        "third_party/{{.Group.repo}}",
+						Prepend:      "{{.Group.repo}}",
+					}},
+				},
+			},
+		},
+	}
+}
+
+// benchPaths returns n actual paths spread over the rules like a large
+// workspace, most of them mapped by the default mapping.
+func benchPaths(n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		pkg := fmt.Sprintf("pkg%d/sub%d", i/1000, i/100%10)
+		switch i % 10 {
+		case 0:
+			paths[i] = fmt.Sprintf("plz-out/gen/%s/f%d.pb.go", pkg, i)
+		case 1:
+			paths[i] = fmt.Sprintf("third_party/repo%d/%s/f%d.go", i%50, pkg, i)
+		default:
+			paths[i] = fmt.Sprintf("%s/f%d.go", pkg, i)
+		}
+	}
+	return paths
+}
+
+// BenchmarkNewMapper measures compiling the rules.
+func BenchmarkNewMapper(b *testing.B) {
+	cfg := benchConfig()
+	for i := 0; i < b.N; i++ {
+		if _, err := newSourceMapper(cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMapRule measures mapping the paths of a workspace of about 1M
+// files, as the startup scan does.
+func BenchmarkMapRule(b *testing.B) {
+	sm, err := newSourceMapper(benchConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	paths := benchPaths(1 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm.MapRule(paths[i%len(paths)])
+	}
+}
+
+// BenchmarkMapRuleParallel is BenchmarkMapRule with the concurrency of the
+// scan workers.
+func BenchmarkMapRuleParallel(b *testing.B) {
+	sm, err := newSourceMapper(benchConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	paths := benchPaths(1 << 20)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			sm.MapRule(paths[i%len(paths)])
+			i++
+		}
+	})
+}
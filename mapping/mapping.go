@@ -1,25 +1,33 @@
 package mapping
 
 import (
-	"path/filepath"
+	"fmt"
+	"regexp"
 
 	"github.com/linuxerwang/goplz/conf"
 	pb "github.com/linuxerwang/goplz/conf/proto"
 )
 
 type sourceMapping struct {
-	actualDir string
-	excludes  []string
-	filters   []*sourceFilter
+	actualDir    string
+	priority     int32
+	policy       pb.ConflictPolicy
+	excludes     *dirSet
+	excludeGlobs globRules
+	filters      []*sourceFilter
+	// match matches the paths matched by any of the filters.
+	match *regexp.Regexp
 }
 
+// Map maps the actual file, which has to be in the actualDir of the mapping.
 func (sm *sourceMapping) Map(actual string) (string, bool, MatchStatus) {
-	for _, e := range sm.excludes {
-		if ContainsDir(actual, e) {
-			return "", false, Excluded
-		}
+	if sm.excludes.Contains(actual) {
+		return "", false, Excluded
+	}
+	if sm.excludeGlobs.Excludes(sm.actualDir, actual) {
+		return "", false, Excluded
 	}
-	if !filepath.HasPrefix(actual, sm.actualDir) {
+	if sm.match == nil || !sm.match.MatchString(actual) {
 		return "", false, Unmatched
 	}
 	for _, f := range sm.filters {
@@ -30,15 +38,49 @@ func (sm *sourceMapping) Map(actual string) (string, bool, MatchStatus) {
 	return "", false, Unmatched
 }
 
-func newSourceMapping(cfg *conf.Config, sm *pb.SourceMapping) *sourceMapping {
+// filter returns the index of the filter mapping the actual file, or -1 if
+// the mapping doesn't map it.
+func (sm *sourceMapping) filter(actual string) int {
+	if sm.excludes.Contains(actual) || sm.excludeGlobs.Excludes(sm.actualDir, actual) {
+		return -1
+	}
+	if sm.match == nil || !sm.match.MatchString(actual) {
+		return -1
+	}
+	for i, f := range sm.filters {
+		if virtual, _, _ := f.Map(actual); virtual != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+func newSourceMapping(cfg *conf.Config, sm *pb.SourceMapping) (*sourceMapping, error) {
+	// The actual paths are relative to the workspace.
+	if !Confined(sm.FromActualDir) {
+		return nil, fmt.Errorf("from_actual_dir %q is absolute or has a \"..\" element", sm.FromActualDir)
+	}
 	smapping := sourceMapping{
 		actualDir: sm.FromActualDir,
+		priority:  sm.Priority,
+		policy:    sm.ConflictPolicy,
+		excludes:  newDirSet(sm.Exclude),
+	}
+	var matches []*regexp.Regexp
+	for i, f := range sm.Filter {
+		sf, err := newSourceFilter(cfg, f)
+		if err != nil {
+			return nil, fmt.Errorf("filter[%d]: %v", i, err)
+		}
+		smapping.filters = append(smapping.filters, sf)
+		matches = append(matches, sf.match)
 	}
-	for _, f := range sm.Filter {
-		smapping.filters = append(smapping.filters, newSourceFilter(cfg, f))
+	var err error
+	if smapping.match, err = combineRegexps(matches); err != nil {
+		return nil, err
 	}
-	for _, e := range sm.Exclude {
-		smapping.excludes = append(smapping.excludes, e)
+	if smapping.excludeGlobs, err = parseGlobRules(sm.ExcludeGlob); err != nil {
+		return nil, fmt.Errorf("exclude_glob: %v", err)
 	}
-	return &smapping
+	return &smapping, nil
 }
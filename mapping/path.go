@@ -1,8 +1,10 @@
 package mapping
 
-import "strings"
-
-import "os"
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
 
 const pathSeparator = string(os.PathSeparator)
 
@@ -22,3 +24,17 @@ func ContainsDir(path, dir string) bool {
 	}
 	return false
 }
+
+// Confined returns true if the path is relative and has no ".." element, so
+// that it stays in the directory it's relative to, whatever the directory.
+func Confined(path string) bool {
+	if filepath.IsAbs(path) {
+		return false
+	}
+	for _, e := range strings.Split(filepath.ToSlash(path), "/") {
+		if e == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package mapping
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfined(t *testing.T) {
+	for path, want := range map[string]bool{
+		"":          true,
+		".":         true,
+		"a/b.go":    true,
+		"a/./b":     true,
+		"a//b":      true,
+		"...":       true,
+		"a/..b":     true,
+		"..":        false,
+		"../a":      false,
+		"a/../b":    false,
+		"a/../../b": false,
+		"a/..":      false,
+		"/a":        false,
+		"/":         false,
+	} {
+		if got := Confined(path); got != want {
+			t.Errorf("Confined(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func FuzzConfined(f *testing.F) {
+	for _, path := range []string{"a/b.go", "../a", "a/../../b", "a/..", "/etc/passwd", "a//..//b", "...", "./..", "a/./../.."} {
+		f.Add(path)
+	}
+	const root = "/ws/root"
+	f.Fuzz(func(t *testing.T, path string) {
+		if !Confined(path) {
+			return
+		}
+		if filepath.IsAbs(path) {
+			t.Fatalf("absolute path %q is confined", path)
+		}
+		joined := filepath.Join(root, path)
+		if joined != root && !strings.HasPrefix(joined, root+pathSeparator) {
+			t.Fatalf("confined path %q escapes %s to %s", path, root, joined)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package mapping
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/linuxerwang/goplz/conf"
+)
+
+// templateFuncs are the helper functions available in mapping templates.
+var templateFuncs = template.FuncMap{
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	"trimPrefix": func(prefix, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	},
+	"trimSuffix": func(suffix, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	},
+	"dir":   filepath.Dir,
+	"base":  filepath.Base,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"env":   os.Getenv,
+}
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+// templateData is the data the mapping templates are executed with. Besides
+// the fields of conf.Config (e.g. {{.GoImportPath}}, {{.WorkspaceName}}), a
+// template can refer to the capture groups of the filter's match regexp.
+type templateData struct {
+	*conf.Config
+
+	// Match holds the numbered capture groups, {{index .Match 0}} is the
+	// whole match.
+	Match []string
+	// Group holds the named capture groups, e.g. {{.Group.name}}.
+	Group map[string]string
+}
+
+func newTemplateData(cfg *conf.Config, re *regexp.Regexp, match []string) *templateData {
+	data := templateData{
+		Config: cfg,
+		Match:  match,
+		Group:  make(map[string]string),
+	}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			data.Group[name] = match[i]
+		}
+	}
+	return &data
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// usesCaptureGroups returns true if the template might refer to the capture
+// groups, whose rendering then depends on the matched path. Besides the Match
+// and Group fields, the whole data reached by {{.}} or {{$}}, e.g. to be
+// bound to a variable or passed to a function, counts as referring to them.
+func usesCaptureGroups(t *template.Template) bool {
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil && nodeUsesCaptureGroups(tmpl.Tree.Root) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeUsesCaptureGroups(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if nodeUsesCaptureGroups(c) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesCaptureGroups(n.Pipe)
+	case *parse.TemplateNode:
+		return nodeUsesCaptureGroups(n.Pipe)
+	case *parse.IfNode:
+		return branchUsesCaptureGroups(&n.BranchNode)
+	case *parse.RangeNode:
+		return branchUsesCaptureGroups(&n.BranchNode)
+	case *parse.WithNode:
+		return branchUsesCaptureGroups(&n.BranchNode)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if nodeUsesCaptureGroups(c) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesCaptureGroups(arg) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return nodeUsesCaptureGroups(n.Node) || capturesField(n.Field)
+	case *parse.FieldNode:
+		return capturesField(n.Ident)
+	case *parse.VariableNode:
+		// $ alone is the whole data, $.Match a field of it and $x.Match a
+		// field of whatever $x is.
+		return len(n.Ident) == 1 && n.Ident[0] == "$" || capturesField(n.Ident[1:])
+	case *parse.DotNode:
+		return true
+	}
+	return false
+}
+
+func branchUsesCaptureGroups(n *parse.BranchNode) bool {
+	return nodeUsesCaptureGroups(n.Pipe) || nodeUsesCaptureGroups(n.List) || nodeUsesCaptureGroups(n.ElseList)
+}
+
+func capturesField(idents []string) bool {
+	for _, ident := range idents {
+		if ident == "Match" || ident == "Group" {
+			return true
+		}
+	}
+	return false
+}
+
+func executeTemplate(t *template.Template, data *templateData) (string, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+
+	buf.Reset()
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,65 @@
+package mapping
+
+import (
+	"testing"
+
+	"github.com/linuxerwang/goplz/conf"
+	pb "github.com/linuxerwang/goplz/conf/proto"
+)
+
+func TestUsesCaptureGroups(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want bool
+	}{
+		{"", false},
+		{"src", false},
+		{"{{.GoImportPath}}", false},
+		{"{{.GoImportPath | lower}}", false},
+		{"{{$p := .GoImportPath}}{{$p}}", false},
+		{"{{with .WorkspaceName}}x{{end}}", false},
+		{"{{index .Match 1}}", true},
+		{"{{.Group.name}}", true},
+		{"{{$.Group.name}}", true},
+		{"{{with .}}{{index .Match 1}}{{end}}", true},
+		{"{{$x := .}}{{index $x.Match 1}}", true},
+		{"{{$x := $}}{{$x}}", true},
+		{"{{printf \"%v\" .}}", true},
+		{"{{with .GoImportPath}}{{.}}{{end}}", true},
+		{"{{if .GoImportPath}}a{{else}}{{.Group.name}}{{end}}", true},
+		{"{{range $i, $m := .Match}}{{$m}}{{end}}", true},
+		{"{{define \"x\"}}{{index .Match 1}}{{end}}{{template \"x\" .}}", true},
+	} {
+		tmpl, err := parseTemplate("test", tc.text)
+		if err != nil {
+			t.Fatalf("parseTemplate(%q): %v", tc.text, err)
+		}
+		if got := usesCaptureGroups(tmpl); got != tc.want {
+			t.Errorf("usesCaptureGroups(%q) = %v, want %v", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestRenderingNotCachedWithCaptureGroups(t *testing.T) {
+	cfg := &conf.Config{GoImportPath: "example.com/ws"}
+	sf, err := newSourceFilter(cfg, &pb.SourceFilter{
+		Match:        `^gen/(\w+)/`,
+		ToVirtualDir: "src",
+		Prepend:      "{{with .}}{{index .Match 1}}{{end}}",
+		Strip:        "gen",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.static != nil {
+		t.Fatal("rendering is static, want it to depend on the capture groups")
+	}
+	for actual, want := range map[string]string{
+		"gen/a/x.go": "src/a/a/x.go",
+		"gen/b/y.go": "src/b/b/y.go",
+	} {
+		if got, _, _ := sf.Map(actual); got != want {
+			t.Errorf("Map(%q) = %q, want %q", actual, got, want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]metric{}
+
+	// escaper escapes the label values.
+	escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// metric is a registered metric, written in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(name string, m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	registry[name] = m
+}
+
+// desc describes a metric and its labels.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// key returns the key of the label values, it panics if their number
+// doesn't match the labels.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the labels with their values, and the le label of a
+// histogram bucket if not empty, e.g. `{op="open",le="0.1"}`.
+func (d *desc) labelPairs(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, d.labels[i]+`="`+escaper.Replace(v)+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a counter partitioned by its labels.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	v      float64
+}
+
+// NewCounter creates and registers a counter with the labels.
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: map[string]*counterValue{},
+	}
+	if len(labels) == 0 {
+		// Show the counter before it's first incremented.
+		c.values[""] = &counterValue{}
+	}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter of the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter of the label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: append([]string(nil), values...)}
+		c.values[key] = cv
+	}
+	cv.v += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cv := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(cv.labels, ""), formatFloat(cv.v))
+	}
+}
+
+// HistogramVec is a histogram partitioned by its labels.
+type HistogramVec struct {
+	desc
+	// buckets are the upper bounds of the buckets, in increasing order.
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates and registers a histogram with the buckets and the
+// labels. The buckets are the upper bounds in increasing order, the +Inf
+// bucket is added.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+	register(name, h)
+	return h
+}
+
+// Observe adds the value to the histogram of the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := h.key(values)
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{
+			labels: append([]string(nil), values...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hv
+	}
+	if i < len(hv.counts) {
+		hv.counts[i]++
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// ObserveDuration adds the duration in seconds to the histogram of the
+// label values.
+func (h *HistogramVec) ObserveDuration(d time.Duration, values ...string) {
+	h.Observe(d.Seconds(), values...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(hv.labels, formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(hv.labels, "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(hv.labels, ""), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(hv.labels, ""), hv.count)
+	}
+}
+
+// gaugeFunc is a gauge collected when the metrics are written.
+type gaugeFunc struct {
+	desc
+	fn func(set func(v float64, values ...string))
+}
+
+// RegisterGauge registers a gauge with the labels, fn is called every time
+// the metrics are written, and calls set with the value of each of the
+// label values.
+func RegisterGauge(name, help string, labels []string, fn func(set func(v float64, values ...string))) {
+	register(name, &gaugeFunc{
+		desc: desc{name: name, help: help, typ: "gauge", labels: labels},
+		fn:   fn,
+	})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	var values []*counterValue
+	g.fn(func(v float64, labels ...string) {
+		// Check the number of the label values.
+		g.key(labels)
+		values = append(values, &counterValue{labels: labels, v: v})
+	})
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labels, "\xff") < strings.Join(values[j].labels, "\xff")
+	})
+	g.header(w)
+	for _, gv := range values {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelPairs(gv.labels, ""), formatFloat(gv.v))
+	}
+}
+
+// Write writes the registered metrics in the Prometheus text format.
+func Write(w io.Writer) {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ms := make([]metric, len(names))
+	for i, name := range names {
+		ms[i] = registry[name]
+	}
+	registryMu.Unlock()
+
+	for _, m := range ms {
+		m.write(w)
+	}
+}
+
+// Handler returns the HTTP handler serving the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
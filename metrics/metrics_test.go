@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// output returns the metric written in the text format.
+func output(m metric) string {
+	var buf bytes.Buffer
+	m.write(&buf)
+	return buf.String()
+}
+
+func expectPanic(t *testing.T, what string, fn func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s didn't panic", what)
+		}
+	}()
+	fn()
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_histogram_seconds", "A\nhistogram.", []float64{1, 2, 5}, "op")
+	for _, v := range []float64{0.5, 1, 2, 3, 10} {
+		h.Observe(v, "open")
+	}
+	h.Observe(1.5, "read")
+
+	// The buckets are cumulative and their upper bounds are inclusive,
+	// the +Inf bucket counts every observation.
+	want := `# HELP test_histogram_seconds A histogram.
+# TYPE test_histogram_seconds histogram
+test_histogram_seconds_bucket{op="open",le="1"} 2
+test_histogram_seconds_bucket{op="open",le="2"} 3
+test_histogram_seconds_bucket{op="open",le="5"} 4
+test_histogram_seconds_bucket{op="open",le="+Inf"} 5
+test_histogram_seconds_sum{op="open"} 16.5
+test_histogram_seconds_count{op="open"} 5
+test_histogram_seconds_bucket{op="read",le="1"} 0
+test_histogram_seconds_bucket{op="read",le="2"} 1
+test_histogram_seconds_bucket{op="read",le="5"} 1
+test_histogram_seconds_bucket{op="read",le="+Inf"} 1
+test_histogram_seconds_sum{op="read"} 1.5
+test_histogram_seconds_count{op="read"} 1
+`
+	if got := output(h); got != want {
+		t.Errorf("histogram is\n%s\nwant\n%s", got, want)
+	}
+	expectPanic(t, "observing without the label", func() { h.Observe(1) })
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter.", "path")
+	c.Inc(`a"b\c` + "\nd")
+	c.Add(2, "a")
+	c.Inc("a")
+
+	want := `# HELP test_counter_total A counter.
+# TYPE test_counter_total counter
+test_counter_total{path="a"} 3
+test_counter_total{path="a\"b\\c\nd"} 1
+`
+	if got := output(c); got != want {
+		t.Errorf("counter is\n%s\nwant\n%s", got, want)
+	}
+	expectPanic(t, "incrementing with too many labels", func() { c.Inc("a", "b") })
+
+	// A counter without labels shows before it's incremented.
+	c = NewCounter("test_unlabeled_total", "An unlabeled counter.")
+	if got := output(c); !strings.HasSuffix(got, "\ntest_unlabeled_total 0\n") {
+		t.Errorf("unlabeled counter is\n%s", got)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	labels := [][]string{{"b"}, {"a"}}
+	RegisterGauge("test_gauge", "A gauge.", []string{"rank"}, func(set func(v float64, values ...string)) {
+		for i, values := range labels {
+			set(float64(i)+0.5, values...)
+		}
+	})
+	registryMu.Lock()
+	g := registry["test_gauge"]
+	registryMu.Unlock()
+
+	want := `# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge{rank="a"} 1.5
+test_gauge{rank="b"} 0.5
+`
+	if got := output(g); got != want {
+		t.Errorf("gauge is\n%s\nwant\n%s", got, want)
+	}
+
+	labels = [][]string{{"a", "b"}}
+	expectPanic(t, "setting a gauge with too many labels", func() { output(g) })
+	labels = [][]string{{}}
+	expectPanic(t, "setting a gauge without the label", func() { output(g) })
+}
+
+func TestRegisterTwice(t *testing.T) {
+	NewCounter("test_twice_total", "A counter.")
+	expectPanic(t, "registering a metric twice", func() {
+		NewHistogram("test_twice_total", "A histogram.", []float64{1})
+	})
+}
+
+func TestCheckLoopback(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { lookupIP = lookup }(lookupIP)
+	hosts := map[string][]net.IP{
+		"localhost": {net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		"mixed":     {net.ParseIP("127.0.0.1"), net.ParseIP("192.0.2.1")},
+		"public":    {net.ParseIP("192.0.2.1")},
+		"empty":     {},
+	}
+	lookupIP = func(host string) ([]net.IP, error) {
+		if ips, ok := hosts[host]; ok {
+			return ips, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:6060": true,
+		"127.1.2.3:6060": true,
+		"[::1]:6060":     true,
+		"localhost:6060": true,
+		"mixed:6060":     false,
+		"public:6060":    false,
+		"empty:6060":     false,
+		"missing:6060":   false,
+		"0.0.0.0:6060":   false,
+		"[::]:6060":      false,
+		":6060":          false,
+		"192.0.2.1:6060": false,
+		"localhost":      false,
+	} {
+		if err := checkLoopback(addr); (err == nil) != ok {
+			t.Errorf("checkLoopback(%s) = %v, want allowed %v", addr, err, ok)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// unixPrefix is the prefix of the addresses of the unix sockets.
+const unixPrefix = "unix:"
+
+// Serve serves the metrics at /metrics, and the profiles of net/http/pprof
+// at /debug/pprof/, on the address until the returned server is closed. The
+// address is a TCP address on the loopback interface, e.g.
+// "localhost:6060", or "unix:" followed by the path of a unix socket. The
+// profiles reveal the internals of goplz, they're never served to the
+// network.
+func Serve(address string) (io.Closer, error) {
+	network, addr := "tcp", address
+	if strings.HasPrefix(address, unixPrefix) {
+		network, addr = "unix", strings.TrimPrefix(address, unixPrefix)
+		// Remove the socket left by a crash.
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	} else if err := checkLoopback(addr); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	return srv, nil
+}
+
+// lookupIP resolves the host names, it's replaced by the tests.
+var lookupIP = net.LookupIP
+
+// checkLoopback returns an error if the TCP address is not on the loopback
+// interface. A host name, e.g. "localhost", must only resolve to loopback
+// addresses.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil && host != "" {
+		if ips, err = lookupIP(host); err != nil {
+			return err
+		}
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("address %s is not on the loopback interface", addr)
+	}
+	for _, ip := range ips {
+		if ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("address %s is not on the loopback interface", addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package scan
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+// Lazy populates the virtual directories when they are first accessed,
+// instead of scanning the whole workspace upfront. For a virtual directory,
+// only the actual directories which could contribute to it according to the
+// mapping rules are read.
+type Lazy struct {
+	mapper mapping.SourceMapper
+	fs     vfs.FileSystem
+
+	onces     sync.Map
+	populated sync.Map
+	count     int64
+}
+
+// NewLazy creates and returns a new Lazy populating fs.
+func NewLazy(mapper mapping.SourceMapper, fs vfs.FileSystem) *Lazy {
+	return &Lazy{
+		mapper: mapper,
+		fs:     fs,
+	}
+}
+
+// LazyReport is a point-in-time report of the lazy population.
+type LazyReport struct {
+	PopulatedDirs int64 `json:"populated_dirs"`
+}
+
+// Report returns the current state of the lazy population.
+func (l *Lazy) Report() *LazyReport {
+	return &LazyReport{
+		PopulatedDirs: atomic.LoadInt64(&l.count),
+	}
+}
+
+// Populate populates the virtual directory and its parent directories, if
+// they have not been populated.
+func (l *Lazy) Populate(virtual string) {
+	virtual = cleanVirtual(virtual)
+	l.populateDir("")
+	if virtual == "" {
+		return
+	}
+	dir := ""
+	for _, name := range strings.Split(virtual, pathSeparator) {
+		dir = filepath.Join(dir, name)
+		if _, remPath := l.fs.MatchPath(dir); len(remPath) != 0 {
+			return
+		}
+		l.populateDir(dir)
+	}
+}
+
+// Populated returns true if the virtual directory has been populated, or is
+// being populated. The changes in it must be tracked then, the files created
+// after the actual directories were read would be missed otherwise.
+func (l *Lazy) Populated(virtual string) bool {
+	_, ok := l.populated.Load(cleanVirtual(virtual))
+	return ok
+}
+
+// Forget forgets that the virtual directory and its subdirectories have been
+// populated, once they're untracked. They are populated again when they are
+// recreated, the files created in them before the watcher saw them would be
+// missed otherwise.
+func (l *Lazy) Forget(virtual string) {
+	virtual = cleanVirtual(virtual)
+	l.onces.Range(func(key, _ interface{}) bool {
+		if _, ok := relVirtual(virtual, key.(string)); ok {
+			l.onces.Delete(key)
+			if _, ok := l.populated.LoadAndDelete(key); ok {
+				atomic.AddInt64(&l.count, -1)
+			}
+		}
+		return true
+	})
+}
+
+func (l *Lazy) populateDir(dir string) {
+	once, _ := l.onces.LoadOrStore(dir, &sync.Once{})
+	once.(*sync.Once).Do(func() {
+		if verbose {
+			log.Printf("populate virtual directory %s\n", dir)
+		}
+		l.populated.Store(dir, true)
+		start := time.Now()
+		l.scanDir(dir)
+		scanDuration.ObserveDuration(time.Since(start), "lazy")
+		atomic.AddInt64(&l.count, 1)
+	})
+}
+
+// scanDir tracks the children of the virtual directory, by reading the
+// actual directories the mapping rules would map into it.
+func (l *Lazy) scanDir(dir string) {
+	seen := make(map[string]bool)
+	for _, p := range l.mapper.Prefixes() {
+		prefix := cleanVirtual(p.Virtual)
+		if rel, ok := relVirtual(prefix, dir); ok {
+			// The directory is inside the prefix, the files come from the
+			// corresponding actual directory.
+			actual := filepath.Join(p.Actual, rel)
+			if seen[actual] || !inScope(actual, p.Scope) {
+				continue
+			}
+			seen[actual] = true
+			l.scanActualDir(p, dir, actual)
+		} else if rel, ok := relVirtual(dir, prefix); ok {
+			// The prefix is deeper, the directories on the way to it are
+			// intermediate directories unless mapped by other rules.
+			child := filepath.Join(dir, strings.SplitN(rel, pathSeparator, 2)[0])
+			if child == prefix {
+				if virtual, readonly, rank, _ := l.mapper.MapRule(p.Actual); virtual == prefix {
+					l.fs.TrackSource(prefix, vfs.Source{Actual: p.Actual, Readonly: readonly, Priority: rank, Dir: true})
+					continue
+				}
+			}
+			l.trackIntermediate(child)
+		}
+	}
+}
+
+func (l *Lazy) scanActualDir(p mapping.Prefix, dir, actualDir string) {
+	f, err := os.Open(actualDir)
+	if err != nil {
+		if verbose && !os.IsNotExist(err) {
+			log.Printf("Failed to open directory %s, %v.\n", actualDir, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	for {
+		entries, err := f.ReadDir(1024)
+		for _, e := range entries {
+			actual := filepath.Join(actualDir, e.Name())
+			virtual, readonly, rank, st := l.mapper.MapRule(actual)
+			switch {
+			case st == mapping.Excluded:
+			case virtual != "":
+				// Only the direct children are tracked, the deeper files are
+				// tracked when their directories get populated.
+				if filepath.Dir(virtual) == dir || (dir == "" && filepath.Dir(virtual) == ".") {
+					l.fs.TrackSource(virtual, vfs.Source{Actual: actual, Readonly: readonly, Priority: rank, Dir: e.IsDir()})
+				}
+			case e.IsDir() && !l.mapper.Excludes(p, actual):
+				// The rule might map files in the subdirectory.
+				l.trackIntermediate(filepath.Join(dir, e.Name()))
+			}
+		}
+		if err != nil {
+			if err != io.EOF && verbose {
+				log.Printf("Failed to read directory %s, %v.\n", actualDir, err)
+			}
+			return
+		}
+	}
+}
+
+func (l *Lazy) trackIntermediate(virtual string) {
+	if _, remPath := l.fs.MatchPath(virtual); len(remPath) != 0 {
+		l.fs.Track(virtual, "", false)
+	}
+}
+
+func cleanVirtual(virtual string) string {
+	virtual = filepath.Clean(virtual)
+	if virtual == "." || virtual == pathSeparator {
+		return ""
+	}
+	return strings.TrimPrefix(virtual, pathSeparator)
+}
+
+// relVirtual returns the virtual path relative to base, and false if path is
+// not base or in base.
+func relVirtual(base, path string) (string, bool) {
+	switch {
+	case base == path:
+		return ".", true
+	case base == "":
+		return path, true
+	case strings.HasPrefix(path, base+pathSeparator):
+		return path[len(base)+1:], true
+	}
+	return "", false
+}
+
+// inScope returns true if the actual directory is in the scope directory, or
+// contains it.
+func inScope(actual, scope string) bool {
+	if scope == "." || actual == scope || actual == "." {
+		return true
+	}
+	return strings.HasPrefix(actual, scope+pathSeparator) || strings.HasPrefix(scope, actual+pathSeparator)
+}
@@ -0,0 +1,139 @@
+package scan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxerwang/goplz/conf"
+	pb "github.com/linuxerwang/goplz/conf/proto"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+func TestLazyRepopulatesRecreatedDir(t *testing.T) {
+	ws := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if err := os.MkdirAll("a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("a/old.go", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapper := mapping.New(&conf.Config{
+		GoImportPath: "example.com/ws",
+		Settings:     &pb.Settings{},
+	})
+	fs, err := vfs.New(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLazy(mapper, fs)
+	const dir = "src/example.com/ws/a"
+	l.Populate(dir)
+	if _, remPath := fs.MatchPath(dir + "/old.go"); len(remPath) != 0 {
+		t.Fatalf("%s/old.go is not tracked", dir)
+	}
+
+	// The directory is removed and recreated with a file, before the
+	// watcher sees the new directory.
+	if err := os.RemoveAll("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Untrack(dir); err != nil {
+		t.Fatal(err)
+	}
+	l.Forget(dir)
+	if l.Populated(dir) {
+		t.Fatalf("%s is still populated", dir)
+	}
+	if err := os.MkdirAll("a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("a/new.go", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs.Track(dir, "a", false)
+
+	l.Populate(dir)
+	if _, remPath := fs.MatchPath(dir + "/new.go"); len(remPath) != 0 {
+		t.Errorf("%s/new.go is not tracked after the directory is recreated", dir)
+	}
+	if _, remPath := fs.MatchPath(dir + "/old.go"); len(remPath) == 0 {
+		t.Errorf("%s/old.go is still tracked", dir)
+	}
+}
+
+// changingFS calls onTrack before tracking a file, once.
+type changingFS struct {
+	vfs.FileSystem
+	onTrack func()
+}
+
+func (fs *changingFS) TrackSource(virtual string, src vfs.Source) {
+	if f := fs.onTrack; f != nil {
+		fs.onTrack = nil
+		f()
+	}
+	fs.FileSystem.TrackSource(virtual, src)
+}
+
+func TestLazyTracksChangesWhilePopulating(t *testing.T) {
+	ws := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if err := os.MkdirAll("a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("a/old.go", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapper := mapping.New(&conf.Config{
+		GoImportPath: "example.com/ws",
+		Settings:     &pb.Settings{},
+	})
+	tree, err := vfs.New(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &changingFS{FileSystem: tree}
+	l := NewLazy(mapper, fs)
+	const dir = "src/example.com/ws/a"
+	l.Populate(filepath.Dir(dir))
+
+	// A file is created once the actual directory was read, the watcher
+	// sees it before the directory is populated.
+	fs.onTrack = func() {
+		if err := ioutil.WriteFile("a/new.go", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if l.Populated(dir) {
+			fs.FileSystem.TrackSource(dir+"/new.go", vfs.Source{Actual: "a/new.go"})
+		}
+	}
+	l.Populate(dir)
+	if fs.onTrack != nil {
+		t.Fatal("no file tracked while populating")
+	}
+	for _, name := range []string{"old.go", "new.go"} {
+		if _, remPath := fs.MatchPath(dir + "/" + name); len(remPath) != 0 {
+			t.Errorf("%s/%s is not tracked", dir, name)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package scan
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/metrics"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+var (
+	verbose       bool
+	pathSeparator = string(os.PathSeparator)
+
+	scanDuration = metrics.NewHistogram("goplz_scan_duration_seconds",
+		`The duration of the scans by their kinds, "full" for the workspace, "dir" for a directory, "rescan" for the directories changed since the snapshot, and "lazy" for populating a virtual directory.`,
+		[]float64{.001, .01, .1, 1, 10, 60, 600}, "kind")
+)
+
+// Init initialize the scan package.
+func Init(ctx *cli.Context) {
+	verbose = ctx.Bool("verbose")
+}
+
+// Progress counts the directories and files scanned. It is safe to read
+// while the scan is running.
+type Progress struct {
+	dirs    int64
+	files   int64
+	tracked int64
+	start   time.Time
+	end     atomic.Value
+}
+
+// NewProgress creates and returns a new Progress starting from now.
+func NewProgress() *Progress {
+	return &Progress{
+		start: time.Now(),
+	}
+}
+
+// Report is a point-in-time report of the progress.
+type Report struct {
+	Dirs        int64   `json:"dirs"`
+	Files       int64   `json:"files"`
+	Tracked     int64   `json:"tracked"`
+	FilesPerSec float64 `json:"files_per_sec"`
+	Elapsed     string  `json:"elapsed"`
+	Done        bool    `json:"done"`
+}
+
+// Report returns the current progress.
+func (p *Progress) Report() *Report {
+	end, done := p.end.Load().(time.Time)
+	if !done {
+		end = time.Now()
+	}
+	elapsed := end.Sub(p.start)
+	r := Report{
+		Dirs:    atomic.LoadInt64(&p.dirs),
+		Files:   atomic.LoadInt64(&p.files),
+		Tracked: atomic.LoadInt64(&p.tracked),
+		Elapsed: elapsed.Round(time.Millisecond).String(),
+		Done:    done,
+	}
+	if elapsed > 0 {
+		r.FilesPerSec = float64(r.Files) / elapsed.Seconds()
+	}
+	return &r
+}
+
+func (p *Progress) String() string {
+	r := p.Report()
+	return fmt.Sprintf("%d directories, %d files, %d tracked (%.0f files/s, %s)",
+		r.Dirs, r.Files, r.Tracked, r.FilesPerSec, r.Elapsed)
+}
+
+// Done marks the scan as finished.
+func (p *Progress) Done() {
+	p.end.Store(time.Now())
+}
+
+// PrintProgress prints the progress to w every interval, until the returned
+// function is called.
+func PrintProgress(w io.Writer, p *Progress, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(w, "\rScanning: %s", p)
+			case <-done:
+				fmt.Fprintf(w, "\rScanned: %s\n", p)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// DirSet is a set of actual directories. It's safe to use concurrently.
+type DirSet struct {
+	dirs sync.Map
+}
+
+// Add adds the directory to the set.
+func (ds *DirSet) Add(dir string) {
+	ds.dirs.Store(dir, true)
+}
+
+// Range calls fn for every directory in the set.
+func (ds *DirSet) Range(fn func(dir string)) {
+	ds.dirs.Range(func(k, _ interface{}) bool {
+		fn(k.(string))
+		return true
+	})
+}
+
+// Walk scans the actual directory root and its subdirectories concurrently,
+// tracking the files mapped by mapper in fs as they are found. Excluded
+// directories are pruned. The actual directories read are added to dirs.
+// progress and dirs can be nil.
+func Walk(root string, mapper mapping.SourceMapper, fs vfs.FileSystem, progress *Progress, dirs *DirSet) {
+	Rescan(root, nil, mapper, fs, progress, dirs)
+}
+
+// Rescan scans the actual directory root like Walk, except that the
+// subdirectories for which known returns true are not descended into. known
+// can be nil.
+func Rescan(root string, known func(dir string) bool, mapper mapping.SourceMapper, fs vfs.FileSystem, progress *Progress, dirs *DirSet) {
+	kind := "dir"
+	switch {
+	case known != nil:
+		kind = "rescan"
+	case root == ".":
+		kind = "full"
+	}
+	start := time.Now()
+	defer func() {
+		scanDuration.ObserveDuration(time.Since(start), kind)
+	}()
+
+	if progress == nil {
+		progress = NewProgress()
+	}
+	w := walker{
+		mapper:   mapper,
+		fs:       fs,
+		progress: progress,
+		known:    known,
+		dirs:     dirs,
+	}
+	w.queue.cond = sync.NewCond(&w.queue.mu)
+
+	fi, err := os.Lstat(root)
+	if err != nil {
+		log.Printf("Failed to scan %s, %v.\n", root, err)
+		return
+	}
+	if !w.visit(root, fi.IsDir()) {
+		return
+	}
+
+	w.queue.push(root)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := w.queue.pop()
+				if !ok {
+					return
+				}
+				w.scanDir(dir)
+				w.queue.done()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func numWorkers() int {
+	// Scanning is mostly waiting for the disk, use more workers than CPUs.
+	return runtime.NumCPU() * 4
+}
+
+type walker struct {
+	mapper   mapping.SourceMapper
+	fs       vfs.FileSystem
+	progress *Progress
+	known    func(dir string) bool
+	// dirs records the actual directories read, if not nil.
+	dirs  *DirSet
+	queue dirQueue
+}
+
+// visit maps and tracks the actual file, it returns true if the file is a
+// directory to descend into.
+func (w *walker) visit(actual string, isDir bool) bool {
+	if isDir {
+		atomic.AddInt64(&w.progress.dirs, 1)
+	} else {
+		atomic.AddInt64(&w.progress.files, 1)
+	}
+	virtual, readonly, rank, st := w.mapper.MapRule(actual)
+	if st == mapping.Excluded {
+		return false
+	}
+	if virtual != "" {
+		w.fs.TrackSource(virtual, vfs.Source{Actual: actual, Readonly: readonly, Priority: rank, Dir: isDir})
+		atomic.AddInt64(&w.progress.tracked, 1)
+	}
+	return isDir
+}
+
+func (w *walker) scanDir(dir string) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if verbose {
+			log.Printf("Failed to open directory %s, %v.\n", dir, err)
+		}
+		return
+	}
+	defer f.Close()
+	if w.dirs != nil {
+		w.dirs.Add(dir)
+	}
+
+	for {
+		entries, err := f.ReadDir(1024)
+		for _, e := range entries {
+			actual := filepath.Join(dir, e.Name())
+			if w.visit(actual, e.IsDir()) && (w.known == nil || !w.known(actual)) {
+				w.queue.push(actual)
+			}
+		}
+		if err != nil {
+			if err != io.EOF && verbose {
+				log.Printf("Failed to read directory %s, %v.\n", dir, err)
+			}
+			return
+		}
+	}
+}
+
+// dirQueue is an unbounded queue of the directories to scan. It tracks the
+// directories being scanned, so that pop returns false only when the whole
+// tree has been scanned.
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    []string
+	pending int
+}
+
+func (q *dirQueue) push(dir string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.dirs = append(q.dirs, dir)
+	q.pending++
+	q.cond.Signal()
+}
+
+func (q *dirQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.dirs) == 0 && q.pending > 0 {
+		q.cond.Wait()
+	}
+	if len(q.dirs) == 0 {
+		return "", false
+	}
+	// Scan depth first to keep the queue short.
+	dir := q.dirs[len(q.dirs)-1]
+	q.dirs = q.dirs[:len(q.dirs)-1]
+	return dir, true
+}
+
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending--
+	if q.pending == 0 {
+		q.cond.Broadcast()
+	}
+}
@@ -0,0 +1,110 @@
+package scan
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxerwang/goplz/conf"
+	pb "github.com/linuxerwang/goplz/conf/proto"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+var benchFiles = flag.Int("bench_files", 1000000, "number of files in the synthetic workspace of the startup benchmarks")
+
+// makeTree creates a synthetic workspace of n files in packages of 100
+// files, 10 packages per directory, and changes into it.
+func makeTree(b testing.TB, n int) {
+	ws := b.TempDir()
+	for i := 0; i < n; i += 100 {
+		dir := filepath.Join(ws, fmt.Sprintf("d%d/p%d", i/1000, i/100%10))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for j := i; j < i+100 && j < n; j++ {
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d.go", j)), nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.Chdir(wd) })
+}
+
+func benchMapper() mapping.SourceMapper {
+	return mapping.New(&conf.Config{
+		GoImportPath: "example.com/ws",
+		Settings:     &pb.Settings{Exclude: []string{".git"}},
+	})
+}
+
+func TestWalkRecordsDirs(t *testing.T) {
+	makeTree(t, 2000)
+	mapper := benchMapper()
+	fs, err := vfs.New(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := &DirSet{}
+	Walk(".", mapper, fs, nil, dirs)
+	got := map[string]bool{}
+	dirs.Range(func(dir string) { got[dir] = true })
+	want := []string{".", "d0", "d1", "d0/p0", "d0/p9", "d1/p9"}
+	for _, dir := range want {
+		if !got[filepath.FromSlash(dir)] {
+			t.Errorf("directory %s is not recorded", dir)
+		}
+	}
+	if len(got) != 23 {
+		t.Errorf("%d directories recorded, want 23", len(got))
+	}
+
+	// The walks without a set don't record into the sets of other walks.
+	Walk("d0", mapper, fs, nil, nil)
+	n := 0
+	dirs.Range(func(string) { n++ })
+	if n != 23 {
+		t.Errorf("%d directories recorded after another walk, want 23", n)
+	}
+}
+
+// BenchmarkWalk measures the startup scan of a workspace of -bench_files
+// files into the vfs.
+func BenchmarkWalk(b *testing.B) {
+	makeTree(b, *benchFiles)
+	mapper := benchMapper()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fs, err := vfs.New(".")
+		if err != nil {
+			b.Fatal(err)
+		}
+		Walk(".", mapper, fs, nil, nil)
+	}
+}
+
+// BenchmarkLazyPopulate measures populating one directory of the workspace
+// in lazy mode, which is all the startup has to do.
+func BenchmarkLazyPopulate(b *testing.B) {
+	makeTree(b, *benchFiles)
+	mapper := benchMapper()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fs, err := vfs.New(".")
+		if err != nil {
+			b.Fatal(err)
+		}
+		l := NewLazy(mapper, fs)
+		l.Populate("src/example.com/ws/d0/p0")
+	}
+}
@@ -0,0 +1,254 @@
+package snapshot
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+// format is the version of the snapshot format, bump it whenever Snapshot
+// changes.
+const format = 4
+
+// ErrIncompatible is returned by Load if the snapshot was saved by another
+// goplz version or with another configuration.
+var ErrIncompatible = errors.New("incompatible snapshot")
+
+// Snapshot is the snapshot of the virtual tree saved on disk.
+type Snapshot struct {
+	Format     int
+	Version    string
+	ConfigHash string
+	Saved      time.Time
+	// Dirs are the actual directories scanned.
+	Dirs []Dir
+	// Entries are the tracked virtual files and directories.
+	Entries []Entry
+}
+
+// Dir is an actual directory scanned, with its mtime when the snapshot was
+// saved.
+type Dir struct {
+	Actual string
+	Mtime  int64
+	// Ignore is the hash of the ignore files in the directory, 0 if there
+	// is none. Editing a file doesn't change the mtime of its directory.
+	Ignore uint64
+}
+
+// Entry is a source of a tracked virtual file or directory.
+type Entry struct {
+	Virtual  string
+	Actual   string
+	Readonly bool
+	Priority int
+	Dir      bool
+}
+
+// Report is the report of restoring a snapshot.
+type Report struct {
+	Restored    bool   `json:"restored"`
+	Error       string `json:"error,omitempty"`
+	Entries     int    `json:"entries"`
+	Dirs        int    `json:"dirs"`
+	ChangedDirs int    `json:"changed_dirs"`
+	RemovedDirs int    `json:"removed_dirs"`
+	Elapsed     string `json:"elapsed"`
+}
+
+// Save saves the snapshot of fs to the file fn. dirs are the actual
+// directories scanned to build fs, their mtimes and ignore files are read
+// now, which relies on fs having been kept up to date with the changes since
+// they were scanned.
+func Save(fn, version, configHash string, mapper mapping.SourceMapper, fs vfs.FileSystem, dirs *scan.DirSet) error {
+	s := Snapshot{
+		Format:     format,
+		Version:    version,
+		ConfigHash: configHash,
+		Saved:      time.Now(),
+	}
+	ignoreFiles := mapper.IgnoreFiles()
+	dirs.Range(func(dir string) {
+		if fi, err := os.Lstat(dir); err == nil && fi.IsDir() {
+			s.Dirs = append(s.Dirs, Dir{
+				Actual: dir,
+				Mtime:  fi.ModTime().UnixNano(),
+				Ignore: hashIgnoreFiles(dir, ignoreFiles),
+			})
+		}
+	})
+	fs.Walk(func(virtual string, e vfs.Entry) {
+		// The intermediate directories are recreated by tracking their
+		// children, and the root is created with fs.
+		if e.Parent() == nil {
+			return
+		}
+		for _, src := range e.Sources() {
+			s.Entries = append(s.Entries, Entry{
+				Virtual:  virtual,
+				Actual:   src.Actual,
+				Readonly: src.Readonly,
+				Priority: src.Priority,
+				Dir:      src.Dir,
+			})
+		}
+	})
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	// Write to a temp file and rename, so that a partial snapshot is never
+	// loaded.
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	err = gob.NewEncoder(zw).Encode(&s)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Load loads the snapshot from the file fn. It returns ErrIncompatible if
+// the snapshot was saved by another goplz version or with another
+// configuration.
+func Load(fn, version, configHash string) (*Snapshot, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	s := Snapshot{}
+	if err := gob.NewDecoder(zr).Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot, %v", err)
+	}
+	if s.Format != format || s.Version != version || s.ConfigHash != configHash {
+		return nil, ErrIncompatible
+	}
+	return &s, nil
+}
+
+// Restore tracks the entries of the snapshot in fs. The entries in the
+// actual directories not changed since the snapshot was saved are restored
+// as is, the changed directories are rescanned, and the new directories in
+// them are walked. The restored and rescanned directories are added to dirs.
+// The directories under an ignore file changed since are rescanned too, as
+// the files the ignore file excludes might have changed.
+func (s *Snapshot) Restore(mapper mapping.SourceMapper, fs vfs.FileSystem, dirs *scan.DirSet, progress *scan.Progress) *Report {
+	start := time.Now()
+	r := Report{Restored: true}
+
+	// The entries by the actual directories containing them.
+	entries := make(map[string][]int, len(s.Dirs))
+	for i, e := range s.Entries {
+		if !mapping.Confined(e.Virtual) || !mapping.Confined(e.Actual) {
+			// The snapshot file is not trusted to stay in the workspace.
+			continue
+		}
+		dir := filepath.Dir(e.Actual)
+		entries[dir] = append(entries[dir], i)
+	}
+	known := make(map[string]bool, len(s.Dirs))
+	for _, d := range s.Dirs {
+		known[d.Actual] = true
+	}
+
+	// The directories whose ignore files changed.
+	ignoreFiles := mapper.IgnoreFiles()
+	ignoreChanged := make(map[string]bool)
+	if len(ignoreFiles) > 0 {
+		for _, d := range s.Dirs {
+			if hashIgnoreFiles(d.Actual, ignoreFiles) != d.Ignore {
+				ignoreChanged[d.Actual] = true
+			}
+		}
+	}
+	underChangedIgnore := func(dir string) bool {
+		for len(ignoreChanged) > 0 {
+			if ignoreChanged[dir] {
+				return true
+			}
+			if dir == "." || dir == "/" {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		return false
+	}
+
+	var changed []string
+	for _, d := range s.Dirs {
+		fi, err := os.Lstat(d.Actual)
+		switch {
+		case err != nil || !fi.IsDir():
+			r.RemovedDirs++
+		case fi.ModTime().UnixNano() != d.Mtime || underChangedIgnore(d.Actual):
+			changed = append(changed, d.Actual)
+		default:
+			for _, i := range entries[d.Actual] {
+				e := s.Entries[i]
+				fs.TrackSource(e.Virtual, vfs.Source{Actual: e.Actual, Readonly: e.Readonly, Priority: e.Priority, Dir: e.Dir})
+			}
+			r.Entries += len(entries[d.Actual])
+			r.Dirs++
+			dirs.Add(d.Actual)
+		}
+	}
+
+	// Rescan the changed directories after restoring the others, so that
+	// the changes are applied on top of the restored entries.
+	isKnown := func(dir string) bool {
+		return known[dir]
+	}
+	for _, dir := range changed {
+		scan.Rescan(dir, isKnown, mapper, fs, progress, dirs)
+	}
+	r.ChangedDirs = len(changed)
+	r.Elapsed = time.Since(start).Round(time.Millisecond).String()
+	return &r
+}
+
+// hashIgnoreFiles returns the hash of the ignore files of the given names in
+// the actual directory dir, or 0 if there is none.
+func hashIgnoreFiles(dir string, names []string) uint64 {
+	h := fnv.New64a()
+	found := false
+	for _, n := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dir, n))
+		if err != nil {
+			continue
+		}
+		found = true
+		fmt.Fprintf(h, "%s\x00%d\x00", n, len(b))
+		h.Write(b)
+	}
+	if !found {
+		return 0
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,257 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linuxerwang/goplz/conf"
+	pb "github.com/linuxerwang/goplz/conf/proto"
+	"github.com/linuxerwang/goplz/mapping"
+	"github.com/linuxerwang/goplz/scan"
+	"github.com/linuxerwang/goplz/vfs"
+)
+
+const (
+	testVersion = "1.0"
+	testHash    = "hash"
+)
+
+// setup creates a workspace with the packages a and b, changes into it and
+// saves the snapshot of its virtual tree. It returns the mapper and the
+// snapshot file.
+func setup(t *testing.T) (mapping.SourceMapper, string) {
+	ws := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, fn := range []string{"a/a.go", "b/b.go", "b/c/c.go"} {
+		writeFile(t, fn)
+	}
+	mapper := newMapper()
+	fs := newFS(t)
+	dirs := &scan.DirSet{}
+	scan.Walk(".", mapper, fs, nil, dirs)
+	// The snapshot is saved out of the workspace, not to change the mtimes
+	// of the directories scanned.
+	fn := filepath.Join(t.TempDir(), "goplz", "snapshot")
+	if err := Save(fn, testVersion, testHash, mapper, fs, dirs); err != nil {
+		t.Fatal(err)
+	}
+	return mapper, fn
+}
+
+// newMapper returns the mapper of the workspace, honoring the .gitignore
+// files.
+func newMapper() mapping.SourceMapper {
+	return mapping.New(&conf.Config{
+		GoImportPath: "example.com/ws",
+		Settings:     &pb.Settings{IgnoreFile: []string{".gitignore"}},
+	})
+}
+
+func writeFile(t *testing.T, fn string) {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newFS(t *testing.T) vfs.FileSystem {
+	fs, err := vfs.New(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// touch changes the mtime of the directory, as adding a file does on a file
+// system with a coarse timestamp granularity.
+func touch(t *testing.T, dir string) {
+	mtime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(dir, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func restore(t *testing.T, mapper mapping.SourceMapper, fn string) (vfs.FileSystem, *Report) {
+	s, err := Load(fn, testVersion, testHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newFS(t)
+	return fs, s.Restore(mapper, fs, &scan.DirSet{}, nil)
+}
+
+func tracked(fs vfs.FileSystem, virtual string) bool {
+	_, remPath := fs.MatchPath(filepath.Join("src/example.com/ws", virtual))
+	return len(remPath) == 0
+}
+
+func TestRestoreUnchanged(t *testing.T) {
+	mapper, fn := setup(t)
+	// A file added without changing the mtime of its directory is not
+	// noticed, which shows the directory is restored from the snapshot.
+	fi, err := os.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, "a/new.go")
+	if err := os.Chtimes("a", fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, r := restore(t, mapper, fn)
+	if r.ChangedDirs != 0 || r.RemovedDirs != 0 {
+		t.Errorf("restored %+v, want no changed or removed directories", r)
+	}
+	for _, virtual := range []string{"a/a.go", "b/b.go", "b/c/c.go"} {
+		if !tracked(fs, virtual) {
+			t.Errorf("%s is not restored", virtual)
+		}
+	}
+	if tracked(fs, "a/new.go") {
+		t.Error("a/new.go is tracked, the unchanged directory a was rescanned")
+	}
+}
+
+func TestRestoreChangedDir(t *testing.T) {
+	mapper, fn := setup(t)
+	writeFile(t, "b/new.go")
+	writeFile(t, "b/d/d.go")
+	if err := os.Remove("b/b.go"); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, "b")
+
+	fs, r := restore(t, mapper, fn)
+	if r.ChangedDirs != 1 {
+		t.Errorf("restored %d changed directories, want 1", r.ChangedDirs)
+	}
+	for virtual, want := range map[string]bool{
+		"a/a.go":   true,
+		"b/new.go": true,
+		"b/d/d.go": true,
+		"b/c/c.go": true,
+		"b/b.go":   false,
+	} {
+		if got := tracked(fs, virtual); got != want {
+			t.Errorf("%s tracked = %v, want %v", virtual, got, want)
+		}
+	}
+}
+
+func TestRestoreRemovedDir(t *testing.T) {
+	mapper, fn := setup(t)
+	if err := os.RemoveAll("b/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, r := restore(t, mapper, fn)
+	if r.RemovedDirs != 1 {
+		t.Errorf("restored %d removed directories, want 1", r.RemovedDirs)
+	}
+	if tracked(fs, "b/c/c.go") {
+		t.Error("b/c/c.go in the removed directory is restored")
+	}
+	if !tracked(fs, "a/a.go") {
+		t.Error("a/a.go is not restored")
+	}
+}
+
+func TestRestoreChangedIgnoreFile(t *testing.T) {
+	_, fn := setup(t)
+	// Editing an ignore file doesn't change the mtime of its directory.
+	fi, err := os.Stat("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("b/.gitignore", []byte("c/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("b", fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mapper of the next start reads the ignore files afresh.
+	fs, r := restore(t, newMapper(), fn)
+	if r.ChangedDirs != 2 {
+		t.Errorf("restored %d changed directories, want b and b/c", r.ChangedDirs)
+	}
+	for virtual, want := range map[string]bool{
+		"a/a.go":   true,
+		"b/b.go":   true,
+		"b/c/c.go": false,
+	} {
+		if got := tracked(fs, virtual); got != want {
+			t.Errorf("%s tracked = %v, want %v", virtual, got, want)
+		}
+	}
+}
+
+func TestRestoreRemovedIgnoreFile(t *testing.T) {
+	ws := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(ws); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	writeFile(t, "a/a.go")
+	writeFile(t, "a/b/b.go")
+	if err := ioutil.WriteFile(".gitignore", []byte("b/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapper := newMapper()
+	fs := newFS(t)
+	dirs := &scan.DirSet{}
+	scan.Walk(".", mapper, fs, nil, dirs)
+	fn := filepath.Join(t.TempDir(), "snapshot")
+	if err := Save(fn, testVersion, testHash, mapper, fs, dirs); err != nil {
+		t.Fatal(err)
+	}
+	if tracked(fs, "a/b/b.go") {
+		t.Fatal("a/b/b.go is tracked, it's ignored")
+	}
+
+	fi, err := os.Stat(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(".gitignore", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(".", fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, _ = restore(t, newMapper(), fn)
+	for _, virtual := range []string{"a/a.go", "a/b/b.go"} {
+		if !tracked(fs, virtual) {
+			t.Errorf("%s is not tracked", virtual)
+		}
+	}
+}
+
+func TestLoadIncompatible(t *testing.T) {
+	_, fn := setup(t)
+	if _, err := Load(fn, testVersion, "other"); err != ErrIncompatible {
+		t.Errorf("Load with another config hash: %v, want ErrIncompatible", err)
+	}
+	if _, err := Load(fn, "2.0", testHash); err != ErrIncompatible {
+		t.Errorf("Load with another version: %v, want ErrIncompatible", err)
+	}
+}
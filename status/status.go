@@ -0,0 +1,132 @@
+package status
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	sectionsMu sync.Mutex
+	sections   = map[string]func() interface{}{}
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+)
+
+// Status is the status of the goplz daemon, as saved in the status file.
+type Status struct {
+	Pid      int                        `json:"pid"`
+	Updated  time.Time                  `json:"updated"`
+	Sections map[string]json.RawMessage `json:"sections"`
+}
+
+// SectionNames returns the names of the sections in order.
+func (st *Status) SectionNames() []string {
+	names := make([]string, 0, len(st.Sections))
+	for n := range st.Sections {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Register registers a named section of the daemon status. fn is called
+// every time the status is saved, its result is encoded as JSON.
+func Register(name string, fn func() interface{}) {
+	sectionsMu.Lock()
+	defer sectionsMu.Unlock()
+
+	sections[name] = fn
+}
+
+// Start saves the status to the file fn every interval, until Stop is called.
+func Start(fn string, interval time.Duration) {
+	stopCh = make(chan struct{})
+	doneCh = make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			save(fn)
+			select {
+			case <-ticker.C:
+			case <-stopCh:
+				os.Remove(fn)
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops saving the status and removes the status file.
+func Stop() {
+	if stopCh == nil {
+		return
+	}
+	close(stopCh)
+	<-doneCh
+	stopCh = nil
+}
+
+// Load loads the status saved in the file fn.
+func Load(fn string) (*Status, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	st := Status{}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func collect() *Status {
+	sectionsMu.Lock()
+	defer sectionsMu.Unlock()
+
+	st := Status{
+		Pid:      os.Getpid(),
+		Updated:  time.Now(),
+		Sections: make(map[string]json.RawMessage, len(sections)),
+	}
+	for name, fn := range sections {
+		b, err := json.Marshal(fn())
+		if err != nil {
+			log.Printf("Failed to encode status section %s, %v.\n", name, err)
+			continue
+		}
+		st.Sections[name] = b
+	}
+	return &st
+}
+
+func save(fn string) {
+	b, err := json.Marshal(collect())
+	if err != nil {
+		log.Printf("Failed to encode status, %v.\n", err)
+		return
+	}
+	// The directory is recreated if it's removed, e.g. by plz clean.
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		log.Printf("Failed to create status directory %s, %v.\n", filepath.Dir(fn), err)
+		return
+	}
+	// Write to a temp file and rename, so that readers never see a partial
+	// status.
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.Printf("Failed to write status file %s, %v.\n", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		log.Printf("Failed to write status file %s, %v.\n", fn, err)
+	}
+}
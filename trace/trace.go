@@ -0,0 +1,113 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxRecord is the maximum size of a record when reading a trace, the
+// records of setxattr carry the data.
+const maxRecord = 1 << 20
+
+// Record is a traced operation of the mounted file system, or a change in
+// the workspace seen by the watcher.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Op is the operation, e.g. "create", or "event" for the changes.
+	Op      string `json:"op"`
+	Virtual string `json:"virtual,omitempty"`
+	// NewVirtual is the new virtual path of a rename.
+	NewVirtual string `json:"new_virtual,omitempty"`
+	// Target is the target of a symlink, or the virtual file of a link.
+	Target string `json:"target,omitempty"`
+	// Event is the kind of the change, e.g. "create".
+	Event string `json:"event,omitempty"`
+	Flags uint32 `json:"flags,omitempty"`
+	Mode  uint32 `json:"mode,omitempty"`
+	Size  uint64 `json:"size,omitempty"`
+	// Attr and Data are the name and value of an xattr.
+	Attr string `json:"attr,omitempty"`
+	Data []byte `json:"data,omitempty"`
+
+	// Actual is the actual file before the operation, or the changed
+	// file. Type is its type, "file", "dir", "symlink", or "missing", and
+	// Symlink its target if it's a symlink.
+	Actual  string `json:"actual,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Symlink string `json:"symlink,omitempty"`
+
+	// Status is the errno of the operation, e.g. "ENOENT", "OK" if it
+	// succeeded.
+	Status string `json:"status,omitempty"`
+	// Result is how the virtual tree was updated for a change, e.g.
+	// "track".
+	Result    string `json:"result,omitempty"`
+	LatencyUs int64  `json:"latency_us"`
+}
+
+// Writer writes the records to a trace file as JSON lines.
+type Writer struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Create creates the trace file, truncating it if it exists.
+func Create(fn string) (*Writer, error) {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{f: f}, nil
+}
+
+// Write writes the record. The record is written right away, so that the
+// trace is complete up to a crash.
+func (w *Writer) Write(r *Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err = w.f.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the trace file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.f.Close()
+}
+
+// Read reads the records of the trace file in order, and calls fn with each
+// of them and its line number, until fn returns an error.
+func Read(fn string, f func(line int, r *Record) error) error {
+	file, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRecord)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("failed to parse line %d of %s, %v", line, fn, err)
+		}
+		if err := f(line, &r); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
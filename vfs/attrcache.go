@@ -0,0 +1,151 @@
+package vfs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// maxCachedAttrs limits the number of attrs cached. When reached, the
+// expired attrs are evicted, and new attrs are not cached if none expired.
+const maxCachedAttrs = 1000000
+
+// attrs caches the attrs of the actual files, shared by all the file
+// systems.
+var attrs = attrCache{stat: getRealDirAttr, limit: maxCachedAttrs}
+
+// attrCache caches the attrs of the actual files, by the actual paths. The
+// attrs are invalidated on changes, and expire after the TTL in case a
+// change was missed. It's disabled if the TTL is 0.
+type attrCache struct {
+	stat    func(actual string) (*fuse.Attr, error)
+	limit   int64
+	ttl     int64
+	entries sync.Map
+	// count is approximate, it's only used to limit the cache size.
+	count    int64
+	hits     int64
+	misses   int64
+	evicting int32
+	// generation is incremented by each invalidation, the attrs read while
+	// one happened may be stale and aren't kept.
+	generation int64
+}
+
+type cachedAttr struct {
+	attr    fuse.Attr
+	expires int64
+}
+
+// SetAttrCacheTTL sets the TTL of the cached attrs, 0 disables the cache.
+func SetAttrCacheTTL(ttl time.Duration) {
+	atomic.StoreInt64(&attrs.ttl, int64(ttl))
+}
+
+// InvalidateAttr removes the cached attrs of the actual file.
+func InvalidateAttr(actual string) {
+	attrs.invalidate(actual)
+}
+
+// AttrCacheReport is a point-in-time report of the attr cache.
+type AttrCacheReport struct {
+	TTL     string  `json:"ttl"`
+	Entries int64   `json:"entries"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// AttrCacheStats returns the statistics of the attr cache.
+func AttrCacheStats() *AttrCacheReport {
+	return attrs.stats()
+}
+
+func (c *attrCache) stats() *AttrCacheReport {
+	r := AttrCacheReport{
+		TTL:     time.Duration(atomic.LoadInt64(&c.ttl)).String(),
+		Entries: atomic.LoadInt64(&c.count),
+		Hits:    atomic.LoadInt64(&c.hits),
+		Misses:  atomic.LoadInt64(&c.misses),
+	}
+	if total := r.Hits + r.Misses; total > 0 {
+		r.HitRate = float64(r.Hits) / float64(total)
+	}
+	return &r
+}
+
+// get returns a copy of the attrs of the actual file, from the cache if
+// possible.
+func (c *attrCache) get(actual string) (*fuse.Attr, error) {
+	ttl := atomic.LoadInt64(&c.ttl)
+	if ttl == 0 {
+		return c.stat(actual)
+	}
+
+	now := time.Now().UnixNano()
+	if v, ok := c.entries.Load(actual); ok {
+		ca := v.(*cachedAttr)
+		if now < ca.expires {
+			atomic.AddInt64(&c.hits, 1)
+			attr := ca.attr
+			return &attr, nil
+		}
+	}
+	atomic.AddInt64(&c.misses, 1)
+
+	generation := atomic.LoadInt64(&c.generation)
+	attr, err := c.stat(actual)
+	if err != nil {
+		c.remove(actual)
+		return nil, err
+	}
+	if atomic.LoadInt64(&c.count) >= c.limit {
+		c.evict(now)
+	}
+	if atomic.LoadInt64(&c.count) < c.limit {
+		ca := &cachedAttr{attr: *attr, expires: now + ttl}
+		if _, loaded := c.entries.LoadOrStore(actual, ca); loaded {
+			c.entries.Store(actual, ca)
+		} else {
+			atomic.AddInt64(&c.count, 1)
+		}
+		// An invalidation happening before the attrs are stored would be
+		// lost, they're removed again. The ones happening after remove
+		// them anyway.
+		if atomic.LoadInt64(&c.generation) != generation && c.entries.CompareAndDelete(actual, ca) {
+			atomic.AddInt64(&c.count, -1)
+		}
+	}
+	return attr, nil
+}
+
+// invalidate removes the cached attrs of the actual file, and prevents the
+// attrs being read concurrently from being cached.
+func (c *attrCache) invalidate(actual string) {
+	atomic.AddInt64(&c.generation, 1)
+	c.remove(actual)
+}
+
+func (c *attrCache) remove(actual string) {
+	if _, ok := c.entries.LoadAndDelete(actual); ok {
+		atomic.AddInt64(&c.count, -1)
+	}
+}
+
+// evict removes the expired attrs.
+func (c *attrCache) evict(now int64) {
+	if !atomic.CompareAndSwapInt32(&c.evicting, 0, 1) {
+		// Being evicted by another goroutine.
+		return
+	}
+	defer atomic.StoreInt32(&c.evicting, 0)
+
+	c.entries.Range(func(k, v interface{}) bool {
+		if v.(*cachedAttr).expires <= now {
+			c.remove(k.(string))
+		}
+		return true
+	})
+}
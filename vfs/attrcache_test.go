@@ -0,0 +1,117 @@
+package vfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// fakeStat returns the stat function of an attr cache returning the sizes,
+// and counting the calls by actual path.
+func fakeStat(sizes map[string]uint64, calls map[string]int) func(string) (*fuse.Attr, error) {
+	return func(actual string) (*fuse.Attr, error) {
+		calls[actual]++
+		return &fuse.Attr{Size: sizes[actual]}, nil
+	}
+}
+
+func TestAttrCacheTTL(t *testing.T) {
+	sizes, calls := map[string]uint64{"a": 1}, map[string]int{}
+	c := attrCache{stat: fakeStat(sizes, calls), limit: 10, ttl: int64(50 * time.Millisecond)}
+
+	for i := 0; i < 3; i++ {
+		if attr, err := c.get("a"); err != nil || attr.Size != 1 {
+			t.Fatalf("got attr %v %v", attr, err)
+		}
+	}
+	if calls["a"] != 1 {
+		t.Errorf("stat called %d times, want 1", calls["a"])
+	}
+
+	sizes["a"] = 2
+	time.Sleep(60 * time.Millisecond)
+	if attr, _ := c.get("a"); attr.Size != 2 {
+		t.Errorf("got size %d after the TTL, want 2", attr.Size)
+	}
+
+	sizes["a"] = 3
+	c.invalidate("a")
+	if attr, _ := c.get("a"); attr.Size != 3 {
+		t.Errorf("got size %d after invalidation, want 3", attr.Size)
+	}
+
+	r := c.stats()
+	if r.Hits != 2 || r.Misses != 3 || r.Entries != 1 {
+		t.Errorf("got stats %+v, want 2 hits, 3 misses and 1 entry", r)
+	}
+	if r.HitRate != 0.4 {
+		t.Errorf("got hit rate %v, want 0.4", r.HitRate)
+	}
+}
+
+func TestAttrCacheDisabled(t *testing.T) {
+	calls := map[string]int{}
+	c := attrCache{stat: fakeStat(map[string]uint64{}, calls), limit: 10}
+	c.get("a")
+	c.get("a")
+	if calls["a"] != 2 {
+		t.Errorf("stat called %d times with the cache disabled, want 2", calls["a"])
+	}
+	if r := c.stats(); r.Entries != 0 {
+		t.Errorf("got %d entries with the cache disabled", r.Entries)
+	}
+}
+
+func TestAttrCacheLimit(t *testing.T) {
+	calls := map[string]int{}
+	c := attrCache{stat: fakeStat(map[string]uint64{}, calls), limit: 2, ttl: int64(50 * time.Millisecond)}
+	for i := 0; i < 3; i++ {
+		c.get(fmt.Sprint(i))
+	}
+	if r := c.stats(); r.Entries != 2 {
+		t.Errorf("got %d entries, want the limit 2", r.Entries)
+	}
+	// None expired, the new attrs aren't cached.
+	c.get("2")
+	if calls["2"] != 2 {
+		t.Errorf("stat of the attrs beyond the limit called %d times, want 2", calls["2"])
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c.get("2")
+	c.get("2")
+	if calls["2"] != 3 {
+		t.Errorf("stat called %d times once the others expired, want 3", calls["2"])
+	}
+	if r := c.stats(); r.Entries != 1 {
+		t.Errorf("got %d entries after the eviction, want 1", r.Entries)
+	}
+}
+
+func TestAttrCacheInvalidatedWhileStatting(t *testing.T) {
+	sizes, calls := map[string]uint64{"a": 1}, map[string]int{}
+	c := attrCache{limit: 10, ttl: int64(time.Minute)}
+	stat := fakeStat(sizes, calls)
+	c.stat = func(actual string) (*fuse.Attr, error) {
+		attr, err := stat(actual)
+		if calls[actual] == 1 {
+			// The file is written after it's statted, and invalidated
+			// before the stale attrs are stored.
+			sizes[actual] = 2
+			c.invalidate(actual)
+		}
+		return attr, err
+	}
+
+	if attr, _ := c.get("a"); attr.Size != 1 {
+		t.Fatalf("got size %d, want 1", attr.Size)
+	}
+	if attr, _ := c.get("a"); attr.Size != 2 {
+		t.Errorf("got stale size %d after the invalidation, want 2", attr.Size)
+	}
+	if r := c.stats(); r.Entries != 1 {
+		t.Errorf("got %d entries, want 1", r.Entries)
+	}
+}
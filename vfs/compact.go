@@ -0,0 +1,717 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// compactFileSystem is a FileSystem using much less memory than fileSystem
+// for large trees, at the cost of coarse locking:
+//   - the path segments are interned, the same names are common in a
+//     monorepo, e.g. "BUILD" and "src";
+//   - the actual path is not stored if it's the actual path of the parent
+//     joined with the name, which is the case for most files;
+//   - the children are kept in a slice sorted by name instead of a map;
+//   - the sources shadowed by the mapped ones are kept aside, few virtual
+//     files have several sources;
+//   - a single lock guards the whole tree.
+type compactFileSystem struct {
+	mu     sync.RWMutex
+	root   *node
+	names  map[string]string
+	inodes *inodes
+	// unions is the sources shadowed by the mapped one of the nodes having
+	// several, sorted.
+	unions map[*node][]Source
+	// times is the times of the synthetic directories, computed from their
+	// children.
+	times map[*node]*dirTimes
+	ranks sourceRanks
+}
+
+// Make sure *compactFileSystem implements FileSystem.
+var _ = (FileSystem)((*compactFileSystem)(nil))
+
+const (
+	flagReadonly uint8 = 1 << iota
+	// flagDerived means the actual path is the actual path of the parent
+	// joined with the name.
+	flagDerived
+	// flagDir means the actual file is a directory.
+	flagDir
+)
+
+type node struct {
+	fs     *compactFileSystem
+	parent *node
+	name   string
+	// actual is empty for the intermediate directories, and if the actual
+	// path is derived.
+	actual   string
+	flags    uint8
+	priority uint16
+	ino      uint64
+	children []*node
+}
+
+// Make sure *node implements Entry.
+var _ = (Entry)((*node)(nil))
+
+// NewCompact creates and returns a new compact FileSystem tracking the
+// actual file. It behaves the same as the one created by New.
+func NewCompact(actual string) (FileSystem, error) {
+	fs := compactFileSystem{
+		names:  map[string]string{},
+		inodes: newInodes(),
+		unions: map[*node][]Source{},
+		times:  map[*node]*dirTimes{},
+		ranks:  sourceRanks{},
+	}
+	fs.root = &node{
+		fs:     &fs,
+		actual: actual,
+		flags:  flagDir,
+		ino:    rootIno,
+	}
+	fs.ranks.count(fs.root.sourcesLocked(), 1)
+	for _, v := range []string{"bin", "pkg", "src"} {
+		fs.root.insertLocked(&node{
+			fs:     &fs,
+			parent: fs.root,
+			name:   fs.intern(v),
+			ino:    fs.inodes.alloc(v),
+		})
+	}
+	return &fs, nil
+}
+
+func (fs *compactFileSystem) intern(name string) string {
+	if s, ok := fs.names[name]; ok {
+		return s
+	}
+	fs.names[name] = name
+	return name
+}
+
+func (fs *compactFileSystem) MatchPath(virtual string) (Entry, []string) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.matchLocked(virtual)
+}
+
+func (fs *compactFileSystem) matchLocked(virtual string) (*node, []string) {
+	if virtual == "" || virtual == "." {
+		return fs.root, nil
+	}
+
+	dirs := strings.Split(virtual, pathSeparator)
+	n := fs.root
+	for idx, d := range dirs {
+		c, _ := n.childLocked(d)
+		if c == nil {
+			return n, dirs[idx:]
+		}
+		n = c
+	}
+	return n, nil
+}
+
+func (fs *compactFileSystem) Track(virtual, actual string, readonly bool) {
+	fs.TrackSource(virtual, Source{Actual: actual, Readonly: readonly})
+}
+
+func (fs *compactFileSystem) TrackSource(virtual string, src Source) {
+	if verbose {
+		log.Printf("track file %s => %s, priority %d\n", virtual, src.Actual, src.Priority)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, remPath := fs.matchLocked(virtual)
+	if len(remPath) == 0 {
+		// An intermediate directory gets mapped to the actual directory, or
+		// the actual file is added to the sources.
+		if src.Actual != "" && n.parent != nil {
+			sources := n.sourcesLocked()
+			fs.ranks.count(sources, -1)
+			sources = addSource(sources, src)
+			fs.ranks.count(sources, 1)
+			n.setSourcesLocked(sources)
+		}
+		return
+	}
+	dirs := strings.Split(virtual, pathSeparator)
+	for i, rp := range remPath {
+		c := &node{
+			fs:     fs,
+			parent: n,
+			name:   fs.intern(rp),
+			ino:    fs.inodes.alloc(strings.Join(dirs[:len(dirs)-len(remPath)+i+1], pathSeparator)),
+		}
+		c.setReadonlyLocked(src.Readonly)
+		if i == len(remPath)-1 {
+			c.setActualLocked(src.Actual)
+			c.priority = clampPriority(src.Priority)
+			c.setDirLocked(src.Dir)
+			fs.ranks.count(c.sourcesLocked(), 1)
+		}
+		n.insertLocked(c)
+		n = c
+	}
+}
+
+func (fs *compactFileSystem) Untrack(virtual string) error {
+	if verbose {
+		log.Printf("untrack file %s\n", virtual)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, remPath := fs.matchLocked(virtual)
+	if len(remPath) > 0 {
+		return os.ErrNotExist
+	}
+	if n.parent == nil {
+		return nil
+	}
+	n.parent.deleteLocked(n.name)
+	n.releaseInosLocked()
+	return nil
+}
+
+func (fs *compactFileSystem) UntrackSource(virtual, actual string) error {
+	if verbose {
+		log.Printf("untrack file %s => %s\n", virtual, actual)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, remPath := fs.matchLocked(virtual)
+	if len(remPath) > 0 {
+		return os.ErrNotExist
+	}
+	if n.parent == nil {
+		return nil
+	}
+	sources, ok := removeSource(n.sourcesLocked(), actual)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if len(sources) > 0 {
+		fs.ranks.count(n.sourcesLocked(), -1)
+		fs.ranks.count(sources, 1)
+		n.setSourcesLocked(sources)
+		return nil
+	}
+	n.parent.deleteLocked(n.name)
+	n.releaseInosLocked()
+	return nil
+}
+
+func (fs *compactFileSystem) Move(oldVirtual, newVirtual, newActual string) error {
+	if verbose {
+		log.Printf("move file %s to %s => %s\n", oldVirtual, newVirtual, newActual)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.movableLocked(oldVirtual)
+	if err != nil {
+		return err
+	}
+	parent, remPath := fs.matchLocked(filepath.Dir(newVirtual))
+	if len(remPath) > 0 {
+		return os.ErrNotExist
+	}
+	name := filepath.Base(newVirtual)
+	var shadowed []Source
+	if old, _ := parent.childLocked(name); old != nil {
+		if old == n {
+			return nil
+		}
+		if sources := old.sourcesLocked(); len(sources) > 1 {
+			if len(old.children) > 0 {
+				return os.ErrExist
+			}
+			shadowed = sources[1:]
+		}
+		parent.deleteLocked(name)
+		old.releaseInosLocked()
+	}
+	oldActual := n.actualLocked()
+	n.parent.deleteLocked(n.name)
+	n.parent, n.name = parent, fs.intern(name)
+	parent.insertLocked(n)
+	n.rebaseLocked(oldActual, newActual)
+	if len(shadowed) > 0 {
+		sources := n.sourcesLocked()
+		fs.ranks.count(sources, -1)
+		for _, s := range shadowed {
+			sources = addSource(sources, s)
+		}
+		fs.ranks.count(sources, 1)
+		n.setSourcesLocked(sources)
+	}
+	return nil
+}
+
+func (fs *compactFileSystem) Exchange(virtual1, virtual2 string) error {
+	if verbose {
+		log.Printf("exchange file %s and %s\n", virtual1, virtual2)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n1, err := fs.movableLocked(virtual1)
+	if err != nil {
+		return err
+	}
+	n2, err := fs.movableLocked(virtual2)
+	if err != nil {
+		return err
+	}
+	a1, a2 := n1.actualLocked(), n2.actualLocked()
+	n1.parent.deleteLocked(n1.name)
+	n2.parent.deleteLocked(n2.name)
+	n1.parent, n2.parent = n2.parent, n1.parent
+	n1.name, n2.name = n2.name, n1.name
+	n1.parent.insertLocked(n1)
+	n2.parent.insertLocked(n2)
+	n1.rebaseLocked(a1, a2)
+	n2.rebaseLocked(a2, a1)
+	return nil
+}
+
+// movableLocked returns the node of the virtual file to move, it can't be the
+// root.
+func (fs *compactFileSystem) movableLocked(virtual string) (*node, error) {
+	n, remPath := fs.matchLocked(virtual)
+	if len(remPath) > 0 {
+		return nil, os.ErrNotExist
+	}
+	if n.parent == nil {
+		return nil, os.ErrInvalid
+	}
+	return n, nil
+}
+
+// rebaseLocked sets the actual path of the moved node, and changes the
+// actual paths of its descendants in oldActual to newActual. The derived
+// actual paths follow their parents.
+func (n *node) rebaseLocked(oldActual, newActual string) {
+	if oldActual == "" {
+		return
+	}
+	n.setActualLocked(newActual)
+	n.rebaseChildrenLocked(oldActual, newActual)
+}
+
+func (n *node) rebaseChildrenLocked(oldActual, newActual string) {
+	rebaseSources(n.fs.unions[n], oldActual, newActual)
+	for _, c := range n.children {
+		if c.flags&flagDerived == 0 && c.actual != "" {
+			if actual, ok := rebasePath(c.actual, oldActual, newActual); ok {
+				c.setActualLocked(actual)
+			}
+		}
+		c.rebaseChildrenLocked(oldActual, newActual)
+	}
+}
+
+func (n *node) releaseInosLocked() {
+	n.fs.ranks.count(n.sourcesLocked(), -1)
+	n.fs.inodes.release(n.ino)
+	delete(n.fs.unions, n)
+	delete(n.fs.times, n)
+	for _, c := range n.children {
+		c.releaseInosLocked()
+	}
+}
+
+func (fs *compactFileSystem) Walk(fn func(virtual string, e Entry)) {
+	fs.root.walk("", fn)
+}
+
+func (fs *compactFileSystem) SourcesByPriority() map[int]int {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.ranks.copy()
+}
+
+func (fs *compactFileSystem) String() string {
+	var buf bytes.Buffer
+	fs.root.Print(&buf, "")
+	return buf.String()
+}
+
+func (n *node) Virtual() string {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	return n.name
+}
+
+func (n *node) Actual() string {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	return n.actualLocked()
+}
+
+func (n *node) actualLocked() string {
+	if n.flags&flagDerived == 0 {
+		return n.actual
+	}
+	// Join the names up to the closest ancestor having the actual path.
+	var names []string
+	p := n
+	for ; p.flags&flagDerived != 0; p = p.parent {
+		names = append(names, p.name)
+	}
+	parts := make([]string, 0, len(names)+1)
+	parts = append(parts, p.actual)
+	for i := len(names) - 1; i >= 0; i-- {
+		parts = append(parts, names[i])
+	}
+	return filepath.Join(parts...)
+}
+
+func (n *node) setActualLocked(actual string) {
+	if actual != "" && n.parent != nil {
+		if pa := n.parent.actualLocked(); pa != "" && filepath.Join(pa, n.name) == actual {
+			n.actual = ""
+			n.flags |= flagDerived
+			return
+		}
+	}
+	n.actual = actual
+	n.flags &^= flagDerived
+}
+
+func (n *node) Sources() []Source {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	return n.sourcesLocked()
+}
+
+func (n *node) sourcesLocked() []Source {
+	actual := n.actualLocked()
+	if actual == "" {
+		return nil
+	}
+	top := Source{Actual: actual, Readonly: n.flags&flagReadonly != 0, Priority: int(n.priority), Dir: n.flags&flagDir != 0}
+	return append([]Source{top}, n.fs.unions[n]...)
+}
+
+// setSourcesLocked maps the node to the first of the sorted sources.
+func (n *node) setSourcesLocked(sources []Source) {
+	treeChanged()
+	if actual := sources[0].Actual; actual != n.actualLocked() {
+		n.pinChildrenLocked()
+		n.setActualLocked(actual)
+	}
+	n.setReadonlyLocked(sources[0].Readonly)
+	n.setDirLocked(sources[0].Dir)
+	n.priority = clampPriority(sources[0].Priority)
+	if len(sources) > 1 {
+		n.fs.unions[n] = append([]Source(nil), sources[1:]...)
+	} else {
+		delete(n.fs.unions, n)
+	}
+}
+
+// pinChildrenLocked stores the actual paths of the children derived from the
+// actual path of the node, before it's mapped to another source.
+func (n *node) pinChildrenLocked() {
+	actual := n.actualLocked()
+	for _, c := range n.children {
+		if c.flags&flagDerived != 0 {
+			c.actual = filepath.Join(actual, c.name)
+			c.flags &^= flagDerived
+		}
+	}
+}
+
+func clampPriority(priority int) uint16 {
+	switch {
+	case priority < 0:
+		return 0
+	case priority > MaxPriority:
+		return MaxPriority
+	}
+	return uint16(priority)
+}
+
+func (n *node) Readonly() bool {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	return n.flags&flagReadonly != 0
+}
+
+func (n *node) setReadonlyLocked(readonly bool) {
+	if readonly {
+		n.flags |= flagReadonly
+	} else {
+		n.flags &^= flagReadonly
+	}
+}
+
+func (n *node) setDirLocked(dir bool) {
+	if dir {
+		n.flags |= flagDir
+	} else {
+		n.flags &^= flagDir
+	}
+}
+
+func (n *node) Attr() (*fuse.Attr, error) {
+	return nodeAttr(n)
+}
+
+func (n *node) Ino() uint64 {
+	return n.ino
+}
+
+func (n *node) baseAttr() (*fuse.Attr, error) {
+	n.fs.mu.RLock()
+	actual, readonly := n.actualLocked(), n.flags&flagReadonly != 0
+	n.fs.mu.RUnlock()
+
+	attr, err := entryAttr(actual, readonly, n.ino)
+	if err == nil && actual == "" {
+		syntheticTimes(n).set(attr)
+	}
+	return attr, err
+}
+
+func (n *node) isDir() bool {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	return n.isDirLocked()
+}
+
+func (n *node) isDirLocked() bool {
+	return n.flags&flagDir != 0 || n.syntheticLocked()
+}
+
+func (n *node) synthetic() bool {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	return n.syntheticLocked()
+}
+
+func (n *node) syntheticLocked() bool {
+	return n.actual == "" && n.flags&flagDerived == 0
+}
+
+func (n *node) subdirs() int {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	count := 0
+	for _, c := range n.children {
+		if c.isDirLocked() {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *node) childNodes() []attrNode {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	nodes := make([]attrNode, len(n.children))
+	for i, c := range n.children {
+		nodes[i] = c
+	}
+	return nodes
+}
+
+func (n *node) cachedTimes() *dirTimes {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	return n.fs.times[n]
+}
+
+func (n *node) cacheTimes(t *dirTimes) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	// The node may have been untracked meanwhile, the times would be kept
+	// forever.
+	if n.trackedLocked() {
+		n.fs.times[n] = t
+	}
+}
+
+// trackedLocked returns true if the node is still in the tree.
+func (n *node) trackedLocked() bool {
+	p := n
+	for ; p.parent != nil; p = p.parent {
+		if c, _ := p.parent.childLocked(p.name); c != p {
+			return false
+		}
+	}
+	return p == n.fs.root
+}
+
+// touchLocked records that the children of the directory changed.
+func (n *node) touchLocked() {
+	treeChanged()
+}
+
+func (n *node) Parent() Entry {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	if n.parent == nil {
+		return nil
+	}
+	return n.parent
+}
+
+func (n *node) GetChild(key string) Entry {
+	n.fs.mu.RLock()
+	defer n.fs.mu.RUnlock()
+
+	if c, _ := n.childLocked(key); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (n *node) SetChild(key string, entry Entry) {
+	c, ok := entry.(*node)
+	if !ok || c.fs != n.fs {
+		panic(fmt.Sprintf("vfs: can't set child %s of a foreign entry type", key))
+	}
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	c.parent = n
+	c.name = n.fs.intern(key)
+	n.deleteLocked(key)
+	n.insertLocked(c)
+}
+
+func (n *node) DeleteChild(key string) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	n.deleteLocked(key)
+}
+
+// childLocked returns the child named name, or nil and the index to insert
+// it at.
+func (n *node) childLocked(name string) (*node, int) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].name >= name
+	})
+	if i < len(n.children) && n.children[i].name == name {
+		return n.children[i], i
+	}
+	return nil, i
+}
+
+func (n *node) insertLocked(c *node) {
+	_, i := n.childLocked(c.name)
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = c
+	n.touchLocked()
+}
+
+func (n *node) deleteLocked(name string) {
+	if c, i := n.childLocked(name); c != nil {
+		copy(n.children[i:], n.children[i+1:])
+		n.children[len(n.children)-1] = nil
+		n.children = n.children[:len(n.children)-1]
+		n.touchLocked()
+	}
+}
+
+func (n *node) Children() []fuse.DirEntry {
+	type child struct {
+		name, actual string
+		readonly     bool
+		ino          uint64
+	}
+	// Stat the actual files without holding the lock.
+	n.fs.mu.RLock()
+	children := make([]child, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, child{c.name, c.actualLocked(), c.flags&flagReadonly != 0, c.ino})
+	}
+	n.fs.mu.RUnlock()
+
+	entries := make([]fuse.DirEntry, 0, len(children))
+	for _, c := range children {
+		attr, err := entryAttr(c.actual, c.readonly, c.ino)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		entries = append(entries, fuse.DirEntry{
+			Name: c.name,
+			Mode: attr.Mode,
+			Ino:  attr.Ino,
+		})
+	}
+	return entries
+}
+
+func (n *node) walk(virtual string, fn func(virtual string, e Entry)) {
+	fn(virtual, n)
+
+	// Don't hold the lock while calling fn.
+	n.fs.mu.RLock()
+	children := append([]*node(nil), n.children...)
+	names := make([]string, len(children))
+	for i, c := range children {
+		names[i] = c.name
+	}
+	n.fs.mu.RUnlock()
+
+	for i, c := range children {
+		c.walk(filepath.Join(virtual, names[i]), fn)
+	}
+}
+
+func (n *node) Print(w io.Writer, prefix string) {
+	virtual := n.Virtual()
+	if virtual == "" || virtual == "." {
+		virtual = "TOP"
+	}
+	ftype := "F"
+	attr, _ := n.Attr()
+	if attr.IsDir() {
+		ftype = "D"
+	}
+	io.WriteString(w, fmt.Sprintf("%s[%s] %s => %s\n", prefix, ftype, virtual, n.Actual()))
+	prefix += "    "
+
+	n.fs.mu.RLock()
+	children := append([]*node(nil), n.children...)
+	n.fs.mu.RUnlock()
+
+	for _, c := range children {
+		c.Print(w, prefix)
+	}
+}
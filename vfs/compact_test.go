@@ -0,0 +1,188 @@
+package vfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// benchFiles is the number of files tracked by the benchmarks, about as many
+// as in a large monorepo.
+const benchFiles = 1 << 20
+
+var implementations = []struct {
+	name  string
+	newFS func(actual string) (FileSystem, error)
+}{
+	{"default", New},
+	{"compact", NewCompact},
+}
+
+type benchFile struct {
+	virtual, actual string
+	dir             bool
+}
+
+// benchTree returns n files in packages of 100 files, 10 packages per
+// directory, preceded by their directories as the scan tracks them.
+func benchTree(n int) []benchFile {
+	files := make([]benchFile, 0, n+n/100+n/1000)
+	for i := 0; i < n; i++ {
+		if i%1000 == 0 {
+			dir := fmt.Sprintf("d%d", i/1000)
+			files = append(files, benchFile{filepath.Join("src/example.com/ws", dir), dir, true})
+		}
+		dir := fmt.Sprintf("d%d/p%d", i/1000, i/100%10)
+		if i%100 == 0 {
+			files = append(files, benchFile{filepath.Join("src/example.com/ws", dir), dir, true})
+		}
+		// The same names are common in a monorepo.
+		name := fmt.Sprintf("f%d.go", i%100)
+		if i%100 == 0 {
+			name = "BUILD"
+		}
+		actual := filepath.Join(dir, name)
+		files = append(files, benchFile{filepath.Join("src/example.com/ws", actual), actual, false})
+	}
+	return files
+}
+
+func trackTree(fs FileSystem, files []benchFile) {
+	for _, f := range files {
+		fs.Track(f.virtual, f.actual, false)
+	}
+}
+
+// BenchmarkMemory reports the heap used per tracked file.
+func BenchmarkMemory(b *testing.B) {
+	files := benchTree(benchFiles)
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				fs, err := impl.newFS(".")
+				if err != nil {
+					b.Fatal(err)
+				}
+				trackTree(fs, files)
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(files)), "B/file")
+				runtime.KeepAlive(fs)
+			}
+		})
+	}
+}
+
+// BenchmarkTrack measures tracking the files, as the startup scan does.
+func BenchmarkTrack(b *testing.B) {
+	files := benchTree(benchFiles)
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fs, err := impl.newFS(".")
+				if err != nil {
+					b.Fatal(err)
+				}
+				trackTree(fs, files)
+			}
+		})
+	}
+}
+
+// BenchmarkMatchPath measures looking up the tracked files, as the FUSE
+// operations do.
+func BenchmarkMatchPath(b *testing.B) {
+	files := benchTree(benchFiles)
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			fs, err := impl.newFS(".")
+			if err != nil {
+				b.Fatal(err)
+			}
+			trackTree(fs, files)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, remPath := fs.MatchPath(files[i%len(files)].virtual); len(remPath) != 0 {
+						b.Fatalf("%s is not tracked", files[i%len(files)].virtual)
+					}
+					i += 7919
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkActual measures resolving the actual paths, which the compact
+// implementation derives from the parents.
+func BenchmarkActual(b *testing.B) {
+	files := benchTree(benchFiles)
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			fs, err := impl.newFS(".")
+			if err != nil {
+				b.Fatal(err)
+			}
+			trackTree(fs, files)
+			entries := make([]Entry, 0, 1024)
+			for i := 0; i < cap(entries); i++ {
+				e, _ := fs.MatchPath(files[i*997%len(files)].virtual)
+				entries = append(entries, e)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				entries[i%len(entries)].Actual()
+			}
+		})
+	}
+}
+
+// TestMoveConcurrentReads reads the names and the parents of the entries
+// while they're moved, for the race detector.
+func TestMoveConcurrentReads(t *testing.T) {
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			fs, err := impl.newFS(".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.Track("src/a", "a", false)
+			fs.Track("src/b", "b", false)
+			fs.Track("src/a/f.go", "a/f.go", false)
+			e, _ := fs.MatchPath("src/a/f.go")
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					e.Virtual()
+					e.Parent()
+					fs.Walk(func(string, Entry) {})
+				}
+			}()
+			for i := 0; i < 500; i++ {
+				if err := fs.Move("src/a/f.go", "src/b/g.go", "b/g.go"); err != nil {
+					t.Fatal(err)
+				}
+				if err := fs.Move("src/b/g.go", "src/a/f.go", "a/f.go"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wg.Wait()
+
+			if got := e.Virtual(); got != "f.go" {
+				t.Errorf("Virtual() = %q, want f.go", got)
+			}
+			if got := e.Actual(); got != "a/f.go" {
+				t.Errorf("Actual() = %q, want a/f.go", got)
+			}
+		})
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 // Entry is an interface for the virtual directory or file.
@@ -17,8 +20,13 @@ type Entry interface {
 	Actual() string
 	// Attr returns the attrs of this entry.
 	Attr() (*fuse.Attr, error)
+	// Ino returns the virtual inode number of this entry.
+	Ino() uint64
 	// Readonly returns true if this virtual file is readonly.
 	Readonly() bool
+	// Sources returns the actual files contributing to this virtual file,
+	// the mapped one first. It's empty for the intermediate directories.
+	Sources() []Source
 	// Parent returns the parent entry.
 	Parent() Entry
 	// GetChild returns the child entry.
@@ -36,33 +44,281 @@ type entry struct {
 	virtual  string
 	actual   string
 	readonly bool
+	priority int
+	dir      bool
+	ino      uint64
+	// times is the times of a synthetic directory, computed from its
+	// children.
+	times *dirTimes
+	// under is the sources shadowed by the mapped one, sorted.
+	under []Source
 
-	parent     Entry
-	children   map[string]Entry
-	childrenMu sync.RWMutex
+	parent   Entry
+	children map[string]Entry
+	// mu guards children, the sources which are set once an intermediate
+	// directory gets mapped to an actual directory or when another source
+	// is tracked, and virtual and parent which are changed when the entry
+	// is moved.
+	mu sync.RWMutex
 }
 
 func (e *entry) Virtual() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	return e.virtual
 }
 
 func (e *entry) Actual() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	return e.actual
 }
 
+func (e *entry) Sources() []Source {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.actual == "" {
+		return nil
+	}
+	top := Source{Actual: e.actual, Readonly: e.readonly, Priority: e.priority, Dir: e.dir}
+	return append([]Source{top}, e.under...)
+}
+
+// setSources maps the entry to the first of the sorted sources.
+func (e *entry) setSources(sources []Source) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.actual, e.readonly, e.priority, e.dir = sources[0].Actual, sources[0].Readonly, sources[0].Priority, sources[0].Dir
+	treeChanged()
+	e.under = nil
+	if len(sources) > 1 {
+		e.under = append([]Source(nil), sources[1:]...)
+	}
+}
+
+// rebaseSources changes the actual paths of the sources in oldActual to
+// newActual.
+func (e *entry) rebaseSources(oldActual, newActual string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if actual, ok := rebasePath(e.actual, oldActual, newActual); ok {
+		e.actual = actual
+	}
+	rebaseSources(e.under, oldActual, newActual)
+}
+
+// place sets the parent and the name of the moved entry.
+func (e *entry) place(parent Entry, virtual string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.parent = parent
+	e.virtual = virtual
+}
+
 func (e *entry) Parent() Entry {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	return e.parent
 }
 
-func (e *entry) Attr() (attr *fuse.Attr, err error) {
-	attr = &defaultDirAttr
-	if e.actual != "" {
-		attr, err = getRealDirAttr(e.actual)
+func (e *entry) Attr() (*fuse.Attr, error) {
+	return nodeAttr(e)
+}
+
+func (e *entry) Ino() uint64 {
+	return e.ino
+}
+
+func (e *entry) baseAttr() (*fuse.Attr, error) {
+	e.mu.RLock()
+	actual, readonly := e.actual, e.readonly
+	e.mu.RUnlock()
+
+	attr, err := entryAttr(actual, readonly, e.ino)
+	if err == nil && actual == "" {
+		syntheticTimes(e).set(attr)
+	}
+	return attr, err
+}
+
+func (e *entry) synthetic() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.actual == ""
+}
+
+func (e *entry) childNodes() []attrNode {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	nodes := make([]attrNode, 0, len(e.children))
+	for _, c := range e.children {
+		if n, ok := c.(attrNode); ok {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (e *entry) cachedTimes() *dirTimes {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.times
+}
+
+func (e *entry) cacheTimes(t *dirTimes) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.times = t
+}
+
+func (e *entry) isDir() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.dir || e.actual == ""
+}
+
+func (e *entry) subdirs() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	count := 0
+	for _, c := range e.children {
+		if n, ok := c.(attrNode); ok && n.isDir() {
+			count++
+		}
+	}
+	return count
+}
+
+// touchLocked records that the children of the directory changed.
+func (e *entry) touchLocked() {
+	treeChanged()
+}
+
+// attrNode is implemented by the entries of the file systems in this
+// package, to compute the attrs of the directories from their children
+// without statting them.
+type attrNode interface {
+	// baseAttr returns the attrs of the actual file, or the default attrs
+	// of a synthetic directory with the times of its newest children.
+	baseAttr() (*fuse.Attr, error)
+	// isDir returns true if the entry was tracked as a directory, or is a
+	// synthetic directory.
+	isDir() bool
+	// subdirs returns the number of children which are directories.
+	subdirs() int
+	// synthetic returns true if the entry isn't mapped to an actual file.
+	synthetic() bool
+	childNodes() []attrNode
+	// cachedTimes returns the times of the synthetic directory last
+	// computed, cacheTimes keeps them.
+	cachedTimes() *dirTimes
+	cacheTimes(t *dirTimes)
+}
+
+// treeChanges is incremented when the tree changes, so that the times of
+// the synthetic directories are computed again.
+var treeChanges int64
+
+func treeChanged() {
+	atomic.AddInt64(&treeChanges, 1)
+}
+
+// dirTimes is the times of a synthetic directory, the newest mtime and
+// ctime among its children, in Unix nanoseconds. They're kept until the tree
+// changes, the attrs of an actual file are invalidated, or they expire along
+// with the cached attrs.
+type dirTimes struct {
+	mtime, ctime int64
+	// tree and generation are treeChanges and the attr cache generation
+	// when the times were computed.
+	tree, generation int64
+	expires          int64
+}
+
+// syntheticTimes returns the times of the synthetic directory, computed again
+// from its children if they may have changed. The synthetic children are
+// descended into, the others are statted through the attr cache.
+func syntheticTimes(n attrNode) *dirTimes {
+	now := time.Now().UnixNano()
+	tree, generation := atomic.LoadInt64(&treeChanges), atomic.LoadInt64(&attrs.generation)
+	if t := n.cachedTimes(); t != nil && t.tree == tree && t.generation == generation && now < t.expires {
+		return t
+	}
+
+	t := &dirTimes{tree: tree, generation: generation, expires: now + atomic.LoadInt64(&attrs.ttl)}
+	for _, c := range n.childNodes() {
+		var mtime, ctime int64
+		if c.synthetic() {
+			ct := syntheticTimes(c)
+			mtime, ctime = ct.mtime, ct.ctime
+		} else {
+			attr, err := c.baseAttr()
+			if err != nil {
+				continue
+			}
+			mtime = int64(attr.Mtime)*int64(time.Second) + int64(attr.Mtimensec)
+			ctime = int64(attr.Ctime)*int64(time.Second) + int64(attr.Ctimensec)
+		}
+		if mtime > t.mtime {
+			t.mtime = mtime
+		}
+		if ctime > t.ctime {
+			t.ctime = ctime
+		}
+	}
+	n.cacheTimes(t)
+	return t
+}
+
+// set sets the times of the attrs, unless the directory has no children.
+func (t *dirTimes) set(attr *fuse.Attr) {
+	if t.mtime == 0 && t.ctime == 0 {
+		return
+	}
+	mtime, ctime := time.Unix(0, t.mtime), time.Unix(0, t.ctime)
+	attr.SetTimes(nil, &mtime, &ctime)
+}
+
+// nodeAttr returns the attrs of the node. The nlink of a directory counts
+// its subdirectories.
+func nodeAttr(n attrNode) (*fuse.Attr, error) {
+	attr, err := n.baseAttr()
+	if err != nil || !attr.IsDir() {
+		return attr, err
+	}
+	attr.Nlink = 2 + uint32(n.subdirs())
+	return attr, nil
+}
+
+// entryAttr returns the attrs of the entry mapped to the actual file, or of
+// an intermediate directory if actual is empty, with the virtual inode
+// number unless the actual file is hard linked.
+func entryAttr(actual string, readonly bool, ino uint64) (attr *fuse.Attr, err error) {
+	dirAttr := defaultDirAttr
+	attr = &dirAttr
+	if actual != "" {
+		attr, err = attrs.get(actual)
 		if err != nil {
 			return
 		}
 	}
-	if e.readonly {
+	if attr.Ino == 0 {
+		attr.Ino = ino
+	}
+	if readonly {
 		// Reset the W bits.
 		attr.Mode &^= 0b010_010_010
 	}
@@ -70,37 +326,51 @@ func (e *entry) Attr() (attr *fuse.Attr, err error) {
 }
 
 func (e *entry) Readonly() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	return e.readonly
 }
 
 func (e *entry) GetChild(key string) Entry {
-	e.childrenMu.RLock()
-	defer e.childrenMu.RUnlock()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
 	return e.children[key]
 }
 
 func (e *entry) SetChild(key string, entry Entry) {
-	e.childrenMu.Lock()
-	defer e.childrenMu.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
 	e.children[key] = entry
+	e.touchLocked()
 }
 
 func (e *entry) DeleteChild(key string) {
-	e.childrenMu.Lock()
-	defer e.childrenMu.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
 	delete(e.children, key)
+	e.touchLocked()
+}
+
+func (e *entry) hasChildren() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return len(e.children) > 0
 }
 
 func (e *entry) Children() []fuse.DirEntry {
-	e.childrenMu.RLock()
-	defer e.childrenMu.RUnlock()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
 	entries := make([]fuse.DirEntry, 0, len(e.children))
 	for _, c := range e.children {
-		attr, err := c.Attr()
+		// Only the mode is needed, don't complete the attrs from the
+		// grandchildren.
+		attr, err := childAttr(c)
 		if err != nil {
 			log.Print(err)
 			continue
@@ -108,11 +378,37 @@ func (e *entry) Children() []fuse.DirEntry {
 		entries = append(entries, fuse.DirEntry{
 			Name: c.Virtual(),
 			Mode: attr.Mode,
+			Ino:  attr.Ino,
 		})
 	}
 	return entries
 }
 
+func childAttr(c Entry) (*fuse.Attr, error) {
+	if n, ok := c.(attrNode); ok {
+		return n.baseAttr()
+	}
+	return c.Attr()
+}
+
+func (e *entry) walk(virtual string, fn func(virtual string, e Entry)) {
+	fn(virtual, e)
+
+	// Don't hold the lock while calling fn.
+	e.mu.RLock()
+	children := make([]Entry, 0, len(e.children))
+	for _, c := range e.children {
+		children = append(children, c)
+	}
+	e.mu.RUnlock()
+
+	for _, c := range children {
+		if ce, ok := c.(*entry); ok {
+			ce.walk(filepath.Join(virtual, ce.Virtual()), fn)
+		}
+	}
+}
+
 func (e *entry) Print(w io.Writer, prefix string) {
 	virtual := e.Virtual()
 	if virtual == "" || virtual == "." {
@@ -126,8 +422,8 @@ func (e *entry) Print(w io.Writer, prefix string) {
 	io.WriteString(w, fmt.Sprintf("%s[%s] %s => %s\n", prefix, ftype, virtual, e.Actual()))
 	prefix += "    "
 
-	e.childrenMu.RLock()
-	defer e.childrenMu.RUnlock()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
 	for _, c := range e.children {
 		c.Print(w, prefix)
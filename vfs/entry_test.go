@@ -0,0 +1,164 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestDirAttrs(t *testing.T) {
+	ws := t.TempDir()
+	for _, dir := range []string{"a/b", "a/c"} {
+		if err := os.MkdirAll(filepath.Join(ws, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(ws, "a/f.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			fs, err := impl.newFS(ws)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, src := range []struct {
+				virtual, actual string
+				dir             bool
+			}{
+				{"src/ws/a", "a", true},
+				{"src/ws/a/b", "a/b", true},
+				{"src/ws/a/c", "a/c", true},
+				{"src/ws/a/f.go", "a/f.go", false},
+			} {
+				fs.TrackSource(src.virtual, Source{Actual: filepath.Join(ws, src.actual), Dir: src.dir})
+			}
+
+			for virtual, want := range map[string]uint32{
+				// The tracked subdirectories are counted.
+				"src/ws/a": 4,
+				"src/ws":   3,
+				"src":      3,
+				"":         5,
+			} {
+				e, _ := fs.MatchPath(virtual)
+				attr, err := e.Attr()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if attr.Nlink != want {
+					t.Errorf("nlink of %q = %d, want %d", virtual, attr.Nlink, want)
+				}
+			}
+
+			// The children are not statted, a removed subdirectory counts
+			// until it's untracked.
+			if err := os.Remove(filepath.Join(ws, "a/c")); err != nil {
+				t.Fatal(err)
+			}
+			e, _ := fs.MatchPath("src/ws/a")
+			if attr, _ := e.Attr(); attr.Nlink != 4 {
+				t.Errorf("nlink of src/ws/a = %d before untracking a/c, want 4", attr.Nlink)
+			}
+			fs.Untrack("src/ws/a/c")
+			if attr, _ := e.Attr(); attr.Nlink != 3 {
+				t.Errorf("nlink of src/ws/a = %d after untracking a/c, want 3", attr.Nlink)
+			}
+			if err := os.Mkdir(filepath.Join(ws, "a/c"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSyntheticDirTimes(t *testing.T) {
+	ws := t.TempDir()
+	if err := os.Mkdir(filepath.Join(ws, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.go", "b.go"} {
+		if err := ioutil.WriteFile(filepath.Join(ws, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	chtime := func(name string, mtime time.Time) {
+		if err := os.Chtimes(filepath.Join(ws, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		InvalidateAttr(filepath.Join(ws, name))
+	}
+	chtime("a.go", base.Add(time.Hour))
+	chtime("b.go", base.Add(2*time.Hour))
+	chtime("d", base)
+
+	SetAttrCacheTTL(time.Minute)
+	defer SetAttrCacheTTL(0)
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			fs, err := impl.newFS(ws)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.Track("src/ws/a.go", filepath.Join(ws, "a.go"), false)
+			fs.Track("src/ws/b.go", filepath.Join(ws, "b.go"), false)
+			fs.TrackSource("src/x/d", Source{Actual: filepath.Join(ws, "d"), Dir: true})
+			attr := func(virtual string) *fuse.Attr {
+				t.Helper()
+				e, _ := fs.MatchPath(virtual)
+				attr, err := e.Attr()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return attr
+			}
+			// expectNewest checks the times of the synthetic directory are
+			// the newest of the children.
+			expectNewest := func(dir string, children ...string) {
+				t.Helper()
+				var mtime, ctime time.Time
+				for _, c := range children {
+					ca := attr(c)
+					if ca.ModTime().After(mtime) {
+						mtime = ca.ModTime()
+					}
+					if ca.ChangeTime().After(ctime) {
+						ctime = ca.ChangeTime()
+					}
+				}
+				da := attr(dir)
+				if !da.ModTime().Equal(mtime) || !da.ChangeTime().Equal(ctime) {
+					t.Errorf("times of %s are %v, %v, want the newest of %v: %v, %v", dir, da.ModTime(), da.ChangeTime(), children, mtime, ctime)
+				}
+			}
+
+			if uid := attr("src/ws").Uid; uid != uint32(os.Getuid()) {
+				t.Errorf("synthetic directory owned by %d, want %d", uid, os.Getuid())
+			}
+			expectNewest("src/ws", "src/ws/a.go", "src/ws/b.go")
+			if got := attr("src/ws").ModTime(); !got.Equal(base.Add(2 * time.Hour)) {
+				t.Errorf("mtime of src/ws is %v, want the mtime of b.go", got)
+			}
+			expectNewest("src", "src/ws/a.go", "src/ws/b.go", "src/x/d")
+
+			// The content of a child changes.
+			chtime("a.go", base.Add(3*time.Hour))
+			expectNewest("src/ws", "src/ws/a.go", "src/ws/b.go")
+			if got := attr("src").ModTime(); !got.Equal(base.Add(3 * time.Hour)) {
+				t.Errorf("mtime of src is %v after a.go changed, want the mtime of a.go", got)
+			}
+
+			// The newest child is removed.
+			if err := fs.Untrack("src/ws/a.go"); err != nil {
+				t.Fatal(err)
+			}
+			expectNewest("src/ws", "src/ws/b.go")
+			chtime("a.go", base.Add(time.Hour))
+		})
+	}
+}
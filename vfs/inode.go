@@ -0,0 +1,84 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+)
+
+// rootIno is the inode number of the root directory, as required by FUSE.
+const rootIno = 1
+
+// linkedIno is set in the inode numbers of the hard linked files, the
+// virtual inode numbers don't have it.
+const linkedIno = 1 << 63
+
+// inodes allocates the virtual inode numbers. The inode number of a virtual
+// file is the FNV-64a hash of its virtual path, so it's stable across
+// restarts, unless it collides with another virtual file in which case the
+// next free number is taken. The hard linked files get the inode number of
+// the actual file instead, see linkIno.
+type inodes struct {
+	mu   sync.Mutex
+	used map[uint64]struct{}
+}
+
+func newInodes() *inodes {
+	return &inodes{
+		used: map[uint64]struct{}{rootIno: {}},
+	}
+}
+
+// alloc allocates the inode number for the virtual path.
+func (in *inodes) alloc(virtual string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(virtual))
+	ino := h.Sum64() &^ linkedIno
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for _, ok := in.used[ino]; ok || ino == 0; _, ok = in.used[ino] {
+		ino = (ino + 1) &^ linkedIno
+	}
+	in.used[ino] = struct{}{}
+	return ino
+}
+
+// linkIno returns the inode number shared by the virtual files of the hard
+// links of an actual file, the FNV-64a hash of its device and inode numbers.
+// Unlike the virtual inode numbers, they're not checked for collisions.
+func linkIno(dev, ino uint64) uint64 {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], dev)
+	binary.LittleEndian.PutUint64(b[8:], ino)
+	h := fnv.New64a()
+	h.Write(b[:])
+	return h.Sum64() | linkedIno
+}
+
+// release releases the inode number for reuse.
+func (in *inodes) release(ino uint64) {
+	if ino == rootIno {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	delete(in.used, ino)
+}
+
+// releaseInos releases the inode numbers of the removed entry and its
+// descendants.
+func releaseInos(in *inodes, e Entry) {
+	walker, ok := e.(interface {
+		walk(virtual string, fn func(virtual string, e Entry))
+	})
+	if !ok {
+		in.release(e.Ino())
+		return
+	}
+	walker.walk("", func(_ string, c Entry) {
+		in.release(c.Ino())
+	})
+}
@@ -0,0 +1,77 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHardLinksShareIno(t *testing.T) {
+	ws := t.TempDir()
+	for _, name := range []string{"a.go", "c.go"} {
+		if err := ioutil.WriteFile(filepath.Join(ws, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(ws, "a.go"), filepath.Join(ws, "b.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			fs, err := impl.newFS(ws)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"a.go", "b.go", "c.go"} {
+				fs.TrackSource("src/"+name, Source{Actual: filepath.Join(ws, name)})
+			}
+			ino := func(virtual string) uint64 {
+				e, _ := fs.MatchPath(virtual)
+				attr, err := e.Attr()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return attr.Ino
+			}
+
+			a, b, c := ino("src/a.go"), ino("src/b.go"), ino("src/c.go")
+			if a != b {
+				t.Errorf("hard links have inodes %d and %d, expected the same", a, b)
+			}
+			if a == c {
+				t.Errorf("unrelated files have the same inode %d", a)
+			}
+			if e, _ := fs.MatchPath("src/c.go"); c != e.Ino() {
+				t.Errorf("inode of unlinked file is %d, expected the virtual inode %d", c, e.Ino())
+			}
+
+			var found int
+			src, _ := fs.MatchPath("src")
+			for _, de := range src.Children() {
+				if de.Name == "a.go" || de.Name == "b.go" {
+					found++
+					if de.Ino != a {
+						t.Errorf("directory entry %s has inode %d, expected %d", de.Name, de.Ino, a)
+					}
+				}
+			}
+			if found != 2 {
+				t.Errorf("found %d of the hard links in the directory entries, expected 2", found)
+			}
+		})
+	}
+}
+
+func TestVirtualInosNotLinked(t *testing.T) {
+	in := newInodes()
+	for _, virtual := range []string{"", "src", "src/a.go", "src/b/c.go"} {
+		if ino := in.alloc(virtual); ino&linkedIno != 0 || ino == 0 || ino == rootIno {
+			t.Errorf("inode of %q is %#x", virtual, ino)
+		}
+	}
+	if ino := linkIno(1, 2); ino&linkedIno == 0 {
+		t.Errorf("inode of the hard link is %#x, expected it to be marked linked", ino)
+	}
+}
@@ -5,9 +5,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	cli "github.com/urfave/cli/v2"
 	"golang.org/x/sys/unix"
 )
@@ -16,10 +20,23 @@ var (
 	verbose       bool
 	pathSeparator = string(os.PathSeparator)
 
-	defaultDirAttr = fuse.Attr{
+	// defaultDirAttr is the attrs of the synthetic directories, owned by
+	// the mounting user. The times are the newest of their children, the
+	// start time if they have none.
+	defaultDirAttr = newDefaultDirAttr(time.Now())
+)
+
+func newDefaultDirAttr(t time.Time) fuse.Attr {
+	attr := fuse.Attr{
 		Mode: fuse.S_IFDIR | 0755,
+		Owner: fuse.Owner{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		},
 	}
-)
+	attr.SetTimes(&t, &t, &t)
+	return attr
+}
 
 // Init initialize the gopathfs package.
 func Init(ctx *cli.Context) {
@@ -33,18 +50,147 @@ type FileSystem interface {
 	// remaining unmatched paths.
 	MatchPath(virtual string) (Entry, []string)
 
-	// Track tracks the mapping from virtual file to the actual file.
+	// Track tracks the mapping from virtual file to the actual file, as a
+	// source with priority 0. It's safe to call concurrently.
 	Track(virtual, actual string, readonly bool)
 
-	// Untrack removes the mapping from the given virtual file.
+	// TrackSource adds the actual file to the sources of the virtual file,
+	// or updates it if it's already one. The virtual file is mapped to the
+	// source ranking first.
+	TrackSource(virtual string, src Source)
+
+	// Untrack removes the mapping from the given virtual file and its
+	// descendants. The actual files are left untouched.
 	Untrack(virtual string) error
 
+	// UntrackSource removes the actual file from the sources of the virtual
+	// file. If it was the mapped source, the next one shows through. The
+	// virtual file and its descendants are untracked once no source is
+	// left.
+	UntrackSource(virtual, actual string) error
+
+	// Move moves the virtual file and its descendants to newVirtual,
+	// replacing the entry there if any, once the actual file was renamed to
+	// newActual. The parent of newVirtual must exist. The moved entries keep
+	// their inode numbers. Only the mapped source of the replaced entry is
+	// replaced, the sources it shadowed are added to the moved entry. It
+	// fails with os.ErrExist if the replaced entry has several sources and
+	// descendants, which source they come from isn't known.
+	Move(oldVirtual, newVirtual, newActual string) error
+
+	// Exchange swaps the virtual files and their descendants, once their
+	// actual files were exchanged. Each keeps its actual path.
+	Exchange(virtual1, virtual2 string) error
+
+	// Walk calls fn for every entry in the tree, parents before their
+	// children. It's safe to call concurrently with Track and Untrack.
+	Walk(fn func(virtual string, e Entry))
+
+	// SourcesByPriority returns the number of the sources tracked in the
+	// tree by their priorities. It's kept up to date as they're tracked,
+	// rather than counted.
+	SourcesByPriority() map[int]int
+
 	String() string
 }
 
+// MaxPriority is the priority of the sources ranking after all the others.
+const MaxPriority = 1<<16 - 1
+
+// Source is an actual file contributing to a virtual file. When several
+// actual files are tracked at the same virtual file, the one with the lowest
+// priority is mapped, the ties are broken by the actual paths so that the
+// order doesn't depend on the order they are tracked in.
+type Source struct {
+	Actual   string
+	Readonly bool
+	// Priority is between 0 and MaxPriority.
+	Priority int
+	// Dir is true if the actual file is a directory, the nlink of the
+	// virtual directories is counted from their tracked subdirectories.
+	Dir bool
+}
+
+// before returns true if s ranks before o.
+func (s Source) before(o Source) bool {
+	if s.Priority != o.Priority {
+		return s.Priority < o.Priority
+	}
+	return s.Actual < o.Actual
+}
+
+// addSource adds src to the sorted sources, replacing the source of the same
+// actual file.
+func addSource(sources []Source, src Source) []Source {
+	sources, _ = removeSource(sources, src.Actual)
+	i := sort.Search(len(sources), func(i int) bool {
+		return src.before(sources[i])
+	})
+	sources = append(sources, Source{})
+	copy(sources[i+1:], sources[i:])
+	sources[i] = src
+	return sources
+}
+
+// removeSource removes the source of the actual file from the sources, and
+// returns false if there is none.
+func removeSource(sources []Source, actual string) ([]Source, bool) {
+	for i, s := range sources {
+		if s.Actual == actual {
+			return append(sources[:i:i], sources[i+1:]...), true
+		}
+	}
+	return sources, false
+}
+
+// rebaseSources changes the actual paths of the sources in oldActual to
+// newActual.
+func rebaseSources(sources []Source, oldActual, newActual string) {
+	for i, s := range sources {
+		if actual, ok := rebasePath(s.Actual, oldActual, newActual); ok {
+			sources[i].Actual = actual
+		}
+	}
+}
+
+// sourceRanks counts the sources tracked in a tree by their priorities. It's
+// guarded by the lock serializing the changes to the tree.
+type sourceRanks map[int]int
+
+// count adds delta to the counts of the sources.
+func (r sourceRanks) count(sources []Source, delta int) {
+	for _, s := range sources {
+		if r[s.Priority] += delta; r[s.Priority] == 0 {
+			delete(r, s.Priority)
+		}
+	}
+}
+
+// countTree adds delta to the counts of the sources of the entry and its
+// descendants.
+func (r sourceRanks) countTree(e *entry, delta int) {
+	e.walk("", func(_ string, c Entry) {
+		r.count(c.Sources(), delta)
+	})
+}
+
+func (r sourceRanks) copy() map[int]int {
+	m := make(map[int]int, len(r))
+	for k, v := range r {
+		m[k] = v
+	}
+	return m
+}
+
 type fileSystem struct {
 	root   entry
 	actual string
+	inodes *inodes
+
+	// trackMu serializes the changes to the tree, so that concurrent Track
+	// calls don't create the same intermediate entries twice.
+	trackMu sync.Mutex
+	ranks   sourceRanks
 }
 
 // Make sure *fileSystem implements FileSystem.
@@ -70,19 +216,43 @@ func (fs *fileSystem) MatchPath(virtual string) (matched Entry, remPath []string
 }
 
 func (fs *fileSystem) Track(virtual, actual string, readonly bool) {
+	fs.TrackSource(virtual, Source{Actual: actual, Readonly: readonly})
+}
+
+func (fs *fileSystem) TrackSource(virtual string, src Source) {
 	if verbose {
-		log.Printf("track file %s => %s\n", virtual, actual)
+		log.Printf("track file %s => %s, priority %d\n", virtual, src.Actual, src.Priority)
 	}
+	fs.trackMu.Lock()
+	defer fs.trackMu.Unlock()
+
 	parent, remPath := fs.MatchPath(virtual)
+	if len(remPath) == 0 {
+		// An intermediate directory gets mapped to the actual directory, or
+		// the actual file is added to the sources.
+		if e, ok := parent.(*entry); ok && src.Actual != "" && e.Parent() != nil {
+			sources := e.Sources()
+			fs.ranks.count(sources, -1)
+			sources = addSource(sources, src)
+			fs.ranks.count(sources, 1)
+			e.setSources(sources)
+		}
+		return
+	}
+	dirs := strings.Split(virtual, pathSeparator)
 	for i, rp := range remPath {
 		e := entry{
 			virtual:  rp,
 			parent:   parent,
 			children: map[string]Entry{},
-			readonly: readonly,
+			readonly: src.Readonly,
+			ino:      fs.inodes.alloc(strings.Join(dirs[:len(dirs)-len(remPath)+i+1], pathSeparator)),
 		}
 		if i == len(remPath)-1 {
-			e.actual = actual
+			e.actual = src.Actual
+			e.priority = src.Priority
+			e.dir = src.Dir
+			fs.ranks.count(e.Sources(), 1)
 		}
 		parent.SetChild(rp, &e)
 		parent = &e
@@ -93,20 +263,184 @@ func (fs *fileSystem) Untrack(virtual string) error {
 	if verbose {
 		log.Printf("untrack file %s\n", virtual)
 	}
+	fs.trackMu.Lock()
+	defer fs.trackMu.Unlock()
+
 	parent, remPath := fs.MatchPath(virtual)
 	if len(remPath) > 0 {
 		return os.ErrNotExist
 	}
-	if err := os.RemoveAll(parent.Actual()); err != nil {
-		return err
-	}
 	if parent.Parent() == nil {
 		return nil
 	}
 	parent.Parent().DeleteChild(parent.Virtual())
+	fs.release(parent)
+	return nil
+}
+
+func (fs *fileSystem) UntrackSource(virtual, actual string) error {
+	if verbose {
+		log.Printf("untrack file %s => %s\n", virtual, actual)
+	}
+	fs.trackMu.Lock()
+	defer fs.trackMu.Unlock()
+
+	m, remPath := fs.MatchPath(virtual)
+	if len(remPath) > 0 {
+		return os.ErrNotExist
+	}
+	e, ok := m.(*entry)
+	if !ok || e.Parent() == nil {
+		return nil
+	}
+	sources, ok := removeSource(e.Sources(), actual)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if len(sources) > 0 {
+		fs.ranks.count(e.Sources(), -1)
+		fs.ranks.count(sources, 1)
+		e.setSources(sources)
+		return nil
+	}
+	e.Parent().DeleteChild(e.Virtual())
+	fs.release(e)
+	return nil
+}
+
+func (fs *fileSystem) Move(oldVirtual, newVirtual, newActual string) error {
+	if verbose {
+		log.Printf("move file %s to %s => %s\n", oldVirtual, newVirtual, newActual)
+	}
+	fs.trackMu.Lock()
+	defer fs.trackMu.Unlock()
+
+	e, err := fs.movable(oldVirtual)
+	if err != nil {
+		return err
+	}
+	parent, remPath := fs.MatchPath(filepath.Dir(newVirtual))
+	if len(remPath) > 0 {
+		return os.ErrNotExist
+	}
+	name := filepath.Base(newVirtual)
+	var shadowed []Source
+	if old := parent.GetChild(name); old != nil {
+		if old == Entry(e) {
+			return nil
+		}
+		if sources := old.Sources(); len(sources) > 1 {
+			if oe, ok := old.(*entry); ok && oe.hasChildren() {
+				return os.ErrExist
+			}
+			shadowed = sources[1:]
+		}
+		fs.release(old)
+	}
+	oldActual := e.Actual()
+	e.Parent().DeleteChild(e.Virtual())
+	e.place(parent, name)
+	parent.SetChild(name, e)
+	e.rebase(oldActual, newActual)
+	if len(shadowed) > 0 {
+		sources := e.Sources()
+		fs.ranks.count(sources, -1)
+		for _, s := range shadowed {
+			sources = addSource(sources, s)
+		}
+		fs.ranks.count(sources, 1)
+		e.setSources(sources)
+	}
 	return nil
 }
 
+func (fs *fileSystem) Exchange(virtual1, virtual2 string) error {
+	if verbose {
+		log.Printf("exchange file %s and %s\n", virtual1, virtual2)
+	}
+	fs.trackMu.Lock()
+	defer fs.trackMu.Unlock()
+
+	e1, err := fs.movable(virtual1)
+	if err != nil {
+		return err
+	}
+	e2, err := fs.movable(virtual2)
+	if err != nil {
+		return err
+	}
+	p1, n1, a1 := e1.Parent(), e1.Virtual(), e1.Actual()
+	p2, n2, a2 := e2.Parent(), e2.Virtual(), e2.Actual()
+	p1.DeleteChild(n1)
+	p2.DeleteChild(n2)
+	e1.place(p2, n2)
+	e2.place(p1, n1)
+	p2.SetChild(n2, e1)
+	p1.SetChild(n1, e2)
+	e1.rebase(a1, a2)
+	e2.rebase(a2, a1)
+	return nil
+}
+
+// release releases the inode numbers of the removed entry and its
+// descendants, and stops counting their sources.
+func (fs *fileSystem) release(e Entry) {
+	if ce, ok := e.(*entry); ok {
+		fs.ranks.countTree(ce, -1)
+	}
+	releaseInos(fs.inodes, e)
+}
+
+// movable returns the entry of the virtual file to move, it can't be the
+// root.
+func (fs *fileSystem) movable(virtual string) (*entry, error) {
+	m, remPath := fs.MatchPath(virtual)
+	if len(remPath) > 0 {
+		return nil, os.ErrNotExist
+	}
+	e, ok := m.(*entry)
+	if !ok || e.Parent() == nil {
+		return nil, os.ErrInvalid
+	}
+	return e, nil
+}
+
+// rebase changes the actual paths of the entry and its descendants in
+// oldActual to newActual.
+func (e *entry) rebase(oldActual, newActual string) {
+	e.walk("", func(_ string, c Entry) {
+		if ce, ok := c.(*entry); ok {
+			ce.rebaseSources(oldActual, newActual)
+		}
+	})
+}
+
+// rebasePath returns the path moved from the oldDir to the newDir, if it's in
+// the oldDir.
+func rebasePath(path, oldDir, newDir string) (string, bool) {
+	if oldDir == "" {
+		return "", false
+	}
+	if path == oldDir {
+		return newDir, true
+	}
+	if strings.HasPrefix(path, oldDir+pathSeparator) {
+		return newDir + path[len(oldDir):], true
+	}
+	return "", false
+}
+
+func (fs *fileSystem) Walk(fn func(virtual string, e Entry)) {
+	fs.root.walk("", fn)
+}
+
+func (fs *fileSystem) SourcesByPriority() map[int]int {
+	fs.trackMu.Lock()
+	defer fs.trackMu.Unlock()
+
+	return fs.ranks.copy()
+}
+
 func (fs *fileSystem) String() string {
 	var buf bytes.Buffer
 	fs.printEntry(&fs.root, &buf, "")
@@ -126,8 +460,13 @@ func New(actual string) (FileSystem, error) {
 			actual:   actual,
 			parent:   nil,
 			children: map[string]Entry{},
+			dir:      true,
+			ino:      rootIno,
 		},
+		inodes: newInodes(),
+		ranks:  sourceRanks{},
 	}
+	fs.ranks.count(fs.root.Sources(), 1)
 
 	for _, v := range []string{"bin", "pkg", "src"} {
 		fs.root.children[v] = &entry{
@@ -135,15 +474,24 @@ func New(actual string) (FileSystem, error) {
 			actual:   "",
 			parent:   &fs.root,
 			children: map[string]Entry{},
+			ino:      fs.inodes.alloc(v),
 		}
 	}
 	return &fs, nil
 }
 
+// getRealDirAttr returns the attrs of the actual file. The inode number is
+// only set for the hard linked regular files, the others get the virtual
+// inode number.
 func getRealDirAttr(actual string) (*fuse.Attr, error) {
 	st := unix.Stat_t{}
 	if err := unix.Lstat(actual, &st); err != nil {
 		return nil, err
 	}
-	return unixAttrToFuseAttr(&st), nil
+	attr := unixAttrToFuseAttr(&st)
+	attr.Ino = 0
+	if st.Mode&unix.S_IFMT == unix.S_IFREG && st.Nlink > 1 {
+		attr.Ino = linkIno(uint64(st.Dev), st.Ino)
+	}
+	return attr, nil
 }
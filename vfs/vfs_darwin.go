@@ -1,7 +1,7 @@
 package vfs
 
 import (
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
 )
 
@@ -11,6 +11,11 @@ func unixAttrToFuseAttr(from *unix.Stat_t) (result *fuse.Attr) {
 	result.Size = uint64(from.Size)
 	result.Blocks = uint64(from.Blocks)
 	result.Mode = uint32(from.Mode)
+	result.Nlink = uint32(from.Nlink)
+	result.Uid = from.Uid
+	result.Gid = from.Gid
+	result.Rdev = uint32(from.Rdev)
+	result.Blksize = uint32(from.Blksize)
 
 	sec, nsec := from.Atimespec.Unix()
 	result.Atime = uint64(sec)
@@ -0,0 +1,129 @@
+package vfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// walkSources counts the sources in the tree by their priorities.
+func walkSources(fs FileSystem) map[int]int {
+	ranks := map[int]int{}
+	fs.Walk(func(_ string, e Entry) {
+		for _, src := range e.Sources() {
+			ranks[src.Priority]++
+		}
+	})
+	return ranks
+}
+
+func TestSourcesByPriority(t *testing.T) {
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			fs, err := impl.newFS(".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := func(step string, want map[int]int) {
+				t.Helper()
+				got := fs.SourcesByPriority()
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("after %s, sources by priority %v, want %v", step, got, want)
+				}
+				if walked := walkSources(fs); !reflect.DeepEqual(got, walked) {
+					t.Errorf("after %s, sources by priority %v, walked %v", step, got, walked)
+				}
+			}
+
+			check("creation", map[int]int{0: 1})
+			fs.Track("src/ws/a", "a", false)
+			fs.Track("src/ws/a/f.go", "a/f.go", false)
+			fs.TrackSource("src/ws/a/g.go", Source{Actual: "gen/a/g.go", Priority: 2})
+			check("tracking", map[int]int{0: 3, 2: 1})
+
+			fs.TrackSource("src/ws/a/g.go", Source{Actual: "gen/a/g.go", Priority: 1})
+			fs.TrackSource("src/ws/a/f.go", Source{Actual: "gen/a/f.go", Priority: 2})
+			check("tracking again", map[int]int{0: 3, 1: 1, 2: 1})
+
+			if err := fs.UntrackSource("src/ws/a/f.go", "a/f.go"); err != nil {
+				t.Fatal(err)
+			}
+			check("untracking a source", map[int]int{0: 2, 1: 1, 2: 1})
+
+			fs.Track("src/ws/b", "b", false)
+			fs.Track("src/ws/b/h.go", "b/h.go", false)
+			if err := fs.Move("src/ws/a/g.go", "src/ws/b/h.go", "b/h.go"); err != nil {
+				t.Fatal(err)
+			}
+			check("moving over a file", map[int]int{0: 3, 1: 1, 2: 1})
+
+			if err := fs.Untrack("src/ws/a"); err != nil {
+				t.Fatal(err)
+			}
+			check("untracking a directory", map[int]int{0: 2, 1: 1})
+		})
+	}
+}
+
+func TestMoveOverShadowingSource(t *testing.T) {
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			fs, err := impl.newFS(".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.Track("src/ws/a", "a", false)
+			fs.Track("src/ws/a/f.go", "a/f.go", false)
+			fs.TrackSource("src/ws/a/f.go", Source{Actual: "gen/a/f.go", Readonly: true, Priority: 1})
+			fs.Track("src/ws/a/.f.go.tmp", "a/.f.go.tmp", false)
+
+			// An atomic save over the hand-written file.
+			if err := fs.Move("src/ws/a/.f.go.tmp", "src/ws/a/f.go", "a/f.go"); err != nil {
+				t.Fatal(err)
+			}
+			e, _ := fs.MatchPath("src/ws/a/f.go")
+			want := []Source{{Actual: "a/f.go"}, {Actual: "gen/a/f.go", Readonly: true, Priority: 1}}
+			if got := e.Sources(); !reflect.DeepEqual(got, want) {
+				t.Errorf("sources after the move %v, want %v", got, want)
+			}
+			if ranks, walked := fs.SourcesByPriority(), walkSources(fs); !reflect.DeepEqual(ranks, walked) {
+				t.Errorf("sources by priority %v, walked %v", ranks, walked)
+			}
+
+			// The generated file shows through once the hand-written one is
+			// deleted.
+			if err := fs.UntrackSource("src/ws/a/f.go", "a/f.go"); err != nil {
+				t.Fatal(err)
+			}
+			e, remPath := fs.MatchPath("src/ws/a/f.go")
+			if len(remPath) > 0 {
+				t.Fatal("virtual file untracked along with the moved source")
+			}
+			if got := e.Actual(); got != "gen/a/f.go" {
+				t.Errorf("actual file %q after untracking the moved source, want gen/a/f.go", got)
+			}
+		})
+	}
+}
+
+func TestMoveOverMergedDirectory(t *testing.T) {
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			fs, err := impl.newFS(".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.TrackSource("src/ws/a", Source{Actual: "a", Dir: true})
+			fs.TrackSource("src/ws/a", Source{Actual: "gen/a", Dir: true, Priority: 1})
+			fs.TrackSource("src/ws/a/x.pb.go", Source{Actual: "gen/a/x.pb.go", Priority: 1})
+			fs.TrackSource("src/ws/b", Source{Actual: "b", Dir: true})
+
+			if err := fs.Move("src/ws/b", "src/ws/a", "a"); err != os.ErrExist {
+				t.Errorf("move over a merged directory got %v, want %v", err, os.ErrExist)
+			}
+			if _, remPath := fs.MatchPath("src/ws/a/x.pb.go"); len(remPath) > 0 {
+				t.Error("child of the merged directory untracked")
+			}
+		})
+	}
+}